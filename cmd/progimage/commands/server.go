@@ -8,7 +8,11 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/j0hnsmith/progimage"
+	"github.com/j0hnsmith/progimage/fs"
 	"github.com/j0hnsmith/progimage/http"
+	primage "github.com/j0hnsmith/progimage/image"
+	"github.com/j0hnsmith/progimage/memory"
 	"github.com/j0hnsmith/progimage/s3"
 	"github.com/minio/minio-go"
 	"github.com/spf13/cobra"
@@ -20,6 +24,28 @@ var accessKey string
 var secretKey string
 var endpoint string
 var secure *bool
+var storage string
+var dataDir string
+var memoryMaxBytes int64
+var contentAddressed bool
+var cacheDerivatives bool
+var derivativeCacheBytes int64
+var autoFormat bool
+var maxQuality int
+var minColors int
+var maxUploadBytes int64
+var maxWidth int
+var maxHeight int
+var maxMegapixels float64
+var maxWork float64
+var stripMetadata bool
+var disableFetch bool
+var fetchTimeout time.Duration
+var fetchMaxBytes int64
+var fetchAllowHosts []string
+var fetchDenyHosts []string
+var batchMaxItems int
+var batchConcurrency int
 
 func init() {
 	rootCmd.AddCommand(serverCmd)
@@ -29,30 +55,133 @@ func init() {
 	serverCmd.Flags().StringVarP(&secretKey, "secretkey", "s", "miniostorage", "Storage secret key")
 	serverCmd.Flags().StringVarP(&endpoint, "endpoint", "e", "", "Storage endpoint")
 	secure = serverCmd.Flags().Bool("secure", false, "Secure storage eg TLS")
-	err := serverCmd.MarkFlagRequired("endpoint")
-	if err != nil {
-		fmt.Fprintf(os.Stderr, err.Error()) // nolint: errcheck,gas
-		os.Exit(1)
+	serverCmd.Flags().StringVar(&storage, "storage", "s3", "Storage backend, s3, fs or memory")
+	serverCmd.Flags().StringVarP(&dataDir, "data-dir", "d", "", "Data directory (fs storage)")
+	serverCmd.Flags().BoolVar(&contentAddressed, "content-addressed", false, "Store images by hash of their data so duplicate uploads share an id (s3 storage)")
+	serverCmd.Flags().Int64Var(&memoryMaxBytes, "memory-max-bytes", 0, "Max bytes of images to keep, least recently used are evicted, 0 for no limit (memory storage)")
+	serverCmd.Flags().BoolVar(&cacheDerivatives, "cache-derivatives", false, "Store transformed images so each transformation is only done once")
+	serverCmd.Flags().Int64Var(&derivativeCacheBytes, "derivative-cache-bytes", 0, "Max bytes of transformed images to keep in memory in front of storage, 0 to only use storage (memory storage has no limit)")
+	serverCmd.Flags().BoolVar(&autoFormat, "auto-format", false, "Choose the format of images requested without an extension from the Accept header, as if ?auto=format was set")
+	serverCmd.Flags().IntVar(&maxQuality, "max-quality", 95, "Max encoding quality clients can request with ?q=")
+	serverCmd.Flags().IntVar(&minColors, "min-colors", 16, "Min gif palette size clients can request with ?colors=")
+	serverCmd.Flags().Int64Var(&maxUploadBytes, "max-upload-bytes", primage.DefaultMaxUploadBytes, "Max size of an uploaded image, larger uploads get a 413")
+	serverCmd.Flags().IntVar(&maxWidth, "max-width", primage.DefaultLimits.MaxWidth, "Max width of an image that's uploaded or transformed, larger images get a 422")
+	serverCmd.Flags().IntVar(&maxHeight, "max-height", primage.DefaultLimits.MaxHeight, "Max height of an image that's uploaded or transformed, larger images get a 422")
+	serverCmd.Flags().Float64Var(&maxMegapixels, "max-megapixels", float64(primage.DefaultLimits.MaxPixels)/1e6, "Max width * height in millions of pixels of an image that's uploaded or transformed, larger images get a 422")
+	serverCmd.Flags().Float64Var(&maxWork, "max-work", float64(primage.DefaultLimits.MaxWork)/1e6, "Max millions of pixels the operations of a transformation can process, eg blur is 2 * kernel size per pixel, more gets a 400")
+	serverCmd.Flags().BoolVar(&stripMetadata, "strip-metadata", false, "Remove EXIF (including GPS location), XMP and ICC metadata from original images as they're served")
+	serverCmd.Flags().BoolVar(&disableFetch, "disable-fetch", false, "Don't allow images to be uploaded by url")
+	serverCmd.Flags().DurationVar(&fetchTimeout, "fetch-timeout", 10*time.Second, "Max time to download an image uploaded by url")
+	serverCmd.Flags().Int64Var(&fetchMaxBytes, "fetch-max-bytes", 0, "Max size of an image uploaded by url, 0 for --max-upload-bytes")
+	serverCmd.Flags().StringSliceVar(&fetchAllowHosts, "fetch-allow-hosts", nil, "Only allow images to be uploaded from these hosts (and subdomains) by url")
+	serverCmd.Flags().StringSliceVar(&fetchDenyHosts, "fetch-deny-hosts", nil, "Never allow images to be uploaded from these hosts (and subdomains) by url")
+	serverCmd.Flags().IntVar(&batchMaxItems, "batch-max-items", 100, "Max images in a batch upload or batch get request")
+	serverCmd.Flags().IntVar(&batchConcurrency, "batch-concurrency", 4, "Max images of a batch request to store or transform at the same time")
+}
+
+// limits returns the image limits for the max-width, max-height, max-megapixels and max-work flags.
+func limits() primage.Limits {
+	return primage.Limits{
+		MaxWidth:  maxWidth,
+		MaxHeight: maxHeight,
+		MaxPixels: int64(maxMegapixels * 1e6),
+		MaxWork:   int64(maxWork * 1e6),
 	}
 }
 
+// newImageService creates the image service for the storage flag.
+func newImageService() (progimage.ImageService, error) {
+	switch storage {
+	case "s3":
+		if endpoint == "" {
+			return nil, fmt.Errorf("--endpoint is required for s3 storage")
+		}
+		c, err := minio.New(endpoint, accessKey, secretKey, *secure)
+		if err != nil {
+			return nil, err
+		}
+
+		is := s3.NewImageService(bucketName, c, uuid.New)
+		is.ContentAddressed = contentAddressed
+		is.MaxUploadBytes = maxUploadBytes
+		is.Limits = limits()
+		if err := is.EnsureBucket(); err != nil {
+			fmt.Fprintf(os.Stdout, "error checking bucket exists: %+v\n", err) // nolint: gas,errcheck
+		}
+		return is, nil
+	case "fs":
+		if dataDir == "" {
+			return nil, fmt.Errorf("--data-dir is required for fs storage")
+		}
+		is := fs.NewImageService(dataDir, uuid.New)
+		is.MaxUploadBytes = maxUploadBytes
+		is.Limits = limits()
+		if err := is.EnsureDir(); err != nil {
+			return nil, err
+		}
+		return is, nil
+	case "memory":
+		is := memory.NewImageService(memoryMaxBytes, uuid.New)
+		is.MaxUploadBytes = maxUploadBytes
+		is.Limits = limits()
+		return is, nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", storage)
+}
+
+// newDerivativeStore creates the derivative store for the cache flags, nil if derivatives aren't cached.
+func newDerivativeStore(is progimage.ImageService) progimage.DerivativeStore {
+	if !cacheDerivatives {
+		return nil
+	}
+	ds, ok := is.(progimage.DerivativeStore)
+	if !ok {
+		// storage can't hold them, keep them in memory
+		return memory.NewDerivativeCache(derivativeCacheBytes, nil)
+	}
+	if derivativeCacheBytes > 0 {
+		return memory.NewDerivativeCache(derivativeCacheBytes, ds)
+	}
+	return ds
+}
+
+// newFetcher creates the fetcher for the fetch flags, nil if fetching is disabled.
+func newFetcher() *http.Fetcher {
+	if disableFetch {
+		return nil
+	}
+	f := http.NewFetcher()
+	f.Timeout = fetchTimeout
+	f.MaxBytes = maxUploadBytes
+	if fetchMaxBytes > 0 {
+		f.MaxBytes = fetchMaxBytes
+	}
+	f.AllowHosts = fetchAllowHosts
+	f.DenyHosts = fetchDenyHosts
+	return f
+}
+
 var serverCmd = &cobra.Command{
 	Use:   "server",
 	Short: "Runs an image processing http server",
 	Long:  "Runs an image processing http server",
 	Args:  cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		c, err := minio.New(endpoint, accessKey, secretKey, *secure)
+		is, err := newImageService()
 		if err != nil {
 			return err
 		}
-
-		uuid.New()
-		is := s3.NewImageService(bucketName, c, uuid.New)
-		if err := is.EnsureBucket(); err != nil {
-			fmt.Fprintf(os.Stdout, "error checking bucket exists: %+v\n", err) // nolint: gas,errcheck
-		}
 		ih := http.NewImageHandler(is)
+		ih.Derivatives = newDerivativeStore(is)
+		ih.AutoFormat = autoFormat
+		ih.MaxQuality = maxQuality
+		ih.MinColors = minColors
+		ih.MaxUploadBytes = maxUploadBytes
+		ih.Limits = limits()
+		ih.StripMetadata = stripMetadata
+		ih.Fetcher = newFetcher()
+		ih.BatchMaxItems = batchMaxItems
+		ih.BatchConcurrency = batchConcurrency
 		s := http.Server{
 			ImageHandler: *ih,
 			Addr:         addr,
@@ -0,0 +1,101 @@
+package commands
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
+	"github.com/j0hnsmith/progimage/image/gif"
+	"github.com/j0hnsmith/progimage/image/jpeg"
+	"github.com/j0hnsmith/progimage/image/png"
+	"github.com/j0hnsmith/progimage/image/webp"
+	"github.com/spf13/cobra"
+)
+
+var ops string
+var format string
+var encodeOpts primage.EncodeOptions
+
+var transformers = map[string]primage.Transformer{
+	"png":  png.Transformer,
+	"jpg":  jpeg.Transformer,
+	"jpeg": jpeg.Transformer,
+	"gif":  gif.Transformer,
+	"webp": webp.Transformer,
+}
+
+func init() {
+	rootCmd.AddCommand(transformCmd)
+	transformCmd.Flags().StringVarP(&ops, "ops", "o", "", "Operations to apply eg 'resize:w=200,h=150,fit=cover|grayscale'")
+	transformCmd.Flags().StringVarP(&format, "format", "f", "", "Output format (png, jpg, gif or webp), defaults to the output file extension")
+	transformCmd.Flags().IntVarP(&encodeOpts.Quality, "quality", "q", 0, "Encoding quality 1-100 (jpg, webp), 0 for the default")
+	transformCmd.Flags().StringVar(&encodeOpts.Compression, "compression", "", "Compression, default, best, fast or none (png)")
+	transformCmd.Flags().IntVar(&encodeOpts.Colors, "colors", 0, "Palette size 2-256 (gif), 0 for the default")
+	transformCmd.Flags().BoolVar(&encodeOpts.Lossless, "lossless", false, "Lossless encoding, quality doesn't apply (webp)")
+}
+
+var transformCmd = &cobra.Command{
+	Use:   "transform <input file> <output file>",
+	Short: "Transforms an image file",
+	Long: `Transforms an image file by applying a pipeline of operations then encoding to the output format.
+
+Available operations (up to 10):
+  resize:w=<px>,h=<px>,fit=contain|cover|fill
+    fit=cover can also have focus=smart, to crop around the most interesting part of the image rather than its
+    centre, or fx=<0-1>,fy=<0-1>, to crop around that point (fractions of the width and height from the top left)
+  crop:x=<px>,y=<px>,w=<px>,h=<px>
+  rotate:deg=90|180|270
+  flip:dir=h|v
+  blur:sigma=<float, at most 10>
+  grayscale
+
+The server takes the same operations with ?ops=, or as query params: ?crop=x,y,w,h or ?crop=smart (with w and h),
+?rotate=, ?flip= and ?w=&h=&fit=. A focal point stored with PUT /image/{id}/focus is used for cover resizes.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		f := format
+		if f == "" {
+			f = strings.TrimPrefix(filepath.Ext(args[1]), ".")
+		}
+		tr, ok := transformers[strings.ToLower(f)]
+		if !ok {
+			return fmt.Errorf("unsupported output format %q", f)
+		}
+
+		spec, err := primage.ParseSpec(ops)
+		if err != nil {
+			return err
+		}
+		p, err := primage.NewPipeline(spec, tr)
+		if err != nil {
+			return err
+		}
+		p.Options = encodeOpts
+
+		in, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer in.Close() // nolint: errcheck
+
+		img, err := p.Run(context.Background(), progimage.Image{ID: args[0], Data: in})
+		if err != nil {
+			return err
+		}
+
+		out, err := os.Create(args[1])
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, img.Data); err != nil {
+			out.Close() // nolint: errcheck,gas
+			return err
+		}
+		return out.Close()
+	},
+}
@@ -1,9 +1,101 @@
 package progimage
 
-import "errors"
+import (
+	"context"
+	"errors"
+)
 
 // ErrImageNotFound represents an image not found.
 var ErrImageNotFound = errors.New("image not found")
 
 // ErrUnrecognisedImageType represents image data that can't be processed.
 var ErrUnrecognisedImageType = errors.New("unrecognised image data")
+
+// ErrImageTooLarge represents image data larger than is accepted.
+var ErrImageTooLarge = errors.New("image too large")
+
+// ErrImageDimensions represents an image with more pixels than can be decoded.
+var ErrImageDimensions = errors.New("image dimensions too large")
+
+// ErrUnsupportedFormat represents an output format that images can't be encoded to.
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// ErrStorageUnavailable represents a storage backend that can't be reached or is failing, the request may succeed if
+// it's retried later.
+var ErrStorageUnavailable = errors.New("storage unavailable")
+
+// ErrInvalidTransform represents a transformation that can't be parsed or applied to an image.
+var ErrInvalidTransform = errors.New("invalid transform")
+
+// kinds are the Err* values KindOf looks for.
+var kinds = []error{
+	ErrImageNotFound,
+	ErrUnrecognisedImageType,
+	ErrImageTooLarge,
+	ErrImageDimensions,
+	ErrUnsupportedFormat,
+	ErrStorageUnavailable,
+	ErrInvalidTransform,
+}
+
+// Error adds context to one of the Err* values (Kind). Detail describes the problem and is safe to show users, Err is
+// the underlying error, if any, which may not be. errors.Is(err, Kind) is true.
+type Error struct {
+	Kind   error
+	Detail string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	s := e.Kind.Error()
+	if e.Detail != "" {
+		s += ", " + e.Detail
+	}
+	if e.Err != nil {
+		s += ", " + e.Err.Error()
+	}
+	return s
+}
+
+// Is reports whether target is the kind of error.
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// KindOf returns the Err* value err is, following errors wrapped by github.com/pkg/errors (Cause) and the standard
+// library (Unwrap, Is). nil is returned if err isn't one of them.
+func KindOf(err error) error {
+	for err != nil {
+		for _, k := range kinds {
+			if err == k {
+				return k
+			}
+			if i, ok := err.(interface{ Is(error) bool }); ok && i.Is(k) {
+				return k
+			}
+		}
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// StorageUnavailable returns an *Error of kind ErrStorageUnavailable for err from a storage backend. If ctx is done err
+// is only because the caller gave up, it's returned as is.
+func StorageUnavailable(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+	return &Error{Kind: ErrStorageUnavailable, Err: err}
+}
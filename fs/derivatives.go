@@ -0,0 +1,101 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/j0hnsmith/progimage"
+	"github.com/pkg/errors"
+)
+
+var _ progimage.DerivativeStore = &ImageService{}
+
+// derivativeDir is the directory holding all derivatives of an image, {Dir}/derived/ab/cd/abcd1234-.../ so they can
+// be deleted together. Shard directories are 2 characters so can't clash.
+func (is *ImageService) derivativeDir(ID string) string {
+	return filepath.Join(is.Dir, "derived", ID[0:2], ID[2:4], ID)
+}
+
+// GetDerivative retrieves the derivative of the image with the given id, Image.Data is an *os.File that should be
+// closed.
+func (is *ImageService) GetDerivative(ctx context.Context, ID, key string) (progimage.Image, error) {
+	ret := progimage.Image{}
+	if !validID.MatchString(ID) || !validID.MatchString(key) {
+		return ret, progimage.ErrImageNotFound
+	}
+
+	p := filepath.Join(is.derivativeDir(ID), key)
+	b, err := ioutil.ReadFile(p + ".json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, progimage.ErrImageNotFound
+		}
+		return ret, errors.Wrapf(err, "error reading derivative metadata %s", ID)
+	}
+	sc := sidecar{}
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return ret, errors.Wrapf(err, "error decoding derivative metadata %s", ID)
+	}
+
+	fp, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, progimage.ErrImageNotFound
+		}
+		return ret, errors.Wrapf(err, "error opening derivative %s", ID)
+	}
+
+	ret.ID = ID
+	ret.Data = fp
+	ret.ContentType = sc.ContentType
+	return ret, nil
+}
+
+// StoreDerivative persists a derivative of the image with the given id, key must be safe to use in a path (like an
+// id).
+func (is *ImageService) StoreDerivative(ctx context.Context, ID, key string, img progimage.Image) error {
+	if !validID.MatchString(ID) || !validID.MatchString(key) {
+		return errors.Errorf("invalid derivative %s %s", ID, key)
+	}
+
+	data, err := ioutil.ReadAll(img.Data)
+	if err != nil {
+		return errors.Wrap(err, "unable to read derivative data")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	sc, err := json.Marshal(sidecar{ContentType: img.ContentType})
+	if err != nil {
+		return errors.Wrap(err, "error encoding derivative metadata")
+	}
+
+	dir := is.derivativeDir(ID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "error creating derivative dir")
+	}
+	// as with images, the data file existing means the derivative exists so write it last
+	p := filepath.Join(dir, key)
+	if err := writeFile(p+".json", sc); err != nil {
+		return errors.Wrap(err, "error writing derivative metadata")
+	}
+	if err := writeFile(p, data); err != nil {
+		os.Remove(p + ".json") // nolint: errcheck,gas
+		return errors.Wrap(err, "error writing derivative")
+	}
+	return nil
+}
+
+// DeleteDerivatives removes all derivatives of the image with the given id.
+func (is *ImageService) DeleteDerivatives(ctx context.Context, ID string) error {
+	if !validID.MatchString(ID) {
+		return nil
+	}
+	if err := os.RemoveAll(is.derivativeDir(ID)); err != nil {
+		return errors.Wrapf(err, "error deleting derivatives %s", ID)
+	}
+	return nil
+}
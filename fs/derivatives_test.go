@@ -0,0 +1,56 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/j0hnsmith/progimage"
+)
+
+func TestImageService_Derivatives(t *testing.T) {
+	is, teardown := setup(t, uuid.New)
+	defer teardown()
+
+	ID := uuid.New().String()
+	key := "0123456789abcdef"
+
+	if _, err := is.GetDerivative(context.Background(), ID, key); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound, got %v", err)
+	}
+
+	d := []byte("not really a png")
+	if err := is.StoreDerivative(context.Background(), ID, key, progimage.Image{ID: ID, Data: bytes.NewReader(d), ContentType: "image/png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := is.GetDerivative(context.Background(), ID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.ContentType != "image/png" {
+		t.Errorf("expected content type 'image/png', got '%s'", img.ContentType)
+	}
+	retrieved, err := ioutil.ReadAll(img.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Data.(io.Closer).Close()
+	if !bytes.Equal(d, retrieved) {
+		t.Error("expected stored derivative to be equal to initial data, data not equal")
+	}
+
+	if err := is.StoreDerivative(context.Background(), ID, "../..", progimage.Image{Data: bytes.NewReader(d)}); err == nil {
+		t.Error("expected error storing derivative with unsafe key")
+	}
+
+	if err := is.DeleteDerivatives(context.Background(), ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := is.GetDerivative(context.Background(), ID, key); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound after delete, got %v", err)
+	}
+}
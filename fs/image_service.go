@@ -0,0 +1,296 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
+	"github.com/pkg/errors"
+)
+
+var _ progimage.ImageService = &ImageService{}
+
+// validID matches ids that are safe to use in a path, anything else can't have been created by Store.
+var validID = regexp.MustCompile(`^[0-9a-zA-Z][0-9a-zA-Z-]{3,}$`)
+
+// ImageService implements progimage.ImageService by storing images in a directory tree. Images are sharded into
+// sub directories by id prefix, eg {Dir}/ab/cd/abcd1234-..., with a {id}.json sidecar file holding the metadata.
+// File operations can't be cancelled, the context is checked before writing.
+type ImageService struct {
+	Dir  string
+	UUID func() uuid.UUID
+
+	// MaxUploadBytes is the max size of image data Store accepts, 0 for primage.DefaultMaxUploadBytes.
+	MaxUploadBytes int64
+
+	// Limits are the max dimensions of images Store accepts, zero for primage.DefaultLimits.
+	Limits primage.Limits
+
+	mu sync.Mutex // guards sidecar updates, so SetFocus can't recreate the sidecar of a deleted image
+}
+
+// NewImageService provides an initialised ImageService.
+func NewImageService(dir string, uuid func() uuid.UUID) *ImageService {
+	return &ImageService{
+		Dir:  dir,
+		UUID: uuid,
+	}
+}
+
+// EnsureDir creates the data directory if it doesn't already exist.
+func (is *ImageService) EnsureDir() error {
+	if err := os.MkdirAll(is.Dir, 0755); err != nil {
+		return errors.Wrap(err, "error creating data dir")
+	}
+	return nil
+}
+
+// sidecar is the metadata stored alongside each image.
+type sidecar struct {
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Hash        string `json:"hash"`
+
+	Focus *progimage.Focus `json:"focus,omitempty"`
+
+	// HasMetadata is nil for images stored before it was recorded, they're treated as having metadata.
+	HasMetadata *bool `json:"has_metadata,omitempty"`
+}
+
+func (is *ImageService) path(ID string) string {
+	return filepath.Join(is.Dir, ID[0:2], ID[2:4], ID)
+}
+
+func (is *ImageService) sidecarPath(ID string) string {
+	return is.path(ID) + ".json"
+}
+
+// Get retrieves the Image with the given id, Image.Data is an *os.File that should be closed.
+func (is *ImageService) Get(ctx context.Context, ID string) (progimage.Image, error) {
+	ret := progimage.Image{}
+	if !validID.MatchString(ID) {
+		return ret, progimage.ErrImageNotFound
+	}
+
+	sc, err := is.readSidecar(ID)
+	if err != nil {
+		return ret, err
+	}
+
+	fp, err := os.Open(is.path(ID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, progimage.ErrImageNotFound
+		}
+		return ret, errors.Wrapf(err, "error opening image %s", ID)
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close() // nolint: errcheck,gas
+		return ret, errors.Wrapf(err, "error getting image info %s", ID)
+	}
+
+	ret.ID = ID
+	ret.Data = fp
+	ret.ContentType = sc.ContentType
+	ret.ETag = sc.Hash
+	ret.LastModified = fi.ModTime()
+	ret.Focus = sc.Focus
+	return ret, nil
+}
+
+var _ progimage.RangeGetter = &ImageService{}
+
+// GetRange retrieves part of the Image with the given id, Image.Data should be closed.
+func (is *ImageService) GetRange(ctx context.Context, ID string, offset, length int64) (progimage.Image, error) {
+	img, err := is.Get(ctx, ID)
+	if err != nil {
+		return img, err
+	}
+	fp := img.Data.(*os.File)
+	img.Data = readCloser{io.NewSectionReader(fp, offset, length), fp}
+	return img, nil
+}
+
+// readCloser closes the underlying file of a reader.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Stat returns information about the Image with the given id.
+func (is *ImageService) Stat(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+	ret := progimage.ImageInfo{}
+	if !validID.MatchString(ID) {
+		return ret, progimage.ErrImageNotFound
+	}
+
+	sc, err := is.readSidecar(ID)
+	if err != nil {
+		return ret, err
+	}
+
+	fi, err := os.Stat(is.path(ID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ret, progimage.ErrImageNotFound
+		}
+		return ret, errors.Wrapf(err, "error getting image info %s", ID)
+	}
+
+	ret.ID = ID
+	ret.ContentType = sc.ContentType
+	ret.Width = sc.Width
+	ret.Height = sc.Height
+	ret.Size = fi.Size()
+	ret.Created = fi.ModTime()
+	ret.Hash = sc.Hash
+	ret.Focus = sc.Focus
+	ret.HasMetadata = sc.HasMetadata == nil || *sc.HasMetadata
+	return ret, nil
+}
+
+func (is *ImageService) readSidecar(ID string) (sidecar, error) {
+	sc := sidecar{}
+	b, err := ioutil.ReadFile(is.sidecarPath(ID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sc, progimage.ErrImageNotFound
+		}
+		return sc, errors.Wrapf(err, "error reading image metadata %s", ID)
+	}
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return sc, errors.Wrapf(err, "error decoding image metadata %s", ID)
+	}
+	return sc, nil
+}
+
+// Store validates data is an image (read into memory), persists the image and returns the id.
+func (is *ImageService) Store(ctx context.Context, rawImg io.Reader) (string, error) {
+	up, err := primage.Validate(rawImg, is.MaxUploadBytes, is.Limits)
+	if err != nil {
+		return "", err
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	ID := is.UUID().String()
+	if err := os.MkdirAll(filepath.Dir(is.path(ID)), 0755); err != nil {
+		return "", errors.Wrap(err, "error creating image dir")
+	}
+
+	sc, err := json.Marshal(sidecar{
+		ContentType: up.ContentType,
+		Width:       up.Width,
+		Height:      up.Height,
+		Hash:        up.Hash,
+		HasMetadata: &up.HasMetadata,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding image metadata")
+	}
+
+	// the image file existing means the image exists, so write it last
+	if err := writeFile(is.sidecarPath(ID), sc); err != nil {
+		return "", errors.Wrap(err, "error writing image metadata")
+	}
+	if err := writeFile(is.path(ID), up.Data); err != nil {
+		os.Remove(is.sidecarPath(ID)) // nolint: errcheck,gas
+		return "", errors.Wrap(err, "error writing image")
+	}
+
+	return ID, nil
+}
+
+var _ progimage.FocusSetter = &ImageService{}
+
+// SetFocus stores the focal point of the Image with the given id in its sidecar file, nil removes it.
+func (is *ImageService) SetFocus(ctx context.Context, ID string, focus *progimage.Focus) error {
+	if !validID.MatchString(ID) {
+		return progimage.ErrImageNotFound
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	sc, err := is.readSidecar(ID)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(is.path(ID)); err != nil {
+		if os.IsNotExist(err) {
+			return progimage.ErrImageNotFound
+		}
+		return errors.Wrapf(err, "error getting image info %s", ID)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sc.Focus = focus
+	b, err := json.Marshal(sc)
+	if err != nil {
+		return errors.Wrap(err, "error encoding image metadata")
+	}
+	if err := writeFile(is.sidecarPath(ID), b); err != nil {
+		return errors.Wrapf(err, "error writing image metadata %s", ID)
+	}
+	return nil
+}
+
+// Delete removes the Image with the given id.
+func (is *ImageService) Delete(ctx context.Context, ID string) error {
+	if !validID.MatchString(ID) {
+		return progimage.ErrImageNotFound
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	if err := os.Remove(is.path(ID)); err != nil {
+		if os.IsNotExist(err) {
+			return progimage.ErrImageNotFound
+		}
+		return errors.Wrapf(err, "error deleting image %s", ID)
+	}
+	if err := os.Remove(is.sidecarPath(ID)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "error deleting image metadata %s", ID)
+	}
+	return nil
+}
+
+// writeFile writes data to a temp file in the same dir then renames it, so a partial file is never visible.
+func writeFile(name string, data []byte) error {
+	fp, err := ioutil.TempFile(filepath.Dir(name), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()           // nolint: errcheck,gas
+		os.Remove(fp.Name()) // nolint: errcheck,gas
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		os.Remove(fp.Name()) // nolint: errcheck,gas
+		return err
+	}
+	if err := os.Chmod(fp.Name(), 0644); err != nil {
+		os.Remove(fp.Name()) // nolint: errcheck,gas
+		return err
+	}
+	if err := os.Rename(fp.Name(), name); err != nil {
+		os.Remove(fp.Name()) // nolint: errcheck,gas
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/j0hnsmith/progimage"
+	"github.com/j0hnsmith/progimage/fs"
+	"github.com/j0hnsmith/progimage/servicetest"
+)
+
+// setup returns an ImageService using a temp dir and a func to remove it.
+func setup(t *testing.T, uf func() uuid.UUID) (*fs.ImageService, func()) {
+	dir, err := ioutil.TempDir("", "progimage-fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	is := fs.NewImageService(filepath.Join(dir, "data"), uf)
+	if err := is.EnsureDir(); err != nil {
+		t.Fatal(err)
+	}
+	return is, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+var fileTests = []struct {
+	Name        string
+	Path        string
+	ContentType string
+}{
+	{Name: "png", Path: "../testimages/test.png", ContentType: "image/png"},
+	{Name: "gif", Path: "../testimages/test.gif", ContentType: "image/gif"},
+	{Name: "jpg", Path: "../testimages/test.jpg", ContentType: "image/jpeg"},
+}
+
+func TestImageService_StoreGetImage(t *testing.T) {
+	for _, item := range fileTests {
+		t.Run(item.Name, func(t *testing.T) {
+			uid := uuid.New()
+			is, teardown := setup(t, func() uuid.UUID {
+				return uid
+			})
+			defer teardown()
+
+			d, err := ioutil.ReadFile(item.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := is.Store(context.Background(), bytes.NewReader(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != uid.String() {
+				t.Errorf("expected id to be %s, got %s", uid.String(), id)
+			}
+
+			// sharded by id prefix
+			if _, err := os.Stat(filepath.Join(is.Dir, id[0:2], id[2:4], id)); err != nil {
+				t.Errorf("expected image file to exist, %s", err)
+			}
+
+			img, err := is.Get(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer img.Data.(*os.File).Close()
+
+			if img.ID != id {
+				t.Errorf("expected image id to be '%s', got '%s'", id, img.ID)
+			}
+			if img.ContentType != item.ContentType {
+				t.Errorf("expected image content type to be '%s', got '%s'", item.ContentType, img.ContentType)
+			}
+
+			retrieved, err := ioutil.ReadAll(img.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d, retrieved) {
+				t.Error("expected stored data to be equal to initial data from file, data not equal")
+			}
+
+			info, err := is.Stat(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ContentType != item.ContentType || info.Size != int64(len(d)) || info.Width == 0 ||
+				info.Height == 0 || info.Hash == "" || info.Created.IsZero() {
+				t.Errorf("unexpected image info %+v", info)
+			}
+		})
+	}
+}
+
+func TestImageService_StoreNoData(t *testing.T) {
+	is, teardown := setup(t, uuid.New)
+	defer teardown()
+
+	r := bytes.NewReader([]byte{})
+	if _, err := is.Store(context.Background(), r); err != progimage.ErrUnrecognisedImageType {
+		t.Errorf("expected progimage.ErrUnrecognisedImageType, got %s", err)
+	}
+
+	// nothing written, other than the data dir
+	files, err := ioutil.ReadDir(is.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no files to be written, got %d", len(files))
+	}
+}
+
+func TestImageService_GetNotExists(t *testing.T) {
+	is, teardown := setup(t, uuid.New)
+	defer teardown()
+
+	for _, id := range []string{"foo", uuid.New().String(), "..", "../../etc/passwd", ""} {
+		if _, err := is.Get(context.Background(), id); err != progimage.ErrImageNotFound {
+			t.Errorf("expected progimage.ErrImageNotFound for %q, got %s", id, err)
+		}
+		if _, err := is.Stat(context.Background(), id); err != progimage.ErrImageNotFound {
+			t.Errorf("expected progimage.ErrImageNotFound for %q, got %s", id, err)
+		}
+	}
+}
+
+func TestImageService_Delete(t *testing.T) {
+	is, teardown := setup(t, uuid.New)
+	defer teardown()
+
+	fp, err := os.Open("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	id, err := is.Store(context.Background(), fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := is.Delete(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := is.Get(context.Background(), id); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound after delete, got %s", err)
+	}
+
+	if err := is.Delete(context.Background(), id); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound deleting twice, got %s", err)
+	}
+}
+
+// TestImageService_SetFocusDelete checks setting the focus of an image while it's deleted doesn't leave its sidecar
+// file behind.
+func TestImageService_SetFocusDelete(t *testing.T) {
+	is, teardown := setup(t, uuid.New)
+	defer teardown()
+
+	d, err := ioutil.ReadFile("../testimages/test.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		id, err := is.Store(context.Background(), bytes.NewReader(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// start both at the same time
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			err := is.SetFocus(context.Background(), id, &progimage.Focus{X: 0.5, Y: 0.5})
+			if err != nil && err != progimage.ErrImageNotFound {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			if err := is.Delete(context.Background(), id); err != nil {
+				t.Error(err)
+			}
+		}()
+		close(start)
+		wg.Wait()
+
+		if _, err := os.Stat(filepath.Join(is.Dir, id[0:2], id[2:4], id+".json")); !os.IsNotExist(err) {
+			t.Fatalf("expected the sidecar to be deleted, got %v", err)
+		}
+	}
+}
+
+func TestImageService_Conformance(t *testing.T) {
+	servicetest.Run(t, servicetest.Suite{
+		New: func(t *testing.T) (progimage.ImageService, func()) {
+			return setup(t, uuid.New)
+		},
+	})
+}
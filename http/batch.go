@@ -0,0 +1,366 @@
+package http
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	primage "github.com/j0hnsmith/progimage/image"
+	"github.com/julienschmidt/httprouter"
+)
+
+// batchItem is the result of storing one image of a batch upload, either ID or Error is set.
+type batchItem struct {
+	Filename string `json:"filename,omitempty"`
+	ID       string `json:"id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// batchCreateResponse is the body of a batch upload response, items are in the same order as the file parts.
+type batchCreateResponse struct {
+	Items []*batchItem `json:"items"`
+}
+
+// handleBatchCreate stores every file part of a multipart/form-data body, up to BatchConcurrency at a time. Unlike
+// handleCreateImage each image is stored independently, the response has the id or error of each one.
+func (h *ImageHandler) handleBatchCreate(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	mt, mtParams, _ := mime.ParseMediaType(r.Header.Get("Content-Type")) // nolint: gas
+	if mt != "multipart/form-data" {
+		writeError(w, r, badRequest("batch uploads must be multipart/form-data"))
+		return
+	}
+	max := h.maxBodyBytes(mt)
+	if r.ContentLength > max {
+		writeError(w, r, tooLarge("request body", max))
+		return
+	}
+	mr := multipart.NewReader(&limitReader{r: r.Body, what: "request body", max: max}, mtParams["boundary"])
+
+	// each store only sets its own item
+	var items []*batchItem
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, h.batchConcurrency())
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			wg.Wait()
+			writeError(w, r, multipartError(err))
+			return
+		}
+		if p.FormName() != "file" {
+			continue
+		}
+		if len(items) == h.BatchMaxItems {
+			wg.Wait()
+			writeError(w, r, badRequest(fmt.Sprintf("too many images, max %d", h.BatchMaxItems)))
+			return
+		}
+
+		// parts have to be read in order, only the reading is done here so the stores can happen at the same time
+		item := &batchItem{Filename: p.FileName()}
+		items = append(items, item)
+
+		sem <- struct{}{}
+		plr := &limitReader{r: p, what: "image " + p.FileName(), max: h.MaxUploadBytes}
+		data, err := ioutil.ReadAll(plr)
+		if err != nil {
+			<-sem
+			if plr.n > plr.max {
+				// only this image is too large, the rest of it is skipped by NextPart
+				item.Error = batchError(r, err)
+				continue
+			}
+			wg.Wait()
+			writeError(w, r, multipartError(err))
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			ID, err := h.ImageService.Store(r.Context(), bytes.NewReader(data))
+			if err != nil {
+				item.Error = batchError(r, err)
+				return
+			}
+			item.ID = ID
+		}()
+	}
+	wg.Wait()
+
+	if len(items) == 0 {
+		writeError(w, r, badRequest("no file parts in multipart body"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(batchCreateResponse{Items: items}); err != nil {
+		log.Println("error writing handleBatchCreate response", err.Error())
+	}
+}
+
+// batchError describes an error storing or getting one image of a batch, see clientError.
+func batchError(r *http.Request, err error) string {
+	return clientError(r, err).Message
+}
+
+// maxBatchGetBytes is the max size of a batch get request body, plenty for BatchMaxItems ids.
+const maxBatchGetBytes = 1024 * 1024 // 1mb
+
+// batchGetRequest is the body of a batch get request. Format is the extension of the output format, empty keeps the
+// original format. Archive is zip (default) or tar.
+type batchGetRequest struct {
+	IDs     []string `json:"ids"`
+	Format  string   `json:"format"`
+	Archive string   `json:"archive"`
+}
+
+// batchResult is an image of a batch get, ready to add to the archive.
+type batchResult struct {
+	name string
+	data []byte
+	err  error
+}
+
+// handleBatchGet writes a zip or tar archive of the images with the given ids, the query params (ops, w, h, fit, q
+// etc) are applied to every image as they are for a single image. Up to BatchConcurrency images are fetched and
+// transformed at a time, they're added to the archive in the order requested (ids listed more than once are only added
+// once). The archive is streamed so errors can't change the status, images that fail are listed in errors.txt at the
+// end of the archive instead.
+func (h *ImageHandler) handleBatchGet(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	req := batchGetRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxBatchGetBytes)).Decode(&req); err != nil {
+		writeError(w, r, badRequest("invalid json body, "+err.Error()))
+		return
+	}
+	if len(req.IDs) == 0 {
+		writeError(w, r, badRequest("no ids in json body"))
+		return
+	}
+	// an archive can't have the same name twice
+	req.IDs = dedupe(req.IDs)
+	if len(req.IDs) > h.BatchMaxItems {
+		writeError(w, r, badRequest(fmt.Sprintf("too many ids, max %d", h.BatchMaxItems)))
+		return
+	}
+
+	spec, err := parseSpec(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ops, err := spec.Operations()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	opts, err := h.parseEncodeOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+	p := primage.Pipeline{Operations: ops, Options: opts, Limits: h.Limits, StripMetadata: h.StripMetadata}
+	if req.Format != "" {
+		tr, ok := h.Transformers[req.Format]
+		if !ok {
+			writeError(w, r, errUnsupportedFormat)
+			return
+		}
+		p.Transformer = tr
+	}
+
+	var aw archiveWriter
+	switch req.Archive {
+	case "", "zip":
+		w.Header().Set("Content-Type", "application/zip")
+		aw = zipWriter{zip.NewWriter(w)}
+	case "tar":
+		w.Header().Set("Content-Type", "application/x-tar")
+		aw = tarWriter{tar.NewWriter(w)}
+	default:
+		writeError(w, r, badRequest("unsupported archive, must be zip or tar"))
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="images.`+archiveExt(req.Archive)+`"`)
+
+	// each image gets its own channel so they can be written in order, the semaphore is released once an image has
+	// been written so only BatchConcurrency images are held in memory
+	results := make([]chan batchResult, len(req.IDs))
+	for i := range results {
+		results[i] = make(chan batchResult, 1)
+	}
+	sem := make(chan struct{}, h.batchConcurrency())
+	go func() {
+		for i, ID := range req.IDs {
+			select {
+			case sem <- struct{}{}:
+			case <-r.Context().Done():
+				return
+			}
+			go func(c chan batchResult, ID string) {
+				c <- h.batchGet(r.Context(), ID, spec, p)
+			}(results[i], ID)
+		}
+	}()
+
+	var failed bytes.Buffer
+	modified := time.Now()
+	for i := range req.IDs {
+		var res batchResult
+		select {
+		case res = <-results[i]:
+			<-sem
+		case <-r.Context().Done():
+			return
+		}
+		if res.err != nil {
+			fmt.Fprintf(&failed, "%s: %s\n", req.IDs[i], batchError(r, res.err)) // nolint: errcheck,gas
+			continue
+		}
+		if err := aw.add(res.name, res.data, modified); err != nil {
+			log.Printf("error writing batch archive, %s", err)
+			return
+		}
+	}
+	if failed.Len() > 0 {
+		if err := aw.add("errors.txt", failed.Bytes(), modified); err != nil {
+			log.Printf("error writing batch archive, %s", err)
+			return
+		}
+	}
+	if err := aw.Close(); err != nil {
+		log.Printf("error writing batch archive, %s", err)
+	}
+}
+
+// batchGet gets the image with the given id, running p (created from spec) on it if it has a Transformer, there are
+// operations or options or metadata is stripped.
+func (h *ImageHandler) batchGet(ctx context.Context, ID string, spec primage.Spec, p primage.Pipeline) batchResult {
+	if ID == "" || strings.ContainsAny(ID, `/\`) || strings.Contains(ID, "..") {
+		// the id is used as the file name in the archive
+		return batchResult{err: badRequest("invalid id")}
+	}
+	img, err := h.ImageService.Get(ctx, ID)
+	if err != nil {
+		return batchResult{err: err}
+	}
+	defer closeData(img)
+
+	if _, p, err = withFocus(spec, p, img.Focus); err != nil {
+		return batchResult{err: err}
+	}
+	if p.Transformer.ContentType == "" &&
+		(len(p.Operations) > 0 || p.Options != (primage.EncodeOptions{}) || p.StripMetadata) {
+		// keep the original format
+		tr, ok := h.transformerFor(img.ContentType)
+		if !ok {
+			return batchResult{err: badRequest("unsupported image type")}
+		}
+		p.Transformer = tr
+	}
+	if p.Transformer.ContentType != "" {
+		if img, err = p.Run(ctx, img); err != nil {
+			return batchResult{err: err}
+		}
+	}
+
+	data, err := ioutil.ReadAll(img.Data)
+	if err != nil {
+		return batchResult{err: err}
+	}
+	name := ID
+	if ext := h.extFor(img.ContentType); ext != "" {
+		name += "." + ext
+	}
+	return batchResult{name: name, data: data}
+}
+
+// dedupe returns IDs without repeats, in the order they're first listed.
+func dedupe(IDs []string) []string {
+	seen := make(map[string]bool, len(IDs))
+	var d []string
+	for _, ID := range IDs {
+		if !seen[ID] {
+			seen[ID] = true
+			d = append(d, ID)
+		}
+	}
+	return d
+}
+
+// extFor returns the Transformers key (file extension) of the transformer for contentType, empty if there isn't one.
+func (h *ImageHandler) extFor(contentType string) string {
+	for _, ext := range h.FormatPreference {
+		if h.Transformers[ext].ContentType == contentType {
+			return ext
+		}
+	}
+	for ext, tr := range h.Transformers {
+		if tr.ContentType == contentType {
+			return ext
+		}
+	}
+	return ""
+}
+
+// batchConcurrency is the number of images of a batch to handle at the same time.
+func (h *ImageHandler) batchConcurrency() int {
+	if h.BatchConcurrency < 1 {
+		return 1
+	}
+	return h.BatchConcurrency
+}
+
+func archiveExt(archive string) string {
+	if archive == "" {
+		return "zip"
+	}
+	return archive
+}
+
+// archiveWriter adds files to an archive.
+type archiveWriter interface {
+	add(name string, data []byte, modified time.Time) error
+	Close() error
+}
+
+type zipWriter struct {
+	*zip.Writer
+}
+
+func (zw zipWriter) add(name string, data []byte, modified time.Time) error {
+	// images are already compressed
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+type tarWriter struct {
+	*tar.Writer
+}
+
+func (tw tarWriter) add(name string, data []byte, modified time.Time) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: modified}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
@@ -0,0 +1,343 @@
+package http_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	pihttp "github.com/j0hnsmith/progimage/http"
+	"github.com/j0hnsmith/progimage/memory"
+)
+
+func readFile(t *testing.T, path string) []byte {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// multipartBody returns a multipart/form-data body with a file part for each of files, and its content type.
+func multipartBody(t *testing.T, files map[string][]byte, order []string) (*bytes.Buffer, string) {
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for _, name := range order {
+		fw, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(files[name])
+	}
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func TestBatchCreate(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+	h := pihttp.NewImageHandler(is)
+
+	files := map[string][]byte{
+		"a.png": readFile(t, "../testimages/test.png"),
+		"b.txt": []byte("not an image"),
+		"c.gif": readFile(t, "../testimages/test.gif"),
+	}
+	body, ct := multipartBody(t, files, []string{"a.png", "b.txt", "c.gif"})
+
+	req, err := http.NewRequest("POST", "/images/batch", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", ct)
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+	}
+
+	resp := struct {
+		Items []struct {
+			Filename string
+			ID       string
+			Error    string
+		}
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 3 {
+		t.Fatalf("expected 3 items, got %+v", resp.Items)
+	}
+	for i, name := range []string{"a.png", "b.txt", "c.gif"} {
+		item := resp.Items[i]
+		if item.Filename != name {
+			t.Errorf("expected item %d to be %s, got %s", i, name, item.Filename)
+		}
+		if name == "b.txt" {
+			if item.ID != "" || item.Error == "" {
+				t.Errorf("expected an error for %s, got %+v", name, item)
+			}
+			continue
+		}
+		img, err := is.Get(context.Background(), item.ID)
+		if err != nil {
+			t.Fatalf("expected %s to be stored, got %s", name, err)
+		}
+		if d, _ := ioutil.ReadAll(img.Data); !bytes.Equal(d, files[name]) {
+			t.Errorf("expected %s to be stored unchanged", name)
+		}
+	}
+}
+
+func TestBatchCreate_TooLarge(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+	h := pihttp.NewImageHandler(is)
+
+	gif := readFile(t, "../testimages/test.gif")
+	png := readFile(t, "../testimages/test.png")
+	if len(png) >= len(gif) {
+		t.Fatal("expected test png to be smaller than test gif")
+	}
+	h.MaxUploadBytes = int64(len(png))
+
+	body, ct := multipartBody(t, map[string][]byte{"a.gif": gif, "b.png": png}, []string{"a.gif", "b.png"})
+	req, err := http.NewRequest("POST", "/images/batch", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", ct)
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+	}
+
+	resp := struct {
+		Items []struct {
+			ID    string
+			Error string
+		}
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Items) != 2 {
+		t.Fatalf("expected 2 items, got %+v", resp.Items)
+	}
+	if resp.Items[0].ID != "" || !strings.Contains(resp.Items[0].Error, "too large") {
+		t.Errorf("expected too large error for gif, got %+v", resp.Items[0])
+	}
+	if resp.Items[1].ID == "" {
+		t.Errorf("expected png to be stored, got %+v", resp.Items[1])
+	}
+}
+
+func TestBatchCreate_Invalid(t *testing.T) {
+	png := readFile(t, "../testimages/test.png")
+	tooMany, tooManyCT := multipartBody(t, map[string][]byte{"a": png, "b": png, "c": png}, []string{"a", "b", "c"})
+
+	var invalidTests = []struct {
+		Name        string
+		ContentType string
+		Body        io.Reader
+	}{
+		{Name: "not multipart", ContentType: "image/png", Body: bytes.NewReader(png)},
+		{Name: "no files", ContentType: "multipart/form-data; boundary=foo", Body: strings.NewReader("--foo--\r\n")},
+		{Name: "too many", ContentType: tooManyCT, Body: tooMany},
+	}
+
+	for _, item := range invalidTests {
+		t.Run(item.Name, func(t *testing.T) {
+			h := pihttp.NewImageHandler(memory.NewImageService(0, uuid.New))
+			h.BatchMaxItems = 2
+
+			req, err := http.NewRequest("POST", "/images/batch", item.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", item.ContentType)
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("expected: %v got: %v", http.StatusBadRequest, status)
+			}
+		})
+	}
+}
+
+// batchGet makes a batch get request returning the files in the archive by name.
+func batchGet(t *testing.T, h http.Handler, path, body, archive string) map[string][]byte {
+	req, err := http.NewRequest("POST", path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected: %v got: %v (%s)", http.StatusOK, status, rr.Body.String())
+	}
+
+	files := map[string][]byte{}
+	switch archive {
+	case "zip":
+		zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[f.Name], _ = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+	case "tar":
+		tr := tar.NewReader(rr.Body)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[hdr.Name], _ = ioutil.ReadAll(tr)
+		}
+	}
+	return files
+}
+
+func TestBatchGet(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+	h := pihttp.NewImageHandler(is)
+
+	png := readFile(t, "../testimages/test.png")
+	pngID, err := is.Store(context.Background(), bytes.NewReader(png))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gifID, err := is.Store(context.Background(), bytes.NewReader(readFile(t, "../testimages/test.gif")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("originals", func(t *testing.T) {
+		body := `{"ids": ["` + pngID + `", "` + gifID + `", "missing"]}`
+		files := batchGet(t, h, "/images/batch/get", body, "zip")
+
+		if len(files) != 3 {
+			t.Fatalf("expected 2 images and errors.txt, got %d files", len(files))
+		}
+		if !bytes.Equal(files[pngID+".png"], png) {
+			t.Error("expected original png data")
+		}
+		if _, ok := files[gifID+".gif"]; !ok {
+			t.Error("expected original gif")
+		}
+		if !strings.Contains(string(files["errors.txt"]), "missing: image not found") {
+			t.Errorf("expected missing image in errors.txt, got %q", files["errors.txt"])
+		}
+	})
+
+	t.Run("converted", func(t *testing.T) {
+		body := `{"ids": ["` + pngID + `", "` + gifID + `"], "format": "jpg", "archive": "tar"}`
+		files := batchGet(t, h, "/images/batch/get?w=10", body, "tar")
+
+		if len(files) != 2 {
+			t.Fatalf("expected 2 images, got %d files", len(files))
+		}
+		for _, ID := range []string{pngID, gifID} {
+			cfg, typ, err := image.DecodeConfig(bytes.NewReader(files[ID+".jpg"]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != "jpeg" || cfg.Width != 10 {
+				t.Errorf("expected 10px wide jpeg, got %dpx %s", cfg.Width, typ)
+			}
+		}
+	})
+
+	t.Run("duplicates", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "/images/batch/get", strings.NewReader(`{"ids": ["`+pngID+`", "`+pngID+`"]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(zr.File) != 1 || zr.File[0].Name != pngID+".png" {
+			t.Errorf("expected the image to be added once, got %d files", len(zr.File))
+		}
+	})
+
+	t.Run("no extension", func(t *testing.T) {
+		h := pihttp.NewImageHandler(is)
+		delete(h.Transformers, "gif")
+
+		files := batchGet(t, h, "/images/batch/get", `{"ids": ["`+gifID+`"]}`, "zip")
+
+		if _, ok := files[gifID]; !ok || len(files) != 1 {
+			t.Errorf("expected a file named %s, got %d files", gifID, len(files))
+		}
+	})
+}
+
+func TestBatchGet_Invalid(t *testing.T) {
+	var invalidTests = []struct {
+		Body   string
+		Status int
+	}{
+		{Body: `{"ids": [`, Status: http.StatusBadRequest},
+		{Body: `{"ids": []}`, Status: http.StatusBadRequest},
+		{Body: `{"ids": ["a", "b", "c"]}`, Status: http.StatusBadRequest},
+		{Body: `{"ids": ["a"], "format": "bmp"}`, Status: http.StatusUnsupportedMediaType},
+		{Body: `{"ids": ["a"], "archive": "rar"}`, Status: http.StatusBadRequest},
+	}
+
+	for _, item := range invalidTests {
+		t.Run(item.Body, func(t *testing.T) {
+			h := pihttp.NewImageHandler(memory.NewImageService(0, uuid.New))
+			h.BatchMaxItems = 2
+
+			req, err := http.NewRequest("POST", "/images/batch/get", strings.NewReader(item.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != item.Status {
+				t.Errorf("expected: %v got: %v", item.Status, status)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/j0hnsmith/progimage"
+	"github.com/pkg/errors"
+)
+
+// Error codes sent in error responses, clients should check the code rather than the message.
+const (
+	CodeImageNotFound         = "image_not_found"
+	CodeUnrecognisedImageType = "unrecognised_image_type"
+	CodeInvalidRequest        = "invalid_request"
+	CodeInvalidTransform      = "invalid_transform"
+	CodeRangeNotSatisfiable   = "range_not_satisfiable"
+	CodeFetchFailed           = "fetch_failed"
+	CodeImageTooLarge         = "image_too_large"
+	CodeImageDimensions       = "image_dimensions_too_large"
+	CodeUnsupportedFormat     = "unsupported_format"
+	CodeStorageUnavailable    = "storage_unavailable"
+	CodeNotImplemented        = "not_implemented"
+	CodeInternal              = "internal_error"
+)
+
+// RequestIDHeader identifies a request in logs and error responses, a valid value sent by the client is used,
+// otherwise one is generated. It's always set on the response.
+const RequestIDHeader = "X-Request-ID"
+
+// Error is the error in an error response body, {"error": {...}}. ImageService returns it for every error response,
+// Err is the progimage.Err* value of the code (if there is one) so progimage.KindOf and errors.Is work. Errors made by
+// the handler can have the cause in Err, it isn't sent but it's logged with server errors.
+type Error struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+	Err       error  `json:"-"`
+}
+
+func (e *Error) Error() string {
+	if e.RequestID == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (request id: %s)", e.Code, e.Message, e.RequestID)
+}
+
+// Unwrap returns Err, the progimage.Err* value of the code or the cause, if any.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// errorResponse is the body of every error response.
+type errorResponse struct {
+	Error *Error `json:"error"`
+}
+
+// sentinelErrors maps the progimage.Err* values to their response status and code, both ways.
+var sentinelErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{err: progimage.ErrImageNotFound, status: http.StatusNotFound, code: CodeImageNotFound},
+	{err: progimage.ErrUnrecognisedImageType, status: http.StatusBadRequest, code: CodeUnrecognisedImageType},
+	{err: progimage.ErrImageTooLarge, status: http.StatusRequestEntityTooLarge, code: CodeImageTooLarge},
+	{err: progimage.ErrImageDimensions, status: http.StatusUnprocessableEntity, code: CodeImageDimensions},
+	{err: progimage.ErrUnsupportedFormat, status: http.StatusUnsupportedMediaType, code: CodeUnsupportedFormat},
+	{err: progimage.ErrStorageUnavailable, status: http.StatusServiceUnavailable, code: CodeStorageUnavailable},
+	{err: progimage.ErrInvalidTransform, status: http.StatusBadRequest, code: CodeInvalidTransform},
+}
+
+// badRequest returns an *Error for an invalid request, msg is shown to the client.
+func badRequest(msg string) *Error {
+	return &Error{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: msg}
+}
+
+// clientError converts err to the *Error the client is sent, progimage.Err* values (see progimage.KindOf) are mapped
+// with sentinelErrors. Server errors are logged in full and only the kind of error is sent, they may contain details
+// of the storage backend.
+func clientError(r *http.Request, err error) *Error {
+	e := &Error{}
+	switch cause := errors.Cause(err).(type) {
+	case *Error:
+		*e = *cause
+	default:
+		e.Status, e.Code, e.Message = http.StatusInternalServerError, CodeInternal, "internal server error"
+		kind := progimage.KindOf(err)
+		for _, s := range sentinelErrors {
+			if kind != s.err {
+				continue
+			}
+			e.Status, e.Code, e.Message = s.status, s.code, s.err.Error()
+			if s.status < http.StatusInternalServerError {
+				// the cause is the progimage.Error (or similar) with the details, not wrapped with internal context
+				e.Message = cause.Error()
+			}
+		}
+	}
+	e.RequestID = requestID(r)
+
+	if e.Status >= http.StatusInternalServerError {
+		msg := err.Error()
+		if e.Err != nil {
+			// the details of an *Error that the client isn't sent
+			msg += ", " + e.Err.Error()
+		}
+		log.Printf("error handling %s %s (request id: %s), %s", r.Method, r.URL.Path, e.RequestID, msg)
+	}
+	return e
+}
+
+// writeError writes the error response for err, see clientError.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e := clientError(r, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(errorResponse{Error: e}); err != nil {
+		log.Println("error writing error response", err.Error())
+	}
+}
+
+// decodeError reads the *Error from an error response, wrapping the progimage.Err* value for its code if there is
+// one. nil is returned if the body isn't an error response (eg from a proxy), the caller should fall back to the
+// status code.
+func decodeError(resp *http.Response) error {
+	er := errorResponse{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&er); err != nil {
+		return nil
+	}
+	if er.Error == nil || er.Error.Code == "" {
+		return nil
+	}
+	for _, s := range sentinelErrors {
+		if er.Error.Code == s.code {
+			er.Error.Err = s.err
+		}
+	}
+	er.Error.Status = resp.StatusCode
+	return er.Error
+}
+
+type requestIDKey struct{}
+
+// ServeHTTP sets the request id (see RequestIDHeader) then routes the request.
+func (h ImageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ID := r.Header.Get(RequestIDHeader)
+	if !validRequestID(ID) {
+		ID = uuid.New().String()
+	}
+	w.Header().Set(RequestIDHeader, ID)
+	h.Router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, ID)))
+}
+
+// requestID returns the id ServeHTTP gave the request.
+func requestID(r *http.Request) string {
+	ID, _ := r.Context().Value(requestIDKey{}).(string) // nolint: gas
+	return ID
+}
+
+// validRequestID reports whether a client sent request id is safe to log and echo back, short and only letters,
+// digits, '-', '_' and '.'.
+func validRequestID(ID string) bool {
+	if ID == "" || len(ID) > 128 {
+		return false
+	}
+	for _, c := range ID {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
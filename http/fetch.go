@@ -0,0 +1,209 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	primage "github.com/j0hnsmith/progimage/image"
+)
+
+// Fetcher downloads images from urls given by clients. Everything about the request is limited so it's safe to use
+// with untrusted urls, by default only public addresses can be fetched (no loopback, private or link local ranges)
+// so clients can't use it to reach internal services.
+type Fetcher struct {
+	MaxBytes     int64         // max size of the image
+	Timeout      time.Duration // max time for the whole download, including redirects
+	MaxRedirects int
+
+	// AllowHosts, if set, are the only hosts that can be fetched. DenyHosts can never be fetched, it takes precedence.
+	// An entry matches the host and its subdomains, eg example.com matches img.example.com.
+	AllowHosts []string
+	DenyHosts  []string
+
+	// AllowPrivate allows non public addresses to be fetched, only use it for testing.
+	AllowPrivate bool
+}
+
+// NewFetcher returns a Fetcher with default limits.
+func NewFetcher() *Fetcher {
+	return &Fetcher{
+		MaxBytes:     primage.DefaultMaxUploadBytes,
+		Timeout:      10 * time.Second,
+		MaxRedirects: 3,
+	}
+}
+
+// privateNets are the ranges blocked unless AllowPrivate is set, in addition to those covered by the net.IP methods.
+var privateNets = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),     // this network, 0.0.0.0 is also unspecified but the rest reach the local host too
+	mustParseCIDR("100.64.0.0/10"), // carrier grade nat
+	mustParseCIDR("192.0.0.0/24"),  // ietf protocol assignments
+	mustParseCIDR("198.18.0.0/15"), // benchmarking
+	mustParseCIDR("240.0.0.0/4"),   // reserved, and broadcast
+	mustParseCIDR("64:ff9b::/96"),  // nat64, the ipv4 address it maps to could be private
+	mustParseCIDR("2002::/16"),     // 6to4, as above
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// publicIP reports whether ip is a public unicast address.
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsLinkLocalMulticast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// hostMatch reports whether host is one of hosts or a subdomain of one.
+func hostMatch(host string, hosts []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, h := range hosts {
+		h = strings.ToLower(strings.TrimPrefix(h, "."))
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkURL returns an error if u can't be fetched, the host is resolved to check its addresses (they're checked
+// again when connecting as the dns answer may change).
+func (f *Fetcher) checkURL(ctx context.Context, u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return badRequest(fmt.Sprintf("unsupported url scheme %q", u.Scheme))
+	}
+	host := u.Hostname()
+	if host == "" {
+		return badRequest("url has no host")
+	}
+	if hostMatch(host, f.DenyHosts) || (len(f.AllowHosts) > 0 && !hostMatch(host, f.AllowHosts)) {
+		return badRequest(fmt.Sprintf("host %s is not allowed", host))
+	}
+	if f.AllowPrivate {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return badRequest(fmt.Sprintf("unable to resolve host %s", host))
+	}
+	for _, a := range addrs {
+		if !publicIP(a.IP) {
+			return badRequest(fmt.Sprintf("host %s is not allowed", host))
+		}
+	}
+	return nil
+}
+
+// client returns a http client that enforces the limits, the address is checked as the connection is made.
+func (f *Fetcher) client(ctx context.Context) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: f.Timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || (!f.AllowPrivate && !publicIP(ip)) {
+				return errAddressNotAllowed
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: f.Timeout,
+		Transport: &http.Transport{
+			// no proxy, it would be the address checked
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   f.Timeout,
+			ResponseHeaderTimeout: f.Timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > f.MaxRedirects {
+				return badRequest(fmt.Sprintf("more than %d redirects", f.MaxRedirects))
+			}
+			return f.checkURL(ctx, req.URL)
+		},
+	}
+}
+
+// errAddressNotAllowed is returned when connecting to an address that can't be fetched, the dns answer changed since
+// the url was checked.
+var errAddressNotAllowed = errors.New("address not allowed")
+
+// fetchFailed returns an *Error for a url that couldn't be downloaded, msg is shown to the client. err isn't, it may
+// have details of the network (addresses, dns, tls), it's logged with the request id.
+func fetchFailed(msg string, err error) *Error {
+	return &Error{Status: http.StatusBadGateway, Code: CodeFetchFailed, Message: msg, Err: err}
+}
+
+// Fetch downloads the image at rawURL.
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, badRequest("invalid url")
+	}
+	if err := f.checkURL(ctx, u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, badRequest("invalid url")
+	}
+	req.Header.Set("Accept", "image/*")
+
+	c := f.client(ctx)
+	defer c.Transport.(*http.Transport).CloseIdleConnections()
+	resp, err := c.Do(req)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); ok {
+			if ue, ok := uerr.Err.(*Error); ok {
+				// from CheckRedirect
+				return nil, ue
+			}
+		}
+		if errors.Is(err, errAddressNotAllowed) {
+			return nil, badRequest(errAddressNotAllowed.Error())
+		}
+		return nil, fetchFailed("url could not be fetched", err)
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fetchFailed(fmt.Sprintf("url could not be fetched, status code %d", resp.StatusCode), nil)
+	}
+	if resp.ContentLength > f.MaxBytes {
+		return nil, tooLarge("remote image", f.MaxBytes)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.MaxBytes+1))
+	if err != nil {
+		return nil, fetchFailed("url could not be fetched", err)
+	}
+	if int64(len(data)) > f.MaxBytes {
+		return nil, tooLarge("remote image", f.MaxBytes)
+	}
+	return data, nil
+}
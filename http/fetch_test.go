@@ -0,0 +1,199 @@
+package http_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	pihttp "github.com/j0hnsmith/progimage/http"
+	"github.com/j0hnsmith/progimage/memory"
+)
+
+// newOrigin returns a server that acts as the remote origin of images.
+func newOrigin(t *testing.T) *httptest.Server {
+	png, err := ioutil.ReadFile("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/test.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(png)
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/test.png", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/elsewhere", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://denied.example.com/test.png", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+// testFetcher returns a fetcher that can fetch from the (loopback) test origin.
+func testFetcher() *pihttp.Fetcher {
+	f := pihttp.NewFetcher()
+	f.AllowPrivate = true
+	return f
+}
+
+func TestFetcher_Fetch(t *testing.T) {
+	origin := newOrigin(t)
+	defer origin.Close()
+
+	png, err := ioutil.ReadFile("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/test.png", "/redirect"} {
+		data, err := testFetcher().Fetch(context.Background(), origin.URL+path)
+		if err != nil {
+			t.Fatalf("%s didn't expect error, got %s", path, err)
+		}
+		if !bytes.Equal(data, png) {
+			t.Errorf("%s expected fetched data to be the image", path)
+		}
+	}
+}
+
+func TestFetcher_FetchInvalid(t *testing.T) {
+	origin := newOrigin(t)
+	defer origin.Close()
+
+	var fetchTests = []struct {
+		Name    string
+		URL     string
+		Fetcher func(*pihttp.Fetcher)
+	}{
+		{Name: "private address", URL: origin.URL + "/test.png", Fetcher: func(f *pihttp.Fetcher) { f.AllowPrivate = false }},
+		{Name: "scheme", URL: "file:///etc/passwd"},
+		{Name: "no host", URL: "http:///test.png"},
+		{Name: "not found", URL: origin.URL + "/missing.png"},
+		{Name: "too large", URL: origin.URL + "/test.png", Fetcher: func(f *pihttp.Fetcher) { f.MaxBytes = 100 }},
+		{Name: "redirect loop", URL: origin.URL + "/loop"},
+		{Name: "redirect denied", URL: origin.URL + "/elsewhere", Fetcher: func(f *pihttp.Fetcher) {
+			f.DenyHosts = []string{"example.com"}
+		}},
+		{Name: "not allowed", URL: origin.URL + "/test.png", Fetcher: func(f *pihttp.Fetcher) {
+			f.AllowHosts = []string{"example.com"}
+		}},
+		{Name: "timeout", URL: origin.URL + "/slow", Fetcher: func(f *pihttp.Fetcher) { f.Timeout = 50 * time.Millisecond }},
+	}
+
+	for _, item := range fetchTests {
+		t.Run(item.Name, func(t *testing.T) {
+			f := testFetcher()
+			if item.Fetcher != nil {
+				item.Fetcher(f)
+			}
+			if _, err := f.Fetch(context.Background(), item.URL); err == nil {
+				t.Error("expected error, didn't get one")
+			}
+		})
+	}
+}
+
+// TestFetcher_FetchFailedMessage checks the client isn't sent network details (addresses, dns) when a url can't be
+// fetched, they're kept in Err to be logged.
+func TestFetcher_FetchFailedMessage(t *testing.T) {
+	origin := newOrigin(t)
+	origin.Close()
+
+	_, err := testFetcher().Fetch(context.Background(), origin.URL+"/test.png")
+	e, ok := err.(*pihttp.Error)
+	if !ok {
+		t.Fatalf("expected *Error, got %v", err)
+	}
+	if e.Code != pihttp.CodeFetchFailed || e.Message != "url could not be fetched" {
+		t.Errorf("expected generic fetch_failed message, got %s", e)
+	}
+	if e.Err == nil {
+		t.Error("expected the cause to be kept")
+	}
+}
+
+func TestFetcher_FetchBlocked(t *testing.T) {
+	var blockedTests = []struct {
+		Name string
+		Host string
+	}{
+		{Name: "loopback", Host: "127.0.0.1"},
+		{Name: "private", Host: "10.0.0.1"},
+		{Name: "link local", Host: "169.254.169.254"},
+		{Name: "carrier grade nat", Host: "100.64.0.1"},
+		{Name: "unspecified", Host: "0.0.0.0"},
+		{Name: "this network", Host: "0.1.2.3"},
+		{Name: "reserved", Host: "240.0.0.1"},
+		{Name: "broadcast", Host: "255.255.255.255"},
+		{Name: "ipv6 loopback", Host: "[::1]"},
+		{Name: "ipv6 link local", Host: "[fe80::1]"},
+		{Name: "ipv4 mapped", Host: "[::ffff:127.0.0.1]"},
+		{Name: "nat64", Host: "[64:ff9b::a00:1]"},
+		{Name: "6to4", Host: "[2002:a00:1::1]"},
+	}
+
+	for _, item := range blockedTests {
+		t.Run(item.Name, func(t *testing.T) {
+			_, err := pihttp.NewFetcher().Fetch(context.Background(), "http://"+item.Host+"/test.png")
+			if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+				t.Errorf("expected %s not to be allowed, got: %v", item.Host, err)
+			}
+		})
+	}
+}
+
+func TestStore_URL(t *testing.T) {
+	origin := newOrigin(t)
+	defer origin.Close()
+
+	var urlTests = []struct {
+		Name    string
+		Body    string
+		Fetcher *pihttp.Fetcher
+		Status  int
+	}{
+		{Name: "ok", Body: `{"url": "` + origin.URL + `/test.png"}`, Fetcher: testFetcher(), Status: http.StatusCreated},
+		{Name: "private address", Body: `{"url": "` + origin.URL + `/test.png"}`, Fetcher: pihttp.NewFetcher(), Status: http.StatusBadRequest},
+		{Name: "disabled", Body: `{"url": "` + origin.URL + `/test.png"}`, Status: http.StatusBadRequest},
+		{Name: "not found", Body: `{"url": "` + origin.URL + `/missing.png"}`, Fetcher: testFetcher(), Status: http.StatusBadGateway},
+		{Name: "data and url", Body: `{"url": "` + origin.URL + `/test.png", "data": "aW1n"}`, Fetcher: testFetcher(), Status: http.StatusBadRequest},
+	}
+
+	for _, item := range urlTests {
+		t.Run(item.Name, func(t *testing.T) {
+			is := memory.NewImageService(0, uuid.New)
+			h := pihttp.NewImageHandler(is)
+			h.Fetcher = item.Fetcher
+
+			req, err := http.NewRequest("POST", "/image/create", strings.NewReader(item.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != item.Status {
+				t.Errorf("expected: %v got: %v (%s)", item.Status, status, rr.Body.String())
+			}
+		})
+	}
+}
@@ -1,93 +1,248 @@
 package http
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
 	"github.com/j0hnsmith/progimage/image/gif"
 	"github.com/j0hnsmith/progimage/image/jpeg"
 	"github.com/j0hnsmith/progimage/image/png"
+	"github.com/j0hnsmith/progimage/image/webp"
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 )
 
-const maxReadBytes = 50 * 1024 * 1024 // 50mb
+// cacheControl is sent with every image, ids are never reused for different data so images can be cached forever.
+const cacheControl = "public, max-age=31536000, immutable"
 
 // ImageHandler is a http.Handler that provides store and retrieve image endpoints.
 type ImageHandler struct {
 	*httprouter.Router
 
-	Transformers map[string]progimage.ImageTypeTransformer
+	Transformers map[string]primage.Transformer
 	ImageService progimage.ImageService
+
+	// Derivatives, if set, stores transformed images so the same transformation isn't repeated.
+	Derivatives progimage.DerivativeStore
+
+	// AutoFormat chooses the output format from the Accept header for images requested without an extension, as if
+	// every request had ?auto=format.
+	AutoFormat bool
+
+	// FormatPreference lists Transformers keys in the order they're chosen when negotiating the output format and the
+	// client accepts more than one equally.
+	FormatPreference []string
+
+	// MaxQuality caps the encoding quality clients can request (?q=), higher values are lowered to it.
+	MaxQuality int
+
+	// MinColors is the smallest gif palette clients can request (?colors=), lower values are raised to it.
+	MinColors int
+
+	// MaxUploadBytes is the max size of an uploaded image, larger uploads get a 413. It's checked against
+	// Content-Length before anything is read and enforced while the body is read. Image services have their own limit,
+	// they should be given the same value.
+	MaxUploadBytes int64
+
+	// Limits are the max dimensions of images that are transformed, larger images get a 422 rather than being decoded.
+	// Image services have their own limits for uploads, they should be given the same value.
+	Limits primage.Limits
+
+	// StripMetadata removes EXIF (including GPS location), XMP and ICC metadata from originals as they're served, so
+	// Range requests for originals with metadata get the whole image. Transformed images never have any metadata.
+	StripMetadata bool
+
+	// Fetcher downloads images for uploads that give a url, nil disables them.
+	Fetcher *Fetcher
+
+	// BatchMaxItems is the max number of images in a batch request, BatchConcurrency how many of them are stored or
+	// fetched at the same time.
+	BatchMaxItems    int
+	BatchConcurrency int
 }
 
-var _ http.Handler = ImageHandler{} // via httprouter.Router
+var _ http.Handler = ImageHandler{}
 
 // NewImageHandler returns an initialised image handler.
 func NewImageHandler(is progimage.ImageService) *ImageHandler {
-	h := ImageHandler{
+	h := &ImageHandler{
 		Router:       httprouter.New(),
 		ImageService: is,
-		Transformers: map[string]progimage.ImageTypeTransformer{
-			"png": png.Transformer,
-			"jpg": jpeg.Transformer,
-			"gif": gif.Transformer,
+		Transformers: map[string]primage.Transformer{
+			"png":  png.Transformer,
+			"jpg":  jpeg.Transformer,
+			"gif":  gif.Transformer,
+			"webp": webp.Transformer,
 		},
+		FormatPreference: []string{"webp", "jpg", "png", "gif"},
+		MaxQuality:       95,
+		MinColors:        16,
+		MaxUploadBytes:   primage.DefaultMaxUploadBytes,
+		Limits:           primage.DefaultLimits,
+		Fetcher:          NewFetcher(),
+		BatchMaxItems:    100,
+		BatchConcurrency: 4,
 	}
 	h.POST("/image/create", h.handleCreateImage)
 	h.GET("/image/:id", h.handleGetImage)
-	return &h
+	h.HEAD("/image/:id", h.handleHeadImage)
+	h.GET("/image/:id/meta", h.handleGetImageMeta)
+	h.PUT("/image/:id/focus", h.handleSetImageFocus)
+	h.DELETE("/image/:id/focus", h.handleDeleteImageFocus)
+	h.DELETE("/image/:id", h.handleDeleteImage)
+	h.POST("/images/batch", h.handleBatchCreate)
+	h.POST("/images/batch/get", h.handleBatchGet)
+	return h
 }
 
-func (h ImageHandler) handleCreateImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+// handleCreateImage stores the image(s) in the request body, which is either the raw image, a multipart/form-data
+// form with one or more file parts or json with the image base64 encoded in the data field or a url to fetch it from.
+func (h *ImageHandler) handleCreateImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	mt, mtParams, _ := mime.ParseMediaType(r.Header.Get("Content-Type")) // nolint: gas
+
 	// don't allow an attacker to send an unlimited stream of bytes
-	lr := io.LimitReader(r.Body, maxReadBytes)
+	max := h.maxBodyBytes(mt)
+	if r.ContentLength > max {
+		writeError(w, r, tooLarge("request body", max))
+		return
+	}
+	lr := &limitReader{r: r.Body, what: "request body", max: max}
 
-	ID, err := h.ImageService.Store(lr)
+	var IDs []string
+	var err error
+	switch mt {
+	case "multipart/form-data":
+		mr := multipart.NewReader(lr, mtParams["boundary"])
+		IDs, err = storeMultipart(r.Context(), h.ImageService, mr, h.MaxUploadBytes, h.BatchMaxItems)
+	case "application/json":
+		var ID string
+		ID, err = storeJSON(r.Context(), h.ImageService, h.Fetcher, lr, h.MaxUploadBytes)
+		IDs = []string{ID}
+	default:
+		var ID string
+		ID, err = h.ImageService.Store(r.Context(), lr)
+		IDs = []string{ID}
+	}
 	if err != nil {
-		if err == progimage.ErrUnrecognisedImageType {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	_, err = w.Write([]byte(fmt.Sprintf(`{"id": "%s"}`, ID)))
-	if err != nil {
+	if err := json.NewEncoder(w).Encode(createResponse{ID: IDs[0], IDs: IDs}); err != nil {
 		log.Println("error writing handleCreateImage response", err.Error())
 	}
 }
 
-func (h ImageHandler) handleGetImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+// maxBodyBytes is the max size of an upload request body with the given media type. Multipart bodies can have up to
+// BatchMaxItems images, base64 encoded json images are a third bigger than the image.
+func (h *ImageHandler) maxBodyBytes(mediaType string) int64 {
+	switch mediaType {
+	case "multipart/form-data":
+		// allow for the part headers
+		return (h.MaxUploadBytes + 1024) * int64(h.BatchMaxItems)
+	case "application/json":
+		// allow for the json around the data, or a url
+		return int64(base64.StdEncoding.EncodedLen(int(h.MaxUploadBytes))) + 4096
+	}
+	return h.MaxUploadBytes
+}
+
+func (h *ImageHandler) handleGetImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
 	ID := params.ByName("id")
 
+	spec, err := parseSpec(r.URL.Query())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ops, err := spec.Operations()
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	opts, err := h.parseEncodeOptions(r.URL.Query())
+	if err != nil {
+		writeError(w, r, badRequest(err.Error()))
+		return
+	}
+	p := primage.Pipeline{Operations: ops, Options: opts, Limits: h.Limits, StripMetadata: h.StripMetadata}
+
+	// the stored hash and created time are the validators of every response, whichever way it's written
 	s := strings.Split(ID, ".")
+	info, ok := h.stat(w, r, s[0])
+	if !ok {
+		return
+	}
 	if len(s) == 2 {
-		h.handleGetImageWithExt(w, r, s[0], s[1])
+		h.handleGetImageWithExt(w, r, info, s[1], spec, p)
 		return
 	}
 
-	h.handleGetImageNoExt(w, r, ID)
+	if h.AutoFormat || r.URL.Query().Get("auto") == "format" {
+		// the response depends on Accept even when the original format is kept
+		w.Header().Add("Vary", "Accept")
+		if ext, ok := h.negotiateFormat(r.Header.Get("Accept")); ok {
+			h.handleGetImageWithExt(w, r, info, ext, spec, p)
+			return
+		}
+	}
+
+	if len(ops) > 0 || opts != (primage.EncodeOptions{}) {
+		h.handleGetImageWithOps(w, r, info, spec, p)
+		return
+	}
+	// an original without metadata is served as is, so ranges can be requested
+	if h.StripMetadata && info.HasMetadata {
+		h.handleGetImageWithOps(w, r, info, spec, p)
+		return
+	}
+
+	h.handleGetImageNoExt(w, r, info)
+}
+
+func (h *ImageHandler) handleGetImageNoExt(w http.ResponseWriter, r *http.Request, info progimage.ImageInfo) {
+	// sent with a 304 too, the focal point can change without the image data changing
+	setFocusHeader(w, info.Focus)
+	if notModified(w, r, info.Hash, info.Created) {
+		return
+	}
+	if r.Header.Get("Range") != "" {
+		h.handleGetImageRange(w, r, info)
+		return
+	}
+	h.writeImage(w, r, info)
 }
 
-func (h ImageHandler) handleGetImageNoExt(w http.ResponseWriter, r *http.Request, ID string) {
-	img, err := h.ImageService.Get(ID)
+// writeImage writes the whole original image, info is from Stat.
+func (h *ImageHandler) writeImage(w http.ResponseWriter, r *http.Request, info progimage.ImageInfo) {
+	img, err := h.ImageService.Get(r.Context(), info.ID)
 	if err != nil {
-		if err == progimage.ErrImageNotFound {
-			http.Error(w, fmt.Sprintf("image %s not found", ID), http.StatusNotFound)
-			return
-		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
+	defer closeData(img)
 
+	setCacheHeaders(w, info.Hash, info.Created)
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Content-Type", img.ContentType)
 	_, err = io.Copy(w, img.Data)
 	if err != nil {
@@ -95,42 +250,684 @@ func (h ImageHandler) handleGetImageNoExt(w http.ResponseWriter, r *http.Request
 	}
 }
 
-func (h ImageHandler) handleGetImageWithExt(w http.ResponseWriter, r *http.Request, ID, ext string) {
+// handleGetImageRange writes part of the original image for a Range request, the whole image is written if the
+// range can't be used (see parseRange) or If-Range doesn't match.
+func (h *ImageHandler) handleGetImageRange(w http.ResponseWriter, r *http.Request, info progimage.ImageInfo) {
+	ID := info.ID
+	if !ifRange(r.Header.Get("If-Range"), info.Hash, info.Created) {
+		h.writeImage(w, r, info)
+		return
+	}
+
+	offset, length, err := parseRange(r.Header.Get("Range"), info.Size)
+	if err == errUnsatisfiableRange {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+		writeError(w, r, &Error{
+			Status:  http.StatusRequestedRangeNotSatisfiable,
+			Code:    CodeRangeNotSatisfiable,
+			Message: err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		h.writeImage(w, r, info)
+		return
+	}
+
+	img, err := h.getRange(r.Context(), ID, offset, length)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	defer closeData(img)
+
+	setCacheHeaders(w, info.Hash, info.Created)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if _, err := io.Copy(w, img.Data); err != nil {
+		log.Println("error writing handleGetImageRange response", err.Error())
+	}
+}
+
+// getRange gets part of an image, using progimage.RangeGetter if the image service implements it.
+func (h *ImageHandler) getRange(ctx context.Context, ID string, offset, length int64) (progimage.Image, error) {
+	if rg, ok := h.ImageService.(progimage.RangeGetter); ok {
+		return rg.GetRange(ctx, ID, offset, length)
+	}
+
+	img, err := h.ImageService.Get(ctx, ID)
+	if err != nil {
+		return img, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, img.Data, offset); err != nil {
+		closeData(img)
+		return img, errors.Wrapf(err, "error reading image %s", ID)
+	}
+	img.Data = readCloser{io.LimitReader(img.Data, length), img.Data}
+	return img, nil
+}
+
+// readCloser keeps the original data of an image so closeData still closes it.
+type readCloser struct {
+	io.Reader
+	orig io.Reader
+}
+
+// Close closes the original data if it needs closing.
+func (rc readCloser) Close() error {
+	if c, ok := rc.orig.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+var errUnsatisfiableRange = errors.New("requested range not satisfiable")
+
+// parseRange parses a Range header for a single byte range (RFC 7233) of data of the given size, returning
+// errUnsatisfiableRange if the range is outside the data. Multiple ranges aren't supported, they're treated as
+// invalid so the whole image is sent, as is allowed.
+func parseRange(header string, size int64) (offset, length int64, err error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return 0, 0, errors.Errorf("invalid range %q", header)
+	}
+	spec := strings.TrimSpace(strings.TrimPrefix(header, "bytes="))
+	i := strings.Index(spec, "-")
+	if i < 0 || strings.Contains(spec, ",") {
+		return 0, 0, errors.Errorf("invalid range %q", header)
+	}
+	start, end := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	if start == "" {
+		// suffix, the last n bytes
+		n, err := strconv.ParseInt(end, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, errors.Errorf("invalid range %q", header)
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, errUnsatisfiableRange
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+
+	offset, err = strconv.ParseInt(start, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, errors.Errorf("invalid range %q", header)
+	}
+	last := size - 1
+	if end != "" {
+		if last, err = strconv.ParseInt(end, 10, 64); err != nil || last < offset {
+			return 0, 0, errors.Errorf("invalid range %q", header)
+		}
+		if last > size-1 {
+			last = size - 1
+		}
+	}
+	if offset >= size {
+		return 0, 0, errUnsatisfiableRange
+	}
+	return offset, last - offset + 1, nil
+}
+
+// ifRange reports whether a range request should be served given its If-Range header, it must be empty or match the
+// image exactly (strong ETag comparison or the same date).
+func ifRange(header, etag string, modified time.Time) bool {
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) || strings.HasPrefix(header, "W/") {
+		return etag != "" && header == `"`+etag+`"`
+	}
+	t, err := http.ParseTime(header)
+	return err == nil && !modified.IsZero() && modified.Truncate(time.Second).Equal(t)
+}
+
+var errUnsupportedFormat = &progimage.Error{Kind: progimage.ErrUnsupportedFormat, Detail: "no transformer for format"}
+
+// handleGetImageWithExt runs p (without a Transformer) on an image (info from Stat), encoding to the format of ext.
+func (h *ImageHandler) handleGetImageWithExt(
+	w http.ResponseWriter, r *http.Request, info progimage.ImageInfo, ext string, spec primage.Spec, p primage.Pipeline,
+) {
 	tr, ok := h.Transformers[ext]
 	if !ok {
-		http.Error(w, "unsupported image type", http.StatusBadRequest)
+		writeError(w, r, errUnsupportedFormat)
+		return
+	}
+
+	spec, p, err := withFocus(spec, p, info.Focus)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	p.Transformer = tr
+	h.writePipeline(w, r, info, spec, p)
+}
+
+// handleGetImageWithOps runs p (without a Transformer) on an image (info from Stat) keeping the original format.
+func (h *ImageHandler) handleGetImageWithOps(
+	w http.ResponseWriter, r *http.Request, info progimage.ImageInfo, spec primage.Spec, p primage.Pipeline,
+) {
+	tr, ok := h.transformerFor(info.ContentType)
+	if !ok {
+		writeError(w, r, errUnsupportedFormat)
 		return
 	}
-	imgOrig, err := h.ImageService.Get(ID)
+
+	spec, p, err := withFocus(spec, p, info.Focus)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	p.Transformer = tr
+	h.writePipeline(w, r, info, spec, p)
+}
+
+// withFocus crops the cover resize of spec around the stored focal point of an image, nil if it hasn't got one (see
+// primage.Spec.WithFocus), recreating the operations of p (created from spec) to match.
+func withFocus(
+	spec primage.Spec, p primage.Pipeline, focus *progimage.Focus,
+) (primage.Spec, primage.Pipeline, error) {
+	if focus == nil {
+		return spec, p, nil
+	}
+	spec = spec.WithFocus(*focus)
+	ops, err := spec.Operations()
 	if err != nil {
-		if err == progimage.ErrImageNotFound {
-			http.Error(w, fmt.Sprintf("image %s not found", ID), http.StatusNotFound)
+		return spec, p, err
+	}
+	p.Operations = ops
+	return spec, p, nil
+}
+
+// derivativeKey identifies the output of a transformation (p created from spec) of an image with the given focal
+// point, it's a hex string so safe for any DerivativeStore. Setting the focal point doesn't change the image data (or
+// its ETag) so it's part of the key even if spec doesn't use it.
+func derivativeKey(spec primage.Spec, p primage.Pipeline, focus *progimage.Focus) string {
+	k := spec.String() + " " + p.Transformer.ContentType
+	if o := p.Options.String(); o != "" {
+		k += " " + o
+	}
+	if p.StripMetadata {
+		k += " strip"
+	}
+	if focus != nil {
+		k += " focus=" + focus.String()
+	}
+	sum := sha256.Sum256([]byte(k))
+	return hex.EncodeToString(sum[:])
+}
+
+// derivativeETag is the ETag of a transformation (see derivativeKey) of an image with the given ETag.
+func derivativeETag(etag, key string) string {
+	sum := sha256.Sum256([]byte(etag + " " + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// setCacheHeaders sets the caching headers for an image, only call it once the image is going to be written.
+func setCacheHeaders(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("Cache-Control", cacheControl)
+	if etag != "" {
+		w.Header().Set("ETag", `"`+etag+`"`)
+	}
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified checks the request's conditional headers, if the client already has the image a 304 (with caching
+// headers) is written and true returned. If-None-Match takes precedence over If-Modified-Since.
+func notModified(w http.ResponseWriter, r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if !etagMatch(inm, etag) {
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		// the header has second precision
+		if err != nil || modified.Truncate(time.Second).After(t) {
+			return false
+		}
+	} else {
+		return false
+	}
+
+	setCacheHeaders(w, etag, modified)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch reports whether an If-None-Match header value matches etag, using weak comparison (RFC 7232).
+func etagMatch(header, etag string) bool {
+	for _, v := range strings.Split(header, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" {
+			return true
+		}
+		if etag != "" && strings.TrimPrefix(v, "W/") == `"`+etag+`"` {
+			return true
+		}
+	}
+	return false
+}
+
+// closeData closes the image data if it needs closing, eg a file.
+func closeData(img progimage.Image) {
+	if c, ok := img.Data.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("error closing image data (id: %s), %s", img.ID, err)
+		}
+	}
+}
+
+// transformerFor returns the transformer that outputs the given content type.
+func (h *ImageHandler) transformerFor(contentType string) (primage.Transformer, bool) {
+	for _, tr := range h.Transformers {
+		if tr.ContentType == contentType {
+			return tr, true
+		}
+	}
+	return primage.Transformer{}, false
+}
+
+// writePipeline writes the output of p (created from spec) run on the image (info from Stat). If h.Derivatives is set
+// the output is read from there when possible, otherwise it's stored there for next time, see derivativeKey. The
+// original is only read if the output needs to be made.
+func (h *ImageHandler) writePipeline(
+	w http.ResponseWriter, r *http.Request, info progimage.ImageInfo, spec primage.Spec, p primage.Pipeline,
+) {
+	key := derivativeKey(spec, p, info.Focus)
+	// nothing to do if the pipeline returns the original
+	converted := len(p.Operations) > 0 || p.Options != (primage.EncodeOptions{}) ||
+		info.ContentType != p.Transformer.ContentType
+	transformed := converted || p.StripMetadata
+	// stripping metadata from an original is cheap, it's not worth storing
+	cache := h.Derivatives != nil && converted
+
+	etag := info.Hash
+	if etag != "" && transformed {
+		etag = derivativeETag(etag, key)
+	}
+	if notModified(w, r, etag, info.Created) {
+		return
+	}
+
+	if cache {
+		img, err := h.Derivatives.GetDerivative(r.Context(), info.ID, key)
+		if err == nil {
+			defer closeData(img)
+			setCacheHeaders(w, etag, info.Created)
+			w.Header().Set("Content-Type", img.ContentType)
+			if _, err := io.Copy(w, img.Data); err != nil {
+				log.Printf("error writing derivative (id: %s), %s", info.ID, err)
+			}
 			return
 		}
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err != progimage.ErrImageNotFound {
+			log.Printf("error getting derivative (id: %s), %s", info.ID, err)
+		}
+	}
+
+	imgOrig, err := h.ImageService.Get(r.Context(), info.ID)
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
+	defer closeData(imgOrig)
 
-	ec := make(chan error, 1)
-	imgConv, err := tr.Transform(imgOrig, ec)
+	imgConv, err := p.Run(r.Context(), imgOrig)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
+	if cache {
+		// the whole output is needed to store it
+		data, err := ioutil.ReadAll(imgConv.Data)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		imgConv.Data = bytes.NewReader(data)
+
+		d := progimage.Image{ID: info.ID, Data: bytes.NewReader(data), ContentType: imgConv.ContentType}
+		if err := h.Derivatives.StoreDerivative(r.Context(), info.ID, key, d); err != nil {
+			log.Printf("error storing derivative (id: %s), %s", info.ID, err)
+		}
+	}
+
+	setCacheHeaders(w, etag, info.Created)
 	w.Header().Set("Content-Type", imgConv.ContentType)
 	written, err := io.Copy(w, imgConv.Data)
 	if err != nil {
 		if written == 0 {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			// nothing sent yet, don't let the error be cached
+			for _, k := range []string{"Cache-Control", "ETag", "Last-Modified"} {
+				w.Header().Del(k)
+			}
+			writeError(w, r, err)
 		} else {
 			// 200 sent already, all we can do is log
 			log.Printf(
-				"error converting %s to %s (id: %s), 200 sent already",
+				"error converting %s to %s (id: %s), 200 sent already, %s",
 				imgOrig.ContentType,
 				imgConv.ContentType,
-				imgOrig.ID,
+				info.ID,
+				err,
 			)
 		}
 	}
 }
+
+func (h *ImageHandler) handleHeadImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ID := params.ByName("id")
+
+	if strings.Contains(ID, ".") || len(r.URL.Query()) > 0 {
+		// transformed, the only way to know the size is to do the work, the body is discarded by net/http
+		h.handleGetImage(w, r, params)
+		return
+	}
+	info, ok := h.stat(w, r, ID)
+	if !ok {
+		return
+	}
+	if h.StripMetadata && info.HasMetadata {
+		p := primage.Pipeline{Limits: h.Limits, StripMetadata: true}
+		h.handleGetImageWithOps(w, r, info, nil, p)
+		return
+	}
+
+	// sent with a 304 too, see handleGetImageNoExt
+	setFocusHeader(w, info.Focus)
+	if notModified(w, r, info.Hash, info.Created) {
+		return
+	}
+
+	setCacheHeaders(w, info.Hash, info.Created)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Type", info.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.Header().Set("X-Image-Width", strconv.Itoa(info.Width))
+	w.Header().Set("X-Image-Height", strconv.Itoa(info.Height))
+}
+
+// imageMeta is the image info with any EXIF metadata of the stored image, even if StripMetadata is set.
+type imageMeta struct {
+	progimage.ImageInfo
+	EXIF *primage.EXIF `json:"exif,omitempty"`
+}
+
+func (h *ImageHandler) handleGetImageMeta(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ID := params.ByName("id")
+	info, ok := h.stat(w, r, ID)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	meta := imageMeta{ImageInfo: info, EXIF: h.exif(r.Context(), ID, info)}
+	if err := json.NewEncoder(w).Encode(meta); err != nil {
+		log.Println("error writing handleGetImageMeta response", err.Error())
+	}
+}
+
+// exif reads the EXIF metadata of a JPEG (with the given info), nil if it has none. Errors are logged, the rest of the
+// info is still useful without it.
+func (h *ImageHandler) exif(ctx context.Context, ID string, info progimage.ImageInfo) *primage.EXIF {
+	if info.ContentType != "image/jpeg" || info.Size == 0 {
+		return nil
+	}
+	length := int64(primage.MetadataBytes)
+	if info.Size < length {
+		length = info.Size
+	}
+	img, err := h.getRange(ctx, ID, 0, length)
+	if err != nil {
+		log.Printf("error getting image metadata (id: %s), %s", ID, err)
+		return nil
+	}
+	defer closeData(img)
+
+	data, err := ioutil.ReadAll(img.Data)
+	if err != nil {
+		log.Printf("error reading image metadata (id: %s), %s", ID, err)
+		return nil
+	}
+	exif, err := primage.ParseEXIF(data)
+	if err != nil {
+		log.Printf("error parsing exif (id: %s), %s", ID, err)
+	}
+	return exif
+}
+
+// focusHeader is the stored focal point of an image sent with the original, x,y (see progimage.ParseFocus).
+const focusHeader = "X-Image-Focus"
+
+// setFocusHeader sets the focus header if the image has a focal point.
+func setFocusHeader(w http.ResponseWriter, focus *progimage.Focus) {
+	if focus != nil {
+		w.Header().Set(focusHeader, focus.String())
+	}
+}
+
+// parseFocusHeader returns the focal point in a focus header, nil if there isn't one or it's invalid.
+func parseFocusHeader(header string) *progimage.Focus {
+	f, err := progimage.ParseFocus(header)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+// maxFocusBytes is the max size of a set focus request body.
+const maxFocusBytes = 1024
+
+// handleSetImageFocus stores the focal point in the json body, {"x": 0.5, "y": 0.25} (see progimage.Focus), cover
+// resizes of the image are cropped around it.
+func (h *ImageHandler) handleSetImageFocus(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	body := struct {
+		X *float64 `json:"x"`
+		Y *float64 `json:"y"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxFocusBytes)).Decode(&body); err != nil {
+		writeError(w, r, badRequest("invalid json body, "+err.Error()))
+		return
+	}
+	if body.X == nil || body.Y == nil {
+		writeError(w, r, badRequest("x and y are required"))
+		return
+	}
+	focus := &progimage.Focus{X: *body.X, Y: *body.Y}
+	if !focus.Valid() {
+		writeError(w, r, badRequest("x and y must be between 0 and 1"))
+		return
+	}
+	h.setFocus(w, r, params.ByName("id"), focus)
+}
+
+func (h *ImageHandler) handleDeleteImageFocus(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	h.setFocus(w, r, params.ByName("id"), nil)
+}
+
+// setFocus stores the focal point of an image, nil removes it, if the image service can.
+func (h *ImageHandler) setFocus(w http.ResponseWriter, r *http.Request, ID string, focus *progimage.Focus) {
+	fs, ok := h.ImageService.(progimage.FocusSetter)
+	if !ok {
+		writeError(w, r, &Error{
+			Status:  http.StatusNotImplemented,
+			Code:    CodeNotImplemented,
+			Message: "the image service can't store focal points",
+		})
+		return
+	}
+	if err := fs.SetFocus(r.Context(), ID, focus); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stat gets the image info, writing an error response if that's not possible.
+func (h *ImageHandler) stat(w http.ResponseWriter, r *http.Request, ID string) (progimage.ImageInfo, bool) {
+	info, err := h.ImageService.Stat(r.Context(), ID)
+	if err != nil {
+		writeError(w, r, err)
+		return info, false
+	}
+	return info, true
+}
+
+func (h *ImageHandler) handleDeleteImage(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	ID := params.ByName("id")
+
+	if err := h.ImageService.Delete(r.Context(), ID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if h.Derivatives != nil {
+		if err := h.Derivatives.DeleteDerivatives(r.Context(), ID); err != nil {
+			log.Printf("error deleting derivatives (id: %s), %s", ID, err)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseEncodeOptions reads the q, compression, colors and lossless query params, see primage.EncodeOptions. Quality
+// and colors are clamped to MaxQuality and MinColors.
+func (h *ImageHandler) parseEncodeOptions(q url.Values) (primage.EncodeOptions, error) {
+	opts := primage.EncodeOptions{}
+	if v := q.Get("q"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return opts, errors.Errorf("invalid q %q, must be 1-100", v)
+		}
+		if h.MaxQuality > 0 && n > h.MaxQuality {
+			n = h.MaxQuality
+		}
+		opts.Quality = n
+	}
+
+	switch v := q.Get("compression"); v {
+	case "", primage.CompressionDefault, primage.CompressionBest, primage.CompressionFast, primage.CompressionNone:
+		opts.Compression = v
+	default:
+		return opts, errors.Errorf("invalid compression %q, must be default, best, fast or none", v)
+	}
+
+	if v := q.Get("colors"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 || n > 256 {
+			return opts, errors.Errorf("invalid colors %q, must be 2-256", v)
+		}
+		if n < h.MinColors {
+			n = h.MinColors
+		}
+		opts.Colors = n
+	}
+
+	if v := q.Get("lossless"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, errors.Errorf("invalid lossless %q, must be 1 or 0", v)
+		}
+		opts.Lossless = b
+	}
+	return opts, nil
+}
+
+// negotiateFormat returns the FormatPreference entry the Accept header prefers, false if none of them are listed
+// explicitly so the original format should be kept. Wildcards aren't enough to change the format, clients that send
+// */* may not support everything we can encode (eg webp).
+func (h *ImageHandler) negotiateFormat(accept string) (string, bool) {
+	ext, best := "", 0.0
+	for _, e := range h.FormatPreference {
+		tr, ok := h.Transformers[e]
+		if !ok {
+			continue
+		}
+		// earlier preferences win ties
+		if q := acceptQuality(accept, tr.ContentType); q > best {
+			ext, best = e, q
+		}
+	}
+	return ext, best > 0
+}
+
+// acceptQuality returns the q value the Accept header gives contentType if it's listed explicitly, 0 if not listed or
+// invalid.
+func acceptQuality(accept, contentType string) float64 {
+	for _, v := range strings.Split(accept, ",") {
+		params := strings.Split(v, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), contentType) {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(p[2:], 64); err != nil {
+					return 0
+				}
+			}
+		}
+		return q
+	}
+	return 0
+}
+
+// parseSpec reads the ops query param (see primage.ParseSpec), then adds the crop (x,y,w,h), rotate (90, 180 or 270
+// clockwise) and flip (h or v) params in that order, so the crop rectangle is in pixels of the image before it's
+// rotated. The w, h and fit params add a final resize, crop=smart makes it a cover resize cropped around the most
+// interesting part of the image instead.
+func parseSpec(q url.Values) (primage.Spec, error) {
+	spec, err := primage.ParseSpec(q.Get("ops"))
+	if err != nil {
+		return nil, err
+	}
+
+	smart := q.Get("crop") == "smart"
+	if v := q.Get("crop"); v != "" && !smart {
+		xywh := strings.Split(v, ",")
+		if len(xywh) != 4 {
+			return nil, &progimage.Error{
+				Kind:   progimage.ErrInvalidTransform,
+				Detail: fmt.Sprintf("crop %q must be x,y,w,h", v),
+			}
+		}
+		cs := primage.OperationSpec{Name: "crop", Args: map[string]string{}}
+		for i, k := range []string{"x", "y", "w", "h"} {
+			cs.Args[k] = strings.TrimSpace(xywh[i])
+		}
+		spec = append(spec, cs)
+	}
+	if v := q.Get("rotate"); v != "" {
+		spec = append(spec, primage.OperationSpec{Name: "rotate", Args: map[string]string{"deg": v}})
+	}
+	if v := q.Get("flip"); v != "" {
+		spec = append(spec, primage.OperationSpec{Name: "flip", Args: map[string]string{"dir": v}})
+	}
+
+	rs := primage.OperationSpec{Name: "resize", Args: map[string]string{}}
+	for _, k := range []string{"w", "h", "fit"} {
+		if v := q.Get(k); v != "" {
+			rs.Args[k] = v
+		}
+	}
+	if smart {
+		rs.Args["focus"] = "smart"
+		if rs.Args["fit"] == "" {
+			rs.Args["fit"] = string(primage.FitCover)
+		}
+	}
+	if len(rs.Args) > 0 {
+		spec = append(spec, rs)
+	}
+	return spec, nil
+}
@@ -2,17 +2,32 @@ package http_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/gif"  // register image type, do not remove
+	_ "image/jpeg" // register image type, do not remove
+	_ "image/png"  // register image type, do not remove
 	"io"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/j0hnsmith/progimage"
 	pihttp "github.com/j0hnsmith/progimage/http"
+	primage "github.com/j0hnsmith/progimage/image"
+	"github.com/j0hnsmith/progimage/memory"
 	"github.com/j0hnsmith/progimage/mock"
+	"github.com/pkg/errors"
+	_ "golang.org/x/image/webp" // register image type, do not remove
 )
 
 // ImageHandler is test wrapper that uses a mocked image service.
@@ -22,8 +37,23 @@ type ImageHandler struct {
 	ImageService *mock.ImageService
 }
 
+// NewImageHandler creates an ImageHandler, images are stat'd before they're written so unless a test sets StatFunc
+// the info comes from GetFunc (without reading the data).
 func NewImageHandler() *ImageHandler {
 	is := new(mock.ImageService)
+	is.StatFunc = func(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+		img, err := is.GetFunc(ctx, ID)
+		if err != nil {
+			return progimage.ImageInfo{}, err
+		}
+		return progimage.ImageInfo{
+			ID:          ID,
+			ContentType: img.ContentType,
+			Created:     img.LastModified,
+			Hash:        img.ETag,
+			Focus:       img.Focus,
+		}, nil
+	}
 	ih := pihttp.NewImageHandler(is)
 	return &ImageHandler{ih, is}
 }
@@ -32,7 +62,7 @@ func TestGet_OK(t *testing.T) {
 	h := NewImageHandler()
 
 	var createdID string
-	h.ImageService.GetFunc = func(ID string) (progimage.Image, error) {
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
 		createdID = ID
 		return progimage.Image{Data: new(bytes.Reader)}, nil
 	}
@@ -59,7 +89,7 @@ func TestGet_OK(t *testing.T) {
 func TestGet_NotFound(t *testing.T) {
 	h := NewImageHandler()
 
-	h.ImageService.GetFunc = func(ID string) (progimage.Image, error) {
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
 		return progimage.Image{}, progimage.ErrImageNotFound
 	}
 
@@ -83,7 +113,7 @@ func TestGet_WithExt(t *testing.T) {
 
 	var getID string
 	var fp *os.File
-	h.ImageService.GetFunc = func(ID string) (progimage.Image, error) {
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
 		getID = ID
 
 		var err error
@@ -120,10 +150,121 @@ func TestGet_WithExt(t *testing.T) {
 	fp.Close()
 }
 
+func TestGet_Conditional(t *testing.T) {
+	modified := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	var conditionalTests = []struct {
+		Name    string
+		Path    string
+		Headers map[string]string
+		Status  int
+	}{
+		{Name: "unconditional", Path: "/image/foo", Status: http.StatusOK},
+		{Name: "etag match", Path: "/image/foo", Headers: map[string]string{"If-None-Match": `"abc"`}, Status: http.StatusNotModified},
+		{Name: "etag list", Path: "/image/foo", Headers: map[string]string{"If-None-Match": `"xyz", W/"abc"`}, Status: http.StatusNotModified},
+		{Name: "etag any", Path: "/image/foo", Headers: map[string]string{"If-None-Match": "*"}, Status: http.StatusNotModified},
+		{Name: "etag mismatch", Path: "/image/foo", Headers: map[string]string{"If-None-Match": `"xyz"`}, Status: http.StatusOK},
+		{Name: "not modified since", Path: "/image/foo", Headers: map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, Status: http.StatusNotModified},
+		{Name: "modified since", Path: "/image/foo", Headers: map[string]string{"If-Modified-Since": modified.Add(-time.Second).Format(http.TimeFormat)}, Status: http.StatusOK},
+		{
+			Name: "etag takes precedence", Path: "/image/foo",
+			Headers: map[string]string{"If-None-Match": `"xyz"`, "If-Modified-Since": modified.Format(http.TimeFormat)},
+			Status:  http.StatusOK,
+		},
+		// transformed images have a different etag
+		{Name: "transformed", Path: "/image/foo.png", Headers: map[string]string{"If-None-Match": `"abc"`}, Status: http.StatusOK},
+	}
+
+	for _, item := range conditionalTests {
+		t.Run(item.Name, func(t *testing.T) {
+			h := NewImageHandler()
+			h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+				fp, err := os.Open("../testimages/test.jpg")
+				if err != nil {
+					return progimage.Image{}, err
+				}
+				return progimage.Image{ID: ID, Data: fp, ContentType: "image/jpeg", ETag: "abc", LastModified: modified}, nil
+			}
+
+			req, err := http.NewRequest("GET", item.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range item.Headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != item.Status {
+				t.Errorf("expected: %v got: %v", item.Status, rr.Code)
+			}
+			if item.Status == http.StatusNotModified && rr.Body.Len() != 0 {
+				t.Errorf("expected empty body, got %d bytes", rr.Body.Len())
+			}
+			if cc := rr.Header().Get("Cache-Control"); cc != "public, max-age=31536000, immutable" {
+				t.Errorf("expected immutable Cache-Control, got: %v", cc)
+			}
+			if lm := rr.Header().Get("Last-Modified"); lm != modified.Format(http.TimeFormat) {
+				t.Errorf("expected Last-Modified %s, got: %v", modified.Format(http.TimeFormat), lm)
+			}
+			etag := rr.Header().Get("ETag")
+			if strings.Contains(item.Path, ".") {
+				if etag == "" || etag == `"abc"` {
+					t.Errorf("expected transformed ETag to differ from source, got: %v", etag)
+				}
+			} else if etag != `"abc"` {
+				t.Errorf("expected ETag \"abc\", got: %v", etag)
+			}
+		})
+	}
+}
+
+func TestGet_ConditionalTransformed(t *testing.T) {
+	h := NewImageHandler()
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+		fp, err := os.Open("../testimages/test.jpg")
+		if err != nil {
+			return progimage.Image{}, err
+		}
+		return progimage.Image{ID: ID, Data: fp, ContentType: "image/jpeg", ETag: "abc"}, nil
+	}
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	small := get("/image/foo.png?w=10", "").Header().Get("ETag")
+	large := get("/image/foo.png?w=20", "").Header().Get("ETag")
+	if small == "" || small == large {
+		t.Fatalf("expected different ETags for different transforms, got %s and %s", small, large)
+	}
+	low, high := get("/image/foo?q=50", "").Header().Get("ETag"), get("/image/foo?q=60", "").Header().Get("ETag")
+	if low == high {
+		t.Errorf("expected different ETags for different encoder options, got %s and %s", low, high)
+	}
+
+	if rr := get("/image/foo.png?w=10", small); rr.Code != http.StatusNotModified {
+		t.Errorf("expected: %v got: %v", http.StatusNotModified, rr.Code)
+	}
+	if rr := get("/image/foo.png?w=20", small); rr.Code != http.StatusOK {
+		t.Errorf("expected: %v got: %v", http.StatusOK, rr.Code)
+	}
+}
+
 func TestGet_WithUnsupportedExt(t *testing.T) {
 	h := NewImageHandler()
 
-	h.ImageService.GetFunc = func(ID string) (progimage.Image, error) {
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
 		return progimage.Image{ID: ID, Data: new(bytes.Buffer), ContentType: "image/jpeg"}, nil
 	}
 
@@ -137,8 +278,8 @@ func TestGet_WithUnsupportedExt(t *testing.T) {
 
 	h.ServeHTTP(rr, req)
 
-	if status := rr.Code; status != http.StatusBadRequest {
-		t.Errorf("expected: %v got: %v", http.StatusOK, status)
+	if status := rr.Code; status != http.StatusUnsupportedMediaType {
+		t.Errorf("expected: %v got: %v", http.StatusUnsupportedMediaType, status)
 	}
 }
 
@@ -147,7 +288,7 @@ func TestStore_OK(t *testing.T) {
 
 	expectedID := "foo"
 	dataIn := new(bytes.Buffer)
-	h.ImageService.StoreFunc = func(r io.Reader) (string, error) {
+	h.ImageService.StoreFunc = func(ctx context.Context, r io.Reader) (string, error) {
 		io.Copy(dataIn, r)
 		return expectedID, nil
 	}
@@ -186,7 +327,7 @@ func TestStore_OK(t *testing.T) {
 func TestStore_UnregognisedImagetype(t *testing.T) {
 	h := NewImageHandler()
 
-	h.ImageService.StoreFunc = func(r io.Reader) (string, error) {
+	h.ImageService.StoreFunc = func(ctx context.Context, r io.Reader) (string, error) {
 		return "", progimage.ErrUnrecognisedImageType
 	}
 
@@ -203,3 +344,1654 @@ func TestStore_UnregognisedImagetype(t *testing.T) {
 		t.Errorf("expected: %v got: %v", http.StatusBadRequest, status)
 	}
 }
+
+func TestStore_Multipart(t *testing.T) {
+	h := NewImageHandler()
+
+	var stored []string
+	h.ImageService.StoreFunc = func(ctx context.Context, r io.Reader) (string, error) {
+		d, err := ioutil.ReadAll(r)
+		if err != nil {
+			return "", err
+		}
+		stored = append(stored, string(d))
+		return fmt.Sprintf("id%d", len(stored)), nil
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	mw.WriteField("name", "ignored")
+	for _, d := range []string{"img one", "img two"} {
+		fw, err := mw.CreateFormFile("file", "img.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(d))
+	}
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/image/create", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("expected: %v got: %v", http.StatusCreated, status)
+	}
+
+	rd := struct {
+		ID  string
+		IDs []string
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(&rd); err != nil {
+		t.Fatal(err)
+	}
+	if rd.ID != "id1" || len(rd.IDs) != 2 || rd.IDs[0] != "id1" || rd.IDs[1] != "id2" {
+		t.Errorf("expected id1 and ids [id1 id2], got: %+v", rd)
+	}
+	if len(stored) != 2 || stored[0] != "img one" || stored[1] != "img two" {
+		t.Errorf("expected file parts to be stored, got: %q", stored)
+	}
+}
+
+func TestStore_MultipartUnrecognised(t *testing.T) {
+	h := NewImageHandler()
+
+	h.ImageService.StoreFunc = func(ctx context.Context, r io.Reader) (string, error) {
+		d, _ := ioutil.ReadAll(r)
+		if string(d) != "img" {
+			return "", progimage.ErrUnrecognisedImageType
+		}
+		return "id1", nil
+	}
+	var deleted []string
+	h.ImageService.DeleteFunc = func(ctx context.Context, ID string) error {
+		deleted = append(deleted, ID)
+		return nil
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for _, d := range []string{"img", "not an img"} {
+		fw, err := mw.CreateFormFile("file", "img.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(d))
+	}
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/image/create", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("expected: %v got: %v", http.StatusBadRequest, status)
+	}
+	if len(deleted) != 1 || deleted[0] != "id1" {
+		t.Errorf("expected images already stored to be deleted, got: %v", deleted)
+	}
+}
+
+func TestStore_MultipartTooMany(t *testing.T) {
+	h := NewImageHandler()
+	h.BatchMaxItems = 2
+
+	var stored []string
+	h.ImageService.StoreFunc = func(ctx context.Context, r io.Reader) (string, error) {
+		stored = append(stored, fmt.Sprintf("id%d", len(stored)+1))
+		return stored[len(stored)-1], nil
+	}
+	var deleted []string
+	h.ImageService.DeleteFunc = func(ctx context.Context, ID string) error {
+		deleted = append(deleted, ID)
+		return nil
+	}
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	for _, d := range []string{"img one", "img two", "img three"} {
+		fw, err := mw.CreateFormFile("file", "img.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte(d))
+	}
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/image/create", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusBadRequest {
+		t.Errorf("expected: %v got: %v", http.StatusBadRequest, status)
+	}
+	if len(stored) != 2 {
+		t.Errorf("expected only %d images to be stored, got: %v", h.BatchMaxItems, stored)
+	}
+	if len(deleted) != 2 || deleted[0] != "id1" || deleted[1] != "id2" {
+		t.Errorf("expected images already stored to be deleted, got: %v", deleted)
+	}
+}
+
+func TestStore_Base64(t *testing.T) {
+	h := NewImageHandler()
+
+	dataIn := new(bytes.Buffer)
+	h.ImageService.StoreFunc = func(ctx context.Context, r io.Reader) (string, error) {
+		io.Copy(dataIn, r)
+		return "foo", nil
+	}
+
+	imgData := "some img data"
+	body := fmt.Sprintf(`{"data": "%s"}`, base64.StdEncoding.EncodeToString([]byte(imgData)))
+	req, err := http.NewRequest("POST", "/image/create", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("expected: %v got: %v", http.StatusCreated, status)
+	}
+	if body := strings.TrimSpace(rr.Body.String()); body != `{"id":"foo","ids":["foo"]}` {
+		t.Errorf("unexpected response %s", body)
+	}
+	if imgData != dataIn.String() {
+		t.Errorf("expected data read to be '%s', got '%s'", imgData, dataIn.String())
+	}
+}
+
+func TestStore_InvalidBody(t *testing.T) {
+	emptyForm := new(bytes.Buffer)
+	mw := multipart.NewWriter(emptyForm)
+	mw.WriteField("name", "no files")
+	mw.Close()
+
+	var invalidBodyTests = []struct {
+		Name        string
+		ContentType string
+		Body        string
+	}{
+		{Name: "json", ContentType: "application/json", Body: `{"data":`},
+		{Name: "no data", ContentType: "application/json", Body: `{}`},
+		{Name: "base64", ContentType: "application/json", Body: `{"data": "not base64!"}`},
+		{Name: "no files", ContentType: mw.FormDataContentType(), Body: emptyForm.String()},
+		{Name: "multipart", ContentType: "multipart/form-data; boundary=foo", Body: "not multipart"},
+	}
+
+	for _, item := range invalidBodyTests {
+		t.Run(item.Name, func(t *testing.T) {
+			h := NewImageHandler()
+
+			req, err := http.NewRequest("POST", "/image/create", strings.NewReader(item.Body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", item.ContentType)
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("expected: %v got: %v", http.StatusBadRequest, status)
+			}
+			if h.ImageService.StoreInvoked {
+				t.Error("expected nothing to be stored")
+			}
+		})
+	}
+}
+
+func TestStore_TooLarge(t *testing.T) {
+	png, err := ioutil.ReadFile("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := new(bytes.Buffer)
+	mw := multipart.NewWriter(form)
+	fw, err := mw.CreateFormFile("file", "test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(png)
+	mw.Close()
+
+	var tooLargeTests = []struct {
+		Name        string
+		ContentType string
+		Body        io.Reader
+	}{
+		{Name: "content length", ContentType: "image/png", Body: bytes.NewReader(png)},
+		// unknown length, only found out while reading
+		{Name: "streamed", ContentType: "image/png", Body: io.MultiReader(bytes.NewReader(png))},
+		{Name: "multipart", ContentType: mw.FormDataContentType(), Body: bytes.NewReader(form.Bytes())},
+		{
+			Name:        "base64",
+			ContentType: "application/json",
+			Body:        strings.NewReader(`{"data": "` + base64.StdEncoding.EncodeToString(png) + `"}`),
+		},
+	}
+
+	for _, item := range tooLargeTests {
+		t.Run(item.Name, func(t *testing.T) {
+			is := memory.NewImageService(0, uuid.New)
+			h := pihttp.NewImageHandler(is)
+			h.MaxUploadBytes = int64(len(png) - 1)
+
+			req, err := http.NewRequest("POST", "/image/create", item.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", item.ContentType)
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+				t.Errorf("expected: %v got: %v (%s)", http.StatusRequestEntityTooLarge, status, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), pihttp.CodeImageTooLarge) {
+				t.Errorf("expected %s error, got %s", pihttp.CodeImageTooLarge, rr.Body.String())
+			}
+			if is.Size() != 0 {
+				t.Error("expected nothing to be stored")
+			}
+		})
+	}
+}
+
+func TestStore_DimensionsTooLarge(t *testing.T) {
+	png, err := ioutil.ReadFile("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	is := memory.NewImageService(0, uuid.New)
+	is.Limits = primage.Limits{MaxWidth: 10}
+	h := pihttp.NewImageHandler(is)
+
+	req, err := http.NewRequest("POST", "/image/create", bytes.NewReader(png))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "image/png")
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("expected: %v got: %v (%s)", http.StatusUnprocessableEntity, status, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), pihttp.CodeImageDimensions) {
+		t.Errorf("expected %s error, got %s", pihttp.CodeImageDimensions, rr.Body.String())
+	}
+	if is.Size() != 0 {
+		t.Error("expected nothing to be stored")
+	}
+}
+
+func TestGet_DimensionsTooLarge(t *testing.T) {
+	var dimensionsTests = []struct {
+		Name   string
+		Path   string
+		Status int
+	}{
+		{Name: "original", Path: "/image/foo", Status: http.StatusOK},
+		{Name: "resize", Path: "/image/foo?w=5", Status: http.StatusUnprocessableEntity},
+		{Name: "convert", Path: "/image/foo.png", Status: http.StatusUnprocessableEntity},
+	}
+
+	for _, item := range dimensionsTests {
+		t.Run(item.Name, func(t *testing.T) {
+			h := NewImageHandler()
+			h.Limits = primage.Limits{MaxPixels: 100}
+
+			h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+				fp, err := os.Open("../testimages/test.jpg")
+				if err != nil {
+					return progimage.Image{}, err
+				}
+				return progimage.Image{ID: ID, Data: fp, ContentType: "image/jpeg"}, nil
+			}
+
+			req, err := http.NewRequest("GET", item.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != item.Status {
+				t.Fatalf("expected: %v got: %v (%s)", item.Status, status, rr.Body.String())
+			}
+			if item.Status != http.StatusOK && !strings.Contains(rr.Body.String(), pihttp.CodeImageDimensions) {
+				t.Errorf("expected %s error, got %s", pihttp.CodeImageDimensions, rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestGet_Resize(t *testing.T) {
+	var resizeTests = []struct {
+		Name        string
+		Path        string
+		ContentType string
+		Width       int
+		Height      int
+	}{
+		{Name: "with ext", Path: "/image/foo.png?w=20&h=10&fit=fill", ContentType: "image/png", Width: 20, Height: 10},
+		{Name: "no ext", Path: "/image/foo?w=20&h=10&fit=fill", ContentType: "image/jpeg", Width: 20, Height: 10},
+		{Name: "width only", Path: "/image/foo.gif?w=20", ContentType: "image/gif", Width: 20},
+		{Name: "webp", Path: "/image/foo.webp?w=20", ContentType: "image/webp", Width: 20},
+	}
+
+	for _, item := range resizeTests {
+		t.Run(item.Name, func(t *testing.T) {
+			h := NewImageHandler()
+
+			h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+				fp, err := os.Open("../testimages/test.jpg")
+				if err != nil {
+					return progimage.Image{}, err
+				}
+				return progimage.Image{ID: ID, Data: fp, ContentType: "image/jpeg"}, nil
+			}
+
+			req, err := http.NewRequest("GET", item.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusOK {
+				t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+			}
+
+			if rr.Header().Get("Content-Type") != item.ContentType {
+				t.Errorf("expected Content-Type %s, got: %v", item.ContentType, rr.Header().Get("Content-Type"))
+			}
+
+			cfg, _, err := image.DecodeConfig(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != item.Width {
+				t.Errorf("expected width %d, got %d", item.Width, cfg.Width)
+			}
+			if item.Height != 0 && cfg.Height != item.Height {
+				t.Errorf("expected height %d, got %d", item.Height, cfg.Height)
+			}
+		})
+	}
+}
+
+func TestGet_AutoFormat(t *testing.T) {
+	var autoFormatTests = []struct {
+		Name        string
+		Path        string
+		Accept      string
+		AutoFormat  bool
+		ContentType string
+	}{
+		{Name: "webp", Path: "/image/foo?auto=format", Accept: "image/avif,image/webp,image/apng,*/*;q=0.8", ContentType: "image/webp"},
+		{Name: "preference", Path: "/image/foo?auto=format", Accept: "image/png,image/jpeg", ContentType: "image/jpeg"},
+		{Name: "quality", Path: "/image/foo?auto=format", Accept: "image/webp;q=0.5,image/png", ContentType: "image/png"},
+		{Name: "rejected", Path: "/image/foo?auto=format", Accept: "image/webp;q=0,image/gif", ContentType: "image/gif"},
+		{Name: "wildcard keeps original", Path: "/image/foo?auto=format", Accept: "*/*", ContentType: "image/jpeg"},
+		{Name: "no accept keeps original", Path: "/image/foo?auto=format&w=20", ContentType: "image/jpeg"},
+		{Name: "server option", Path: "/image/foo", Accept: "image/webp", AutoFormat: true, ContentType: "image/webp"},
+	}
+
+	for _, item := range autoFormatTests {
+		t.Run(item.Name, func(t *testing.T) {
+			h := NewImageHandler()
+			h.AutoFormat = item.AutoFormat
+
+			h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+				fp, err := os.Open("../testimages/test.jpg")
+				if err != nil {
+					return progimage.Image{}, err
+				}
+				return progimage.Image{ID: ID, Data: fp, ContentType: "image/jpeg"}, nil
+			}
+
+			req, err := http.NewRequest("GET", item.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item.Accept != "" {
+				req.Header.Set("Accept", item.Accept)
+			}
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusOK {
+				t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != item.ContentType {
+				t.Errorf("expected Content-Type %s, got: %v", item.ContentType, ct)
+			}
+			if v := rr.Header().Get("Vary"); v != "Accept" {
+				t.Errorf("expected Vary Accept, got: %q", v)
+			}
+			if _, _, err := image.Decode(rr.Body); err != nil {
+				t.Errorf("expected a valid image, got %s", err)
+			}
+		})
+	}
+}
+
+func TestGet_NoAutoFormat(t *testing.T) {
+	h := NewImageHandler()
+
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+		return progimage.Image{ID: ID, Data: strings.NewReader("data"), ContentType: "image/jpeg"}, nil
+	}
+
+	req, err := http.NewRequest("GET", "/image/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "image/webp")
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if ct := rr.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("expected original Content-Type image/jpeg, got: %v", ct)
+	}
+	if v := rr.Header().Get("Vary"); v != "" {
+		t.Errorf("expected no Vary header, got: %q", v)
+	}
+}
+
+func TestGet_EncodeOptions(t *testing.T) {
+	h := NewImageHandler()
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+		fp, err := os.Open("../testimages/test.jpg")
+		if err != nil {
+			return progimage.Image{}, err
+		}
+		return progimage.Image{ID: ID, Data: fp, ContentType: "image/jpeg"}, nil
+	}
+
+	size := func(path string) int {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%s expected: %v got: %v", path, http.StatusOK, rr.Code)
+		}
+		if _, _, err := image.Decode(bytes.NewReader(rr.Body.Bytes())); err != nil {
+			t.Fatalf("%s expected a valid image, got %s", path, err)
+		}
+		return rr.Body.Len()
+	}
+
+	if low, high := size("/image/foo?q=10"), size("/image/foo?q=90"); low >= high {
+		t.Errorf("expected q=10 (%d bytes) to be smaller than q=90 (%d bytes)", low, high)
+	}
+	// clamped to MaxQuality
+	if clamped, max := size("/image/foo?q=100"), size("/image/foo?q=95"); clamped != max {
+		t.Errorf("expected q=100 to be clamped to q=95, got %d and %d bytes", clamped, max)
+	}
+	if fast, best := size("/image/foo.png?compression=fast"), size("/image/foo.png?compression=best"); best > fast {
+		t.Errorf("expected best compression (%d bytes) to be no larger than fast (%d bytes)", best, fast)
+	}
+	if few, many := size("/image/foo.gif?colors=16"), size("/image/foo.gif?colors=256"); few >= many {
+		t.Errorf("expected 16 colors (%d bytes) to be smaller than 256 (%d bytes)", few, many)
+	}
+}
+
+func TestGet_Lossless(t *testing.T) {
+	h := NewImageHandler()
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+		fp, err := os.Open("../testimages/test.png")
+		if err != nil {
+			return progimage.Image{}, err
+		}
+		return progimage.Image{ID: ID, Data: fp, ContentType: "image/png"}, nil
+	}
+	var got primage.EncodeOptions
+	tr := h.Transformers["webp"]
+	encode := tr.Encoder
+	tr.Encoder = func(w io.Writer, m image.Image, opts primage.EncodeOptions) error {
+		got = opts
+		return encode(w, m, opts)
+	}
+	h.Transformers["webp"] = tr
+
+	for _, tt := range []struct {
+		query    string
+		lossless bool
+	}{
+		{query: "", lossless: false},
+		{query: "?lossless=1", lossless: true},
+		{query: "?lossless=0", lossless: false},
+	} {
+		t.Run(tt.query, func(t *testing.T) {
+			rr := request(t, h, "GET", "/image/foo.webp"+tt.query, "")
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected: %v got: %v", http.StatusOK, rr.Code)
+			}
+			if got.Lossless != tt.lossless {
+				t.Errorf("expected lossless %t, got %t", tt.lossless, got.Lossless)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "image/webp" {
+				t.Errorf("expected content type image/webp, got %s", ct)
+			}
+		})
+	}
+}
+
+func TestGet_EncodeOptionsInvalid(t *testing.T) {
+	for _, q := range []string{"q=0", "q=101", "q=abc", "compression=max", "colors=1", "colors=257", "lossless=yes"} {
+		t.Run(q, func(t *testing.T) {
+			h := NewImageHandler()
+
+			req, err := http.NewRequest("GET", "/image/foo.jpg?"+q, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("expected: %v got: %v", http.StatusBadRequest, status)
+			}
+			if h.ImageService.GetInvoked {
+				t.Error("expected image not to be fetched")
+			}
+		})
+	}
+}
+
+func TestGet_ResizeInvalid(t *testing.T) {
+	for _, q := range []string{"w=abc", "w=-1", "h=0", "w=10&fit=stretch", "w=100000"} {
+		t.Run(q, func(t *testing.T) {
+			h := NewImageHandler()
+
+			req, err := http.NewRequest("GET", "/image/foo.png?"+q, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("expected: %v got: %v", http.StatusBadRequest, status)
+			}
+			if h.ImageService.GetInvoked {
+				t.Error("expected image not to be fetched")
+			}
+		})
+	}
+}
+
+func TestGet_Ops(t *testing.T) {
+	h := NewImageHandler()
+
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+		fp, err := os.Open("../testimages/test.png")
+		if err != nil {
+			return progimage.Image{}, err
+		}
+		return progimage.Image{ID: ID, Data: fp, ContentType: "image/png"}, nil
+	}
+
+	req, err := http.NewRequest("GET", "/image/foo?ops=crop:x=0,y=0,w=20,h=10|rotate:deg=90&w=5", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+	}
+
+	cfg, typ, err := image.DecodeConfig(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != "png" {
+		t.Errorf("expected png, got %s", typ)
+	}
+	if cfg.Width != 5 || cfg.Height != 10 {
+		t.Errorf("expected 5x10, got %dx%d", cfg.Width, cfg.Height)
+	}
+}
+
+func TestGet_CropRotateFlip(t *testing.T) {
+	var paramTests = []struct {
+		Name   string
+		Query  string
+		Ops    string // the equivalent ops param
+		Width  int
+		Height int
+	}{
+		{Name: "crop", Query: "crop=10,20,30,40", Ops: "crop:x=10,y=20,w=30,h=40", Width: 30, Height: 40},
+		{Name: "rotate", Query: "rotate=90", Ops: "rotate:deg=90", Width: 476, Height: 1000},
+		{Name: "flip", Query: "flip=h", Ops: "flip:dir=h", Width: 1000, Height: 476},
+		// crop, rotate then flip whatever the order of the params
+		{
+			Name:  "chained",
+			Query: "flip=v&rotate=270&crop=0,0,20,10",
+			Ops:   "crop:x=0,y=0,w=20,h=10|rotate:deg=270|flip:dir=v",
+			Width: 10, Height: 20,
+		},
+		{Name: "after ops", Query: "ops=grayscale&crop=0,0,20,10", Ops: "grayscale|crop:x=0,y=0,w=20,h=10", Width: 20, Height: 10},
+		{Name: "before resize", Query: "crop=0,0,20,10&w=10", Ops: "crop:x=0,y=0,w=20,h=10&w=10", Width: 10, Height: 5},
+		{
+			Name:  "smart",
+			Query: "crop=smart&w=100&h=100",
+			Ops:   "resize:w=100,h=100,fit=cover,focus=smart",
+			Width: 100, Height: 100,
+		},
+	}
+
+	get := func(t *testing.T, query string) []byte {
+		h := NewImageHandler()
+		h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+			fp, err := os.Open("../testimages/test.png")
+			if err != nil {
+				return progimage.Image{}, err
+			}
+			return progimage.Image{ID: ID, Data: fp, ContentType: "image/png"}, nil
+		}
+
+		req, err := http.NewRequest("GET", "/image/foo.png?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		h.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("expected: %v got: %v (%s)", http.StatusOK, status, rr.Body.String())
+		}
+		return rr.Body.Bytes()
+	}
+
+	for _, item := range paramTests {
+		t.Run(item.Name, func(t *testing.T) {
+			body := get(t, item.Query)
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != item.Width || cfg.Height != item.Height {
+				t.Errorf("expected %dx%d, got %dx%d", item.Width, item.Height, cfg.Width, cfg.Height)
+			}
+			if !bytes.Equal(body, get(t, "ops="+item.Ops)) {
+				t.Errorf("expected the same image as ops=%s", item.Ops)
+			}
+		})
+	}
+}
+
+func TestGet_OpsInvalid(t *testing.T) {
+	for _, q := range []string{
+		"ops=sharpen",
+		"ops=rotate:deg=45",
+		"ops=crop:x=10000,y=0,w=1,h=1",
+		"crop=0,0,10",
+		"crop=0,0,10,10,10",
+		"crop=a,0,10,10",
+		"crop=0,0,0,10",
+		"crop=990,0,20,10",
+		"rotate=45",
+		"flip=x",
+		"crop=smart",
+		"crop=smart&w=10&h=10&fit=contain",
+		"ops=resize:w=10,h=10,fit=cover,focus=faces",
+		"ops=resize:w=10,h=10,fit=cover,fx=2,fy=0",
+		"ops=resize:w=10,h=10,fit=cover,fx=0.5",
+	} {
+		t.Run(q, func(t *testing.T) {
+			h := NewImageHandler()
+
+			h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+				fp, err := os.Open("../testimages/test.png")
+				if err != nil {
+					return progimage.Image{}, err
+				}
+				return progimage.Image{ID: ID, Data: fp, ContentType: "image/png"}, nil
+			}
+
+			req, err := http.NewRequest("GET", "/image/foo.jpg?"+q, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("expected: %v got: %v", http.StatusBadRequest, status)
+			}
+		})
+	}
+}
+
+func TestDelete_OK(t *testing.T) {
+	h := NewImageHandler()
+
+	var deletedID string
+	h.ImageService.DeleteFunc = func(ctx context.Context, ID string) error {
+		deletedID = ID
+		return nil
+	}
+
+	req, err := http.NewRequest("DELETE", "/image/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("expected: %v got: %v", http.StatusNoContent, status)
+	}
+
+	if deletedID != "foo" {
+		t.Errorf("expected id to be: foo got: %v", deletedID)
+	}
+}
+
+func TestDelete_NotFound(t *testing.T) {
+	h := NewImageHandler()
+
+	h.ImageService.DeleteFunc = func(ctx context.Context, ID string) error {
+		return progimage.ErrImageNotFound
+	}
+
+	req, err := http.NewRequest("DELETE", "/image/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("expected: %v got: %v", http.StatusNotFound, status)
+	}
+}
+
+func TestGetMeta_OK(t *testing.T) {
+	h := NewImageHandler()
+
+	created := time.Date(2018, 7, 9, 12, 0, 0, 0, time.UTC)
+	h.ImageService.StatFunc = func(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+		return progimage.ImageInfo{
+			ID:          ID,
+			ContentType: "image/png",
+			Width:       640,
+			Height:      480,
+			Size:        1234,
+			Created:     created,
+			Hash:        "abc",
+		}, nil
+	}
+
+	req, err := http.NewRequest("GET", "/image/foo/meta", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+	}
+
+	if h.ImageService.GetInvoked {
+		t.Error("expected image data not to be fetched")
+	}
+
+	info := progimage.ImageInfo{}
+	if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.ID != "foo" || info.Width != 640 || info.Height != 480 || info.Size != 1234 || info.Hash != "abc" {
+		t.Errorf("unexpected image info %+v", info)
+	}
+	if !info.Created.Equal(created) {
+		t.Errorf("expected created to be %s, got %s", created, info.Created)
+	}
+}
+
+func TestGetMeta_NotFound(t *testing.T) {
+	h := NewImageHandler()
+
+	h.ImageService.StatFunc = func(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+		return progimage.ImageInfo{}, progimage.ErrImageNotFound
+	}
+
+	req, err := http.NewRequest("GET", "/image/foo/meta", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("expected: %v got: %v", http.StatusNotFound, status)
+	}
+}
+
+// storeImage stores the image at path in is, returning its id.
+func storeImage(t *testing.T, is progimage.ImageService, path string) string {
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	ID, err := is.Store(context.Background(), fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ID
+}
+
+func TestGetMeta_EXIF(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+	h := pihttp.NewImageHandler(is)
+	ID := storeImage(t, is, "../testimages/exif.jpg")
+
+	req, err := http.NewRequest("GET", "/image/"+ID+"/meta", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+	}
+
+	meta := struct {
+		progimage.ImageInfo
+		EXIF *primage.EXIF
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(&meta); err != nil {
+		t.Fatal(err)
+	}
+	// upright
+	if meta.Width != 20 || meta.Height != 40 {
+		t.Errorf("expected 20x40, got %dx%d", meta.Width, meta.Height)
+	}
+	if meta.EXIF == nil {
+		t.Fatal("expected exif")
+	}
+	if meta.EXIF.Make != "Acme" || meta.EXIF.Orientation != 6 || meta.EXIF.Taken != "2017-01-02T03:04:05" {
+		t.Errorf("unexpected exif %+v", meta.EXIF)
+	}
+	if meta.EXIF.GPS == nil || meta.EXIF.GPS.Latitude < 51 || meta.EXIF.GPS.Longitude > 0 {
+		t.Errorf("unexpected gps %+v", meta.EXIF.GPS)
+	}
+}
+
+func TestGet_StripMetadata(t *testing.T) {
+	exif := []byte("Exif\x00\x00")
+	var stripTests = []struct {
+		Name    string
+		Path    string
+		Strip   bool
+		Width   int
+		HasEXIF bool
+	}{
+		{Name: "original", Path: "/image/%s", Width: 40, HasEXIF: true},
+		{Name: "stripped", Path: "/image/%s", Strip: true, Width: 20},
+		{Name: "transformed", Path: "/image/%s.png", Width: 20},
+		{Name: "resized", Path: "/image/%s?w=10", Width: 10},
+	}
+
+	for _, item := range stripTests {
+		t.Run(item.Name, func(t *testing.T) {
+			is := memory.NewImageService(0, uuid.New)
+			h := pihttp.NewImageHandler(is)
+			h.StripMetadata = item.Strip
+			ID := storeImage(t, is, "../testimages/exif.jpg")
+
+			req, err := http.NewRequest("GET", fmt.Sprintf(item.Path, ID), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Range", "bytes=0-99")
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusOK && !(item.HasEXIF && status == http.StatusPartialContent) {
+				t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+			}
+			if item.HasEXIF {
+				// only the range is sent
+				if !bytes.Contains(rr.Body.Bytes(), exif) {
+					t.Error("expected the original with exif")
+				}
+				return
+			}
+			if bytes.Contains(rr.Body.Bytes(), exif) {
+				t.Error("expected exif to be removed")
+			}
+			cfg, _, err := image.DecodeConfig(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != item.Width {
+				t.Errorf("expected width %d, got %d", item.Width, cfg.Width)
+			}
+		})
+	}
+}
+
+func TestGet_StripMetadataNone(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+	h := pihttp.NewImageHandler(is)
+	h.StripMetadata = true
+	// gif has no metadata to strip
+	ID := storeImage(t, is, "../testimages/test.gif")
+	data, err := ioutil.ReadFile("../testimages/test.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("GET", "/image/"+ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Range", "bytes=0-9")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusPartialContent {
+		t.Fatalf("expected: %v got: %v", http.StatusPartialContent, status)
+	}
+	if !bytes.Equal(rr.Body.Bytes(), data[:10]) {
+		t.Errorf("expected the first 10 bytes of the original, got %q", rr.Body.Bytes())
+	}
+
+	rr = request(t, h, "HEAD", "/image/"+ID, "")
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+	}
+	if cl := rr.Header().Get("Content-Length"); cl != fmt.Sprint(len(data)) {
+		t.Errorf("expected content length %d, got %s", len(data), cl)
+	}
+	if ar := rr.Header().Get("Accept-Ranges"); ar != "bytes" {
+		t.Errorf("expected ranges to be accepted, got %q", ar)
+	}
+}
+
+// TestGet_StripMetadataReads checks an image is read once at most to serve it with StripMetadata set, whether it has
+// metadata is known from Stat.
+func TestGet_StripMetadataReads(t *testing.T) {
+	var readTests = []struct {
+		Path string
+		Gets map[string]int // by method
+	}{
+		// HEAD needs the stripped image to know its size
+		{Path: "../testimages/exif.jpg", Gets: map[string]int{"GET": 1, "HEAD": 1}},
+		{Path: "../testimages/test.gif", Gets: map[string]int{"GET": 1, "HEAD": 0}},
+	}
+
+	for _, item := range readTests {
+		t.Run(item.Path, func(t *testing.T) {
+			is := memory.NewImageService(0, uuid.New)
+			ID := storeImage(t, is, item.Path)
+
+			h := NewImageHandler()
+			h.StripMetadata = true
+			gets := 0
+			h.ImageService.StatFunc = is.Stat
+			h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+				gets++
+				return is.Get(ctx, ID)
+			}
+
+			for method, expected := range item.Gets {
+				gets = 0
+				if rr := request(t, h, method, "/image/"+ID, ""); rr.Code != http.StatusOK {
+					t.Fatalf("%s expected: %v got: %v", method, http.StatusOK, rr.Code)
+				}
+				if gets != expected {
+					t.Errorf("%s expected the image to be read %d times, got %d", method, expected, gets)
+				}
+			}
+		})
+	}
+}
+
+// request makes a request with an optional body to h and returns the response.
+func request(t *testing.T, h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestSetFocus(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+	h := pihttp.NewImageHandler(is)
+	ID := storeImage(t, is, "../testimages/test.png")
+
+	var focusTests = []struct {
+		Name   string
+		Method string
+		ID     string
+		Body   string
+		Status int
+		Focus  *progimage.Focus
+	}{
+		{Name: "set", Method: "PUT", ID: ID, Body: `{"x": 0.25, "y": 1}`, Status: http.StatusNoContent,
+			Focus: &progimage.Focus{X: 0.25, Y: 1}},
+		{Name: "invalid json", Method: "PUT", ID: ID, Body: `{"x": 0.5`, Status: http.StatusBadRequest,
+			Focus: &progimage.Focus{X: 0.25, Y: 1}},
+		{Name: "missing y", Method: "PUT", ID: ID, Body: `{"x": 0.5}`, Status: http.StatusBadRequest,
+			Focus: &progimage.Focus{X: 0.25, Y: 1}},
+		{Name: "outside", Method: "PUT", ID: ID, Body: `{"x": 1.5, "y": 0}`, Status: http.StatusBadRequest,
+			Focus: &progimage.Focus{X: 0.25, Y: 1}},
+		{Name: "negative", Method: "PUT", ID: ID, Body: `{"x": 0, "y": -0.1}`, Status: http.StatusBadRequest,
+			Focus: &progimage.Focus{X: 0.25, Y: 1}},
+		{Name: "not found", Method: "PUT", ID: "foo", Body: `{"x": 0, "y": 0}`, Status: http.StatusNotFound,
+			Focus: &progimage.Focus{X: 0.25, Y: 1}},
+		{Name: "delete", Method: "DELETE", ID: ID, Status: http.StatusNoContent},
+		{Name: "delete not found", Method: "DELETE", ID: "foo", Status: http.StatusNotFound},
+	}
+
+	for _, item := range focusTests {
+		t.Run(item.Name, func(t *testing.T) {
+			rr := request(t, h, item.Method, "/image/"+item.ID+"/focus", item.Body)
+			if status := rr.Code; status != item.Status {
+				t.Fatalf("expected: %v got: %v (%s)", item.Status, status, rr.Body.String())
+			}
+
+			info, err := is.Stat(context.Background(), ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (info.Focus == nil) != (item.Focus == nil) || info.Focus != nil && *info.Focus != *item.Focus {
+				t.Errorf("expected focus %v, got %v", item.Focus, info.Focus)
+			}
+		})
+	}
+}
+
+func TestSetFocus_NotImplemented(t *testing.T) {
+	h := NewImageHandler()
+
+	rr := request(t, h, "PUT", "/image/foo/focus", `{"x": 0.5, "y": 0.5}`)
+	if status := rr.Code; status != http.StatusNotImplemented {
+		t.Fatalf("expected: %v got: %v", http.StatusNotImplemented, status)
+	}
+	if !strings.Contains(rr.Body.String(), pihttp.CodeNotImplemented) {
+		t.Errorf("expected %s error, got %s", pihttp.CodeNotImplemented, rr.Body.String())
+	}
+}
+
+// TestGet_Focus checks cover resizes are cropped around the stored focal point, other transformations aren't changed.
+func TestGet_Focus(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+	h := pihttp.NewImageHandler(is)
+	ID := storeImage(t, is, "../testimages/test.png")
+
+	get := func(t *testing.T, query string) *httptest.ResponseRecorder {
+		rr := request(t, h, "GET", "/image/"+ID+"?"+query, "")
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("expected: %v got: %v (%s)", http.StatusOK, status, rr.Body.String())
+		}
+		return rr
+	}
+	var queries = []string{
+		"w=100&h=100&fit=cover",
+		"crop=smart&w=100&h=100",
+		"w=100&h=100",
+		"crop=0,0,500,476&w=100&h=100&fit=cover",
+	}
+	before := map[string]*httptest.ResponseRecorder{}
+	for _, q := range queries {
+		before[q] = get(t, q)
+	}
+	original := get(t, "")
+
+	if rr := request(t, h, "PUT", "/image/"+ID+"/focus", `{"x": 1, "y": 0.5}`); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v got: %v", http.StatusNoContent, rr.Code)
+	}
+	if rr := get(t, ""); rr.Header().Get("X-Image-Focus") != "1,0.5" {
+		t.Errorf("expected focus header 1,0.5, got %q", rr.Header().Get("X-Image-Focus"))
+	}
+
+	// the image data is the same, revalidating the original updates the focus header
+	req, err := http.NewRequest("GET", "/image/"+ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("If-None-Match", original.Header().Get("ETag"))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified || rr.Header().Get("X-Image-Focus") != "1,0.5" {
+		t.Errorf("expected a 304 with focus header 1,0.5, got %v %q", rr.Code, rr.Header().Get("X-Image-Focus"))
+	}
+
+	var focusTests = []struct {
+		Query   string
+		Changed bool
+		Ops     string // the equivalent ops param if changed
+	}{
+		{Query: queries[0], Changed: true, Ops: "resize:w=100,h=100,fit=cover,fx=1,fy=0.5"},
+		// the stored focus takes precedence
+		{Query: queries[1], Changed: true, Ops: "resize:w=100,h=100,fit=cover,fx=1,fy=0.5"},
+		// no crop
+		{Query: queries[2]},
+		// the crop moves the focal point
+		{Query: queries[3]},
+	}
+	for _, item := range focusTests {
+		t.Run(item.Query, func(t *testing.T) {
+			rr := get(t, item.Query)
+			body, etag := rr.Body.Bytes(), rr.Header().Get("ETag")
+			changed := !bytes.Equal(body, before[item.Query].Body.Bytes())
+			if changed != item.Changed {
+				t.Fatalf("expected changed %v, got %v", item.Changed, changed)
+			}
+			// every transformation is revalidated when the focal point changes, the image data (and its ETag) doesn't
+			if etag == before[item.Query].Header().Get("ETag") {
+				t.Errorf("expected the etag to change with the focal point")
+			}
+			req, err := http.NewRequest("GET", "/image/"+ID+"?"+item.Query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("If-None-Match", before[item.Query].Header().Get("ETag"))
+			rv := httptest.NewRecorder()
+			h.ServeHTTP(rv, req)
+			if rv.Code != http.StatusOK {
+				t.Errorf("expected revalidating with the old etag to be %v, got %v", http.StatusOK, rv.Code)
+			}
+			if item.Changed && !bytes.Equal(body, get(t, "ops="+item.Ops).Body.Bytes()) {
+				t.Errorf("expected the same image as ops=%s", item.Ops)
+			}
+		})
+	}
+
+	if rr := request(t, h, "DELETE", "/image/"+ID+"/focus", ""); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected: %v got: %v", http.StatusNoContent, rr.Code)
+	}
+	if !bytes.Equal(get(t, queries[0]).Body.Bytes(), before[queries[0]].Body.Bytes()) {
+		t.Error("expected the centred crop once the focus is removed")
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	var errorTests = []struct {
+		Name      string
+		Path      string
+		Err       error
+		RequestID string
+		Status    int
+		Code      string
+		Message   string
+	}{
+		{
+			Name:      "not found",
+			Path:      "/image/foo",
+			Err:       progimage.ErrImageNotFound,
+			RequestID: "abc-123",
+			Status:    http.StatusNotFound,
+			Code:      pihttp.CodeImageNotFound,
+			Message:   "image not found",
+		},
+		{
+			Name:    "internal",
+			Path:    "/image/foo",
+			Err:     errors.New("s3: access denied for bucket secret-bucket"),
+			Status:  http.StatusInternalServerError,
+			Code:    pihttp.CodeInternal,
+			Message: "internal server error",
+		},
+		{
+			Name:    "storage unavailable",
+			Path:    "/image/foo",
+			Err:     errors.Wrap(&progimage.Error{Kind: progimage.ErrStorageUnavailable, Err: errors.New("dial tcp")}, "get"),
+			Status:  http.StatusServiceUnavailable,
+			Code:    pihttp.CodeStorageUnavailable,
+			Message: "storage unavailable",
+		},
+		{
+			Name:    "unrecognised",
+			Path:    "/image/foo.png",
+			Err:     nil,
+			Status:  http.StatusBadRequest,
+			Code:    pihttp.CodeUnrecognisedImageType,
+			Message: "unrecognised image data, image: unknown format",
+		},
+		{
+			Name:   "unsupported format",
+			Path:   "/image/foo.bmp",
+			Status: http.StatusUnsupportedMediaType,
+			Code:   pihttp.CodeUnsupportedFormat,
+		},
+		{
+			Name:      "invalid request id",
+			Path:      "/image/foo?w=x",
+			RequestID: "<script>",
+			Status:    http.StatusBadRequest,
+			Code:      pihttp.CodeInvalidTransform,
+		},
+	}
+
+	for _, item := range errorTests {
+		t.Run(item.Name, func(t *testing.T) {
+			h := NewImageHandler()
+			h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+				if item.Err == nil {
+					return progimage.Image{ID: ID, Data: strings.NewReader("not an image"), ContentType: "image/gif"}, nil
+				}
+				return progimage.Image{}, item.Err
+			}
+
+			req, err := http.NewRequest("GET", item.Path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if item.RequestID != "" {
+				req.Header.Set(pihttp.RequestIDHeader, item.RequestID)
+			}
+
+			rr := httptest.NewRecorder()
+
+			h.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != item.Status {
+				t.Errorf("expected: %v got: %v", item.Status, status)
+			}
+			if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected content type application/json, got %s", ct)
+			}
+
+			resp := struct {
+				Error pihttp.Error `json:"error"`
+			}{}
+			if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error.Code != item.Code {
+				t.Errorf("expected code %s, got %s", item.Code, resp.Error.Code)
+			}
+			if item.Message != "" && resp.Error.Message != item.Message {
+				t.Errorf("expected message %q, got %q", item.Message, resp.Error.Message)
+			}
+
+			ID := rr.Header().Get(pihttp.RequestIDHeader)
+			if ID == "" || resp.Error.RequestID != ID {
+				t.Errorf("expected request id %q in body, got %q", ID, resp.Error.RequestID)
+			}
+			if item.RequestID == "abc-123" && ID != item.RequestID {
+				t.Errorf("expected client request id to be used, got %q", ID)
+			}
+			if item.RequestID == "<script>" && ID == item.RequestID {
+				t.Error("expected invalid client request id to be replaced")
+			}
+		})
+	}
+}
+
+func TestHead_OK(t *testing.T) {
+	h := NewImageHandler()
+
+	h.ImageService.StatFunc = func(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+		return progimage.ImageInfo{ID: ID, ContentType: "image/gif", Width: 10, Height: 20, Size: 1234}, nil
+	}
+
+	req, err := http.NewRequest("HEAD", "/image/foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+
+	h.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected: %v got: %v", http.StatusOK, status)
+	}
+
+	for k, v := range map[string]string{
+		"Content-Type":   "image/gif",
+		"Content-Length": "1234",
+		"X-Image-Width":  "10",
+		"X-Image-Height": "20",
+	} {
+		if rr.Header().Get(k) != v {
+			t.Errorf("expected %s header to be %s, got %s", k, v, rr.Header().Get(k))
+		}
+	}
+}
+
+// TestImageHandler_Memory exercises the handler with a real (in memory) image service.
+func TestImageHandler_Memory(t *testing.T) {
+	h := pihttp.NewImageHandler(memory.NewImageService(0, uuid.New))
+
+	fp, err := os.Open("../testimages/test.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	req, err := http.NewRequest("POST", "/image/create", fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("expected: %v got: %v", http.StatusCreated, status)
+	}
+
+	rd := struct{ ID string }{}
+	if err := json.NewDecoder(rr.Body).Decode(&rd); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests = []struct {
+		Method      string
+		Path        string
+		Status      int
+		ContentType string
+	}{
+		{Method: "GET", Path: "/image/" + rd.ID, Status: http.StatusOK, ContentType: "image/gif"},
+		{Method: "GET", Path: "/image/" + rd.ID + ".png?w=10", Status: http.StatusOK, ContentType: "image/png"},
+		{Method: "GET", Path: "/image/" + rd.ID + "/meta", Status: http.StatusOK, ContentType: "application/json"},
+		{Method: "DELETE", Path: "/image/" + rd.ID, Status: http.StatusNoContent},
+		{Method: "GET", Path: "/image/" + rd.ID, Status: http.StatusNotFound},
+	}
+	for _, item := range requests {
+		req, err := http.NewRequest(item.Method, item.Path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != item.Status {
+			t.Errorf("%s %s expected: %v got: %v", item.Method, item.Path, item.Status, rr.Code)
+		}
+		if item.ContentType != "" && rr.Header().Get("Content-Type") != item.ContentType {
+			t.Errorf("%s %s expected Content-Type %s, got: %v",
+				item.Method, item.Path, item.ContentType, rr.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestGet_Derivatives(t *testing.T) {
+	h := pihttp.NewImageHandler(memory.NewImageService(0, uuid.New))
+	dc := memory.NewDerivativeCache(0, nil)
+	h.Derivatives = dc
+
+	fp, err := os.Open("../testimages/test.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	req, err := http.NewRequest("POST", "/image/create", fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("expected: %v got: %v", http.StatusCreated, status)
+	}
+	rd := struct{ ID string }{}
+	if err := json.NewDecoder(rr.Body).Decode(&rd); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(path, contentType string) []byte {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("GET %s expected: %v got: %v", path, http.StatusOK, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != contentType {
+			t.Errorf("GET %s expected Content-Type %s, got: %v", path, contentType, ct)
+		}
+		return rr.Body.Bytes()
+	}
+
+	// untransformed, nothing to cache
+	get("/image/"+rd.ID+".gif", "image/gif")
+	if dc.Size() != 0 {
+		t.Errorf("expected original not to be cached, cache size %d", dc.Size())
+	}
+
+	first := get("/image/"+rd.ID+".png?w=10", "image/png")
+	if dc.Size() != int64(len(first)) {
+		t.Errorf("expected derivative to be cached, cache size %d", dc.Size())
+	}
+	if second := get("/image/"+rd.ID+".png?w=10", "image/png"); !bytes.Equal(first, second) {
+		t.Error("expected cached derivative to be equal to rendered derivative")
+	}
+
+	req, err = http.NewRequest("DELETE", "/image/"+rd.ID, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if dc.Size() != 0 {
+		t.Errorf("expected derivatives to be deleted with the image, cache size %d", dc.Size())
+	}
+}
+
+func TestGet_Range(t *testing.T) {
+	d, err := ioutil.ReadFile("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(d)
+
+	is := memory.NewImageService(0, uuid.New)
+	id, err := is.Store(context.Background(), bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := is.Stat(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the mock doesn't implement progimage.RangeGetter
+	mh := NewImageHandler()
+	mh.ImageService.StatFunc = is.Stat
+	mh.ImageService.GetFunc = is.Get
+
+	var rangeTests = []struct {
+		Name         string
+		Headers      map[string]string
+		Status       int
+		ContentRange string
+		Body         []byte
+	}{
+		{Name: "no range", Status: http.StatusOK, Body: d},
+		{Name: "start", Headers: map[string]string{"Range": "bytes=0-9"}, Status: http.StatusPartialContent,
+			ContentRange: fmt.Sprintf("bytes 0-9/%d", size), Body: d[:10]},
+		{Name: "open ended", Headers: map[string]string{"Range": "bytes=10-"}, Status: http.StatusPartialContent,
+			ContentRange: fmt.Sprintf("bytes 10-%d/%d", size-1, size), Body: d[10:]},
+		{Name: "suffix", Headers: map[string]string{"Range": "bytes=-5"}, Status: http.StatusPartialContent,
+			ContentRange: fmt.Sprintf("bytes %d-%d/%d", size-5, size-1, size), Body: d[size-5:]},
+		{Name: "end past size", Headers: map[string]string{"Range": fmt.Sprintf("bytes=5-%d", size+100)},
+			Status: http.StatusPartialContent, ContentRange: fmt.Sprintf("bytes 5-%d/%d", size-1, size), Body: d[5:]},
+		{Name: "unsatisfiable", Headers: map[string]string{"Range": fmt.Sprintf("bytes=%d-", size)},
+			Status: http.StatusRequestedRangeNotSatisfiable, ContentRange: fmt.Sprintf("bytes */%d", size)},
+		{Name: "multiple", Headers: map[string]string{"Range": "bytes=0-1,5-6"}, Status: http.StatusOK, Body: d},
+		{Name: "invalid", Headers: map[string]string{"Range": "pixels=0-1"}, Status: http.StatusOK, Body: d},
+		{Name: "if-range etag", Headers: map[string]string{"Range": "bytes=0-9", "If-Range": `"` + info.Hash + `"`},
+			Status: http.StatusPartialContent, ContentRange: fmt.Sprintf("bytes 0-9/%d", size), Body: d[:10]},
+		{Name: "if-range date", Headers: map[string]string{"Range": "bytes=0-9", "If-Range": info.Created.Format(http.TimeFormat)},
+			Status: http.StatusPartialContent, ContentRange: fmt.Sprintf("bytes 0-9/%d", size), Body: d[:10]},
+		{Name: "if-range changed", Headers: map[string]string{"Range": "bytes=0-9", "If-Range": `"abc"`}, Status: http.StatusOK, Body: d},
+		{Name: "if-range weak", Headers: map[string]string{"Range": "bytes=0-9", "If-Range": `W/"` + info.Hash + `"`}, Status: http.StatusOK, Body: d},
+	}
+
+	handlers := map[string]http.Handler{
+		"RangeGetter": pihttp.NewImageHandler(is),
+		"Get":         mh,
+	}
+	for name, h := range handlers {
+		t.Run(name, func(t *testing.T) {
+			for _, item := range rangeTests {
+				t.Run(item.Name, func(t *testing.T) {
+					req, err := http.NewRequest("GET", "/image/"+id, nil)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for k, v := range item.Headers {
+						req.Header.Set(k, v)
+					}
+					rr := httptest.NewRecorder()
+					h.ServeHTTP(rr, req)
+
+					if rr.Code != item.Status {
+						t.Fatalf("expected: %v got: %v", item.Status, rr.Code)
+					}
+					if cr := rr.Header().Get("Content-Range"); cr != item.ContentRange {
+						t.Errorf("expected Content-Range %q, got: %q", item.ContentRange, cr)
+					}
+					if ar := rr.Header().Get("Accept-Ranges"); item.Status != http.StatusRequestedRangeNotSatisfiable && ar != "bytes" {
+						t.Errorf("expected Accept-Ranges bytes, got: %q", ar)
+					}
+					if item.Body != nil && !bytes.Equal(item.Body, rr.Body.Bytes()) {
+						t.Errorf("expected %d bytes of image, got %d bytes not equal", len(item.Body), rr.Body.Len())
+					}
+				})
+			}
+		})
+	}
+}
+
+// TestGet_ETagFromStat checks every way of writing an original uses the hash from Stat as its ETag, even if the
+// image service gives Get a different one (eg s3's own ETag).
+func TestGet_ETagFromStat(t *testing.T) {
+	d, err := ioutil.ReadFile("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2018, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	h := NewImageHandler()
+	h.ImageService.StatFunc = func(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+		return progimage.ImageInfo{
+			ID: ID, ContentType: "image/png", Size: int64(len(d)), Created: created, Hash: "stat-hash",
+		}, nil
+	}
+	h.ImageService.GetFunc = func(ctx context.Context, ID string) (progimage.Image, error) {
+		return progimage.Image{
+			ID: ID, Data: bytes.NewReader(d), ContentType: "image/png", ETag: "get-etag", LastModified: time.Now(),
+		}, nil
+	}
+
+	var etagTests = []struct {
+		Name    string
+		Method  string
+		Headers map[string]string
+		Status  int
+	}{
+		{Name: "get", Method: "GET", Status: http.StatusOK},
+		{Name: "head", Method: "HEAD", Status: http.StatusOK},
+		{Name: "range", Method: "GET", Headers: map[string]string{"Range": "bytes=0-9"}, Status: http.StatusPartialContent},
+		{Name: "not modified", Method: "GET", Headers: map[string]string{"If-None-Match": `"stat-hash"`},
+			Status: http.StatusNotModified},
+	}
+
+	for _, item := range etagTests {
+		t.Run(item.Name, func(t *testing.T) {
+			req, err := http.NewRequest(item.Method, "/image/foo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range item.Headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != item.Status {
+				t.Fatalf("expected: %v got: %v", item.Status, rr.Code)
+			}
+			if etag := rr.Header().Get("ETag"); etag != `"stat-hash"` {
+				t.Errorf(`expected ETag "stat-hash", got %s`, etag)
+			}
+			if lm := rr.Header().Get("Last-Modified"); lm != created.Format(http.TimeFormat) {
+				t.Errorf("expected Last-Modified %s, got %s", created.Format(http.TimeFormat), lm)
+			}
+		})
+	}
+}
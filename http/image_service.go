@@ -1,9 +1,13 @@
 package http
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"strings"
 
 	"github.com/j0hnsmith/progimage"
 	"github.com/pkg/errors"
@@ -14,7 +18,9 @@ type GetterDoer interface {
 	Do(r *http.Request) (*http.Response, error)
 }
 
-// ImageService is a progimage.ImageService that makes requests to a http server.
+// ImageService is a progimage.ImageService that makes requests to a http server, requests are cancelled when the
+// context is done. Error responses are returned as an *Error, use progimage.KindOf to get the progimage.Err* value for
+// its code.
 type ImageService struct {
 	BaseURL string
 	Client  GetterDoer
@@ -23,13 +29,21 @@ type ImageService struct {
 var _ progimage.ImageService = ImageService{}
 
 // Get the image for the given ID.
-func (is ImageService) Get(ID string) (progimage.Image, error) {
-	resp, err := is.Client.Get(is.BaseURL + "/image/" + ID)
+func (is ImageService) Get(ctx context.Context, ID string) (progimage.Image, error) {
 	ret := progimage.Image{}
+	req, err := http.NewRequestWithContext(ctx, "GET", is.BaseURL+"/image/"+ID, nil)
 	if err != nil {
-		return ret, errors.Wrap(err, "unable to make get request")
+		return ret, errors.Wrap(err, "unable to create new http request")
+	}
+	resp, err := is.Client.Do(req)
+	if err != nil {
+		return ret, progimage.StorageUnavailable(ctx, errors.Wrap(err, "unable to make get request"))
 	}
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close() // nolint: errcheck
+		if err := decodeError(resp); err != nil {
+			return ret, err
+		}
 		if resp.StatusCode == http.StatusNotFound {
 			return ret, progimage.ErrImageNotFound
 		}
@@ -37,22 +51,100 @@ func (is ImageService) Get(ID string) (progimage.Image, error) {
 	}
 
 	ret.ID = ID
-	ret.ContentType = resp.Header.Get("ContentType")
+	ret.ContentType = resp.Header.Get("Content-Type")
+	ret.Data = resp.Body
+	ret.ETag = strings.Trim(resp.Header.Get("ETag"), `"`)
+	ret.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified")) // nolint: gas
+	ret.Focus = parseFocusHeader(resp.Header.Get(focusHeader))
+	return ret, nil
+}
+
+var _ progimage.RangeGetter = ImageService{}
+
+// GetRange gets part of the image for the given ID using a Range request.
+func (is ImageService) GetRange(ctx context.Context, ID string, offset, length int64) (progimage.Image, error) {
+	ret := progimage.Image{}
+	req, err := http.NewRequestWithContext(ctx, "GET", is.BaseURL+"/image/"+ID, nil)
+	if err != nil {
+		return ret, errors.Wrap(err, "unable to create new http request")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := is.Client.Do(req)
+	if err != nil {
+		return ret, progimage.StorageUnavailable(ctx, errors.Wrap(err, "unable to make get request"))
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		defer resp.Body.Close() // nolint: errcheck
+		if err := decodeError(resp); err != nil {
+			return ret, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return ret, progimage.ErrImageNotFound
+		}
+		return ret, errors.Errorf("unknown error getting image range, status code %d", resp.StatusCode)
+	}
+
+	ret.ID = ID
+	ret.ContentType = resp.Header.Get("Content-Type")
 	ret.Data = resp.Body
+	ret.ETag = strings.Trim(resp.Header.Get("ETag"), `"`)
+	ret.LastModified, _ = http.ParseTime(resp.Header.Get("Last-Modified")) // nolint: gas
+	ret.Focus = parseFocusHeader(resp.Header.Get(focusHeader))
+	return ret, nil
+}
+
+// Stat returns information about the image for the given ID.
+func (is ImageService) Stat(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+	ret := progimage.ImageInfo{}
+	req, err := http.NewRequestWithContext(ctx, "GET", is.BaseURL+"/image/"+ID+"/meta", nil)
+	if err != nil {
+		return ret, errors.Wrap(err, "unable to create new http request")
+	}
+	resp, err := is.Client.Do(req)
+	if err != nil {
+		return ret, progimage.StorageUnavailable(ctx, errors.Wrap(err, "unable to make get request"))
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusOK {
+		if err := decodeError(resp); err != nil {
+			return ret, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return ret, progimage.ErrImageNotFound
+		}
+		return ret, errors.Errorf("unknown error getting image info, status code %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return ret, errors.Wrap(err, "error decoding resp")
+	}
 	return ret, nil
 }
 
 // Store an image.
-func (is ImageService) Store(imgRdr io.Reader) (string, error) {
-	req, err := http.NewRequest("POST", is.BaseURL+"/image/create", imgRdr)
+func (is ImageService) Store(ctx context.Context, imgRdr io.Reader) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", is.BaseURL+"/image/create", imgRdr)
 	if err != nil {
 		return "", errors.Wrap(err, "unable to create new http request")
 	}
 	resp, err := is.Client.Do(req)
 	if err != nil {
-		return "", errors.Wrap(err, "unable to make post request")
+		return "", progimage.StorageUnavailable(ctx, errors.Wrap(err, "unable to make post request"))
 	}
+	defer resp.Body.Close() // nolint: errcheck
+
 	if resp.StatusCode != http.StatusCreated {
+		if err := decodeError(resp); err != nil {
+			return "", err
+		}
+		if resp.StatusCode == http.StatusBadRequest {
+			return "", progimage.ErrUnrecognisedImageType
+		}
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			return "", progimage.ErrImageTooLarge
+		}
 		return "", errors.Errorf("unknown error creating new image, status code %d", resp.StatusCode)
 	}
 
@@ -64,6 +156,64 @@ func (is ImageService) Store(imgRdr io.Reader) (string, error) {
 	return rd.ID, nil
 }
 
+var _ progimage.FocusSetter = ImageService{}
+
+// SetFocus stores the focal point of the image for the given ID, nil removes it.
+func (is ImageService) SetFocus(ctx context.Context, ID string, focus *progimage.Focus) error {
+	method, body := "DELETE", io.Reader(nil)
+	if focus != nil {
+		b, err := json.Marshal(focus)
+		if err != nil {
+			return errors.Wrap(err, "error encoding focus")
+		}
+		method, body = "PUT", bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, is.BaseURL+"/image/"+ID+"/focus", body)
+	if err != nil {
+		return errors.Wrap(err, "unable to create new http request")
+	}
+	resp, err := is.Client.Do(req)
+	if err != nil {
+		return progimage.StorageUnavailable(ctx, errors.Wrap(err, "unable to make focus request"))
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusNoContent {
+		if err := decodeError(resp); err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return progimage.ErrImageNotFound
+		}
+		return errors.Errorf("unknown error setting image focus, status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Delete an image.
+func (is ImageService) Delete(ctx context.Context, ID string) error {
+	req, err := http.NewRequestWithContext(ctx, "DELETE", is.BaseURL+"/image/"+ID, nil)
+	if err != nil {
+		return errors.Wrap(err, "unable to create new http request")
+	}
+	resp, err := is.Client.Do(req)
+	if err != nil {
+		return progimage.StorageUnavailable(ctx, errors.Wrap(err, "unable to make delete request"))
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode != http.StatusNoContent {
+		if err := decodeError(resp); err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return progimage.ErrImageNotFound
+		}
+		return errors.Errorf("unknown error deleting image, status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
 type respData struct {
 	ID string
 }
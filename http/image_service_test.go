@@ -2,17 +2,23 @@ package http_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/j0hnsmith/progimage"
 	pihttp "github.com/j0hnsmith/progimage/http"
+	"github.com/j0hnsmith/progimage/memory"
+	"github.com/j0hnsmith/progimage/servicetest"
+	"github.com/pkg/errors"
 )
 
 var (
@@ -58,18 +64,34 @@ func TestImageService_Get(t *testing.T) {
 			conn.Close()
 		})
 
-		_, err := is.Get("someid")
+		_, err := is.Get(context.Background(), "someid")
 		if err == nil {
 			t.Errorf("expected error, didn't get one")
 		}
 	})
 
+	t.Run("cancelled", func(t *testing.T) {
+		teardown := setup()
+		defer teardown()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		mux.HandleFunc("/image/someid", func(w http.ResponseWriter, r *http.Request) {
+			cancel()
+			<-r.Context().Done()
+		})
+
+		_, err := is.Get(ctx, "someid")
+		if uerr, ok := errors.Cause(err).(*url.Error); !ok || uerr.Err != context.Canceled {
+			t.Errorf("expected context.Canceled, got: %v", err)
+		}
+	})
+
 	t.Run("404", func(t *testing.T) {
 		teardown := setup()
 		defer teardown()
 
-		_, err := is.Get("id-does-not-exist")
-		if err != progimage.ErrImageNotFound {
+		_, err := is.Get(context.Background(), "id-does-not-exist")
+		if progimage.KindOf(err) != progimage.ErrImageNotFound {
 			t.Errorf("expected ErrImageNotFound, got: %s", err)
 		}
 	})
@@ -87,10 +109,12 @@ func TestImageService_Get(t *testing.T) {
 			defer rdr.Close()
 
 			w.Header().Set("Content-Type", "image/png")
+			w.Header().Set("ETag", `"abc123"`)
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
 			io.Copy(w, rdr)
 		})
 
-		img, err := is.Get("someid")
+		img, err := is.Get(context.Background(), "someid")
 		if err != nil {
 			t.Errorf("didn't expect error, got %s", err.Error())
 		}
@@ -98,9 +122,15 @@ func TestImageService_Get(t *testing.T) {
 		if img.ID != "someid" {
 			t.Errorf("expected ID to be 'someid', got: %s", img.ID)
 		}
-		if img.ContentType == "image/png" {
+		if img.ContentType != "image/png" {
 			t.Errorf("expected content type to be image/png, got: %s", img.ContentType)
 		}
+		if img.ETag != "abc123" {
+			t.Errorf("expected etag to be abc123, got: %s", img.ETag)
+		}
+		if !img.LastModified.Equal(time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)) {
+			t.Errorf("expected last modified to be 2006-01-02 15:04:05, got: %s", img.LastModified)
+		}
 
 		// compare the image data
 		data, err := ioutil.ReadAll(img.Data)
@@ -125,13 +155,45 @@ func TestImageService_Get(t *testing.T) {
 	})
 }
 
+func TestImageService_Stat(t *testing.T) {
+
+	t.Run("success", func(t *testing.T) {
+		teardown := setup()
+		defer teardown()
+
+		mux.HandleFunc("/image/someid/meta", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": "someid", "content_type": "image/png", "width": 10, "height": 20, "size": 30}`))
+		})
+
+		info, err := is.Stat(context.Background(), "someid")
+		if err != nil {
+			t.Fatalf("didn't expect error, got %s", err.Error())
+		}
+
+		expected := progimage.ImageInfo{ID: "someid", ContentType: "image/png", Width: 10, Height: 20, Size: 30}
+		if info != expected {
+			t.Errorf("expected info to be %+v, got: %+v", expected, info)
+		}
+	})
+
+	t.Run("404", func(t *testing.T) {
+		teardown := setup()
+		defer teardown()
+
+		if _, err := is.Stat(context.Background(), "id-does-not-exist"); progimage.KindOf(err) != progimage.ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %s", err)
+		}
+	})
+}
+
 func TestImageService_Store(t *testing.T) {
 
 	t.Run("success", func(t *testing.T) {
 		teardown := setup()
 		defer teardown()
 
-		var recdB64, recdContentType string
+		var recdB64 string
 
 		mux.HandleFunc("/image/create", func(w http.ResponseWriter, r *http.Request) {
 			uploadedData, err := ioutil.ReadAll(r.Body)
@@ -139,7 +201,6 @@ func TestImageService_Store(t *testing.T) {
 				t.Fatal(err)
 			}
 			recdB64 = base64.StdEncoding.EncodeToString(uploadedData)
-			recdContentType = r.Header.Get("Content-Type")
 			w.WriteHeader(http.StatusCreated)
 			w.Write([]byte(`{"id": "someid"}`))
 		})
@@ -155,7 +216,7 @@ func TestImageService_Store(t *testing.T) {
 		tr := io.TeeReader(rdr, &buf)
 
 		// do the thing
-		id, err := is.Store(tr)
+		id, err := is.Store(context.Background(), tr)
 		if err != nil {
 			t.Errorf("didn't expect error, got %s", err.Error())
 		}
@@ -197,7 +258,7 @@ func TestImageService_Store(t *testing.T) {
 		defer rdr.Close()
 
 		// do the thing
-		if _, err := is.Store(rdr); err == nil {
+		if _, err := is.Store(context.Background(), rdr); err == nil {
 			t.Errorf("expected error but didn't get one")
 		}
 	})
@@ -218,8 +279,113 @@ func TestImageService_Store(t *testing.T) {
 		defer rdr.Close()
 
 		// do the thing
-		if _, err := is.Store(rdr); err == nil {
+		if _, err := is.Store(context.Background(), rdr); err == nil {
 			t.Errorf("expected error but didn't get one")
 		}
 	})
 }
+
+func TestImageService_Delete(t *testing.T) {
+
+	t.Run("success", func(t *testing.T) {
+		teardown := setup()
+		defer teardown()
+
+		var method string
+		mux.HandleFunc("/image/someid", func(w http.ResponseWriter, r *http.Request) {
+			method = r.Method
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		if err := is.Delete(context.Background(), "someid"); err != nil {
+			t.Errorf("didn't expect error, got %s", err.Error())
+		}
+		if method != "DELETE" {
+			t.Errorf("expected DELETE request, got %s", method)
+		}
+	})
+
+	t.Run("404", func(t *testing.T) {
+		teardown := setup()
+		defer teardown()
+
+		if err := is.Delete(context.Background(), "id-does-not-exist"); progimage.KindOf(err) != progimage.ErrImageNotFound {
+			t.Errorf("expected ErrImageNotFound, got: %s", err)
+		}
+	})
+
+	t.Run("wrong status", func(t *testing.T) {
+		teardown := setup()
+		defer teardown()
+
+		mux.HandleFunc("/image/someid", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+
+		if err := is.Delete(context.Background(), "someid"); err == nil {
+			t.Errorf("expected error but didn't get one")
+		}
+	})
+}
+
+func TestImageService_ErrorResponse(t *testing.T) {
+	teardown := setup()
+	defer teardown()
+
+	mux.HandleFunc("/image/notfound", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error": {"code": "image_not_found", "message": "image not found, notfound", "request_id": "abc"}}`))
+	})
+	mux.HandleFunc("/image/unavailable", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error": {"code": "internal_error", "message": "internal server error", "request_id": "abc"}}`))
+	})
+
+	mux.HandleFunc("/image/down", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error": {"code": "storage_unavailable", "message": "storage unavailable"}}`))
+	})
+
+	_, err := is.Get(context.Background(), "notfound")
+	if progimage.KindOf(err) != progimage.ErrImageNotFound {
+		t.Errorf("expected ErrImageNotFound, got: %v", err)
+	}
+	if perr, ok := err.(*pihttp.Error); !ok || perr.Message != "image not found, notfound" || perr.RequestID != "abc" {
+		t.Errorf("expected the message and request id to be kept, got: %v", err)
+	}
+	if _, err := is.Get(context.Background(), "down"); progimage.KindOf(err) != progimage.ErrStorageUnavailable {
+		t.Errorf("expected ErrStorageUnavailable, got: %v", err)
+	}
+
+	_, err = is.Get(context.Background(), "unavailable")
+	perr, ok := err.(*pihttp.Error)
+	if !ok {
+		t.Fatalf("expected *Error, got: %v", err)
+	}
+	expected := pihttp.Error{
+		Status:    http.StatusInternalServerError,
+		Code:      pihttp.CodeInternal,
+		Message:   "internal server error",
+		RequestID: "abc",
+	}
+	if *perr != expected {
+		t.Errorf("expected %+v, got %+v", expected, *perr)
+	}
+}
+
+// TestImageService_Conformance runs the client against a server using the in memory image service.
+func TestImageService_Conformance(t *testing.T) {
+	servicetest.Run(t, servicetest.Suite{
+		New: func(t *testing.T) (progimage.ImageService, func()) {
+			s := httptest.NewServer(pihttp.NewImageHandler(memory.NewImageService(0, uuid.New)))
+			is := pihttp.ImageService{
+				BaseURL: s.URL,
+				Client:  &http.Client{Timeout: time.Second * 100},
+			}
+			return is, s.Close
+		},
+	})
+}
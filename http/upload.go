@@ -0,0 +1,145 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+
+	"github.com/j0hnsmith/progimage"
+)
+
+// tooLarge returns the error for data (what) larger than max bytes.
+func tooLarge(what string, max int64) error {
+	return &progimage.Error{
+		Kind:   progimage.ErrImageTooLarge,
+		Detail: fmt.Sprintf("%s is larger than %d bytes", what, max),
+	}
+}
+
+// limitReader reads from r, returning a progimage.ErrImageTooLarge error (see tooLarge) once more than max bytes
+// have been read. Unlike io.LimitReader the data isn't silently truncated.
+type limitReader struct {
+	r    io.Reader
+	what string
+	max  int64
+	n    int64 // read so far
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n > l.max {
+		return 0, tooLarge(l.what, l.max)
+	}
+	// one more byte than allowed so too much data can be told apart from exactly enough
+	if rem := l.max + 1 - l.n; int64(len(p)) > rem {
+		p = p[:rem]
+	}
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		return n, tooLarge(l.what, l.max)
+	}
+	return n, err
+}
+
+// createResponse is the body of a successful upload, ID is the first of IDs so clients that only send one image
+// don't need to look at the list.
+type createResponse struct {
+	ID  string   `json:"id"`
+	IDs []string `json:"ids"`
+}
+
+// jsonUpload is the body of an application/json upload, either the base64 encoded image or a url to fetch it from.
+type jsonUpload struct {
+	Data string `json:"data"`
+	URL  string `json:"url"`
+}
+
+// storeMultipart stores the image in each file part of a multipart/form-data body, other parts are ignored, each is
+// limited to maxBytes and there can be up to maxItems. If any image can't be stored the ones already stored are
+// deleted.
+func storeMultipart(
+	ctx context.Context, is progimage.ImageService, mr *multipart.Reader, maxBytes int64, maxItems int,
+) ([]string, error) {
+	var IDs []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			deleteAll(ctx, is, IDs)
+			return nil, multipartError(err)
+		}
+		if p.FormName() != "file" {
+			continue
+		}
+		if len(IDs) == maxItems {
+			deleteAll(ctx, is, IDs)
+			return nil, badRequest(fmt.Sprintf("too many images, max %d", maxItems))
+		}
+
+		ID, err := is.Store(ctx, &limitReader{r: p, what: "image " + p.FileName(), max: maxBytes})
+		if err != nil {
+			deleteAll(ctx, is, IDs)
+			return nil, err
+		}
+		IDs = append(IDs, ID)
+	}
+
+	if len(IDs) == 0 {
+		return nil, badRequest("no file parts in multipart body")
+	}
+	return IDs, nil
+}
+
+// multipartError is the error for a multipart body that can't be read, either it's too large or invalid.
+func multipartError(err error) error {
+	if progimage.KindOf(err) == progimage.ErrImageTooLarge {
+		return err
+	}
+	return badRequest("invalid multipart body, " + err.Error())
+}
+
+// storeJSON stores the image in a json body, the image is fetched with f if a url is given. The image is limited to
+// maxBytes.
+func storeJSON(ctx context.Context, is progimage.ImageService, f *Fetcher, r io.Reader, maxBytes int64) (string, error) {
+	u := jsonUpload{}
+	if err := json.NewDecoder(r).Decode(&u); err != nil {
+		return "", badRequest("invalid json body, " + err.Error())
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case u.Data != "" && u.URL != "":
+		return "", badRequest("only one of data or url can be set in json body")
+	case u.Data != "":
+		if data, err = base64.StdEncoding.DecodeString(u.Data); err != nil {
+			return "", badRequest("invalid base64 data, " + err.Error())
+		}
+	case u.URL != "":
+		if f == nil {
+			return "", badRequest("url uploads are disabled")
+		}
+		if data, err = f.Fetch(ctx, u.URL); err != nil {
+			return "", err
+		}
+	default:
+		return "", badRequest("no data or url in json body")
+	}
+	return is.Store(ctx, &limitReader{r: bytes.NewReader(data), what: "image", max: maxBytes})
+}
+
+// deleteAll deletes images stored by a failed upload, errors are only logged.
+func deleteAll(ctx context.Context, is progimage.ImageService, IDs []string) {
+	for _, ID := range IDs {
+		if err := is.Delete(ctx, ID); err != nil {
+			log.Printf("error deleting image from failed upload (id: %s), %s", ID, err)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package imagetransform
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MetadataBytes is how much of the start of an image is searched for EXIF metadata, a JPEG APP1 segment is at most
+// 64kb and comes before the image data.
+const MetadataBytes = 128 * 1024
+
+// EXIF is the metadata cameras and phones add to JPEGs that ParseEXIF understands.
+type EXIF struct {
+	Make  string `json:"make,omitempty"`
+	Model string `json:"model,omitempty"`
+
+	// Orientation is how the image has to be rotated and flipped to show it upright, 1 (or 0, not set) means it
+	// doesn't need to be, 6 and 8 rotate it 90 and 270 degrees clockwise, see the TIFF spec for the others.
+	Orientation int `json:"orientation,omitempty"`
+
+	// Taken is when the photo was taken in the camera's local time, eg 2018-03-04T05:06:07, EXIF has no time zone.
+	Taken string `json:"taken,omitempty"`
+
+	GPS *GPS `json:"gps,omitempty"`
+}
+
+// GPS is the location an image was taken in decimal degrees, negative for south and west.
+type GPS struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// EXIF tags read by ParseEXIF.
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagGPSLatitudeRef   = 0x0001
+	tagGPSLatitude      = 0x0002
+	tagGPSLongitudeRef  = 0x0003
+	tagGPSLongitude     = 0x0004
+)
+
+// ParseEXIF reads the EXIF metadata from the start of a JPEG, at least the first MetadataBytes of it if it's that
+// large. nil is returned if data isn't a JPEG or has no EXIF metadata, an error if the metadata can't be parsed.
+func ParseEXIF(data []byte) (*EXIF, error) {
+	tiffData, err := jpegEXIF(data)
+	if tiffData == nil || err != nil {
+		return nil, err
+	}
+	t, err := newTIFF(tiffData)
+	if err != nil {
+		return nil, err
+	}
+	ifd0, err := t.ifd(t.order.Uint32(t.data[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	e := &EXIF{
+		Make:  t.string(ifd0[tagMake]),
+		Model: t.string(ifd0[tagModel]),
+		Taken: exifTime(t.string(ifd0[tagDateTime])),
+	}
+	if o, ok := t.uint(ifd0[tagOrientation]); ok && o >= 1 && o <= 8 {
+		e.Orientation = int(o)
+	}
+
+	// the sub IFDs are optional, a broken one doesn't lose what's already been read
+	if off, ok := t.uint(ifd0[tagExifIFD]); ok {
+		if ifd, err := t.ifd(off); err == nil {
+			if taken := exifTime(t.string(ifd[tagDateTimeOriginal])); taken != "" {
+				e.Taken = taken
+			}
+		}
+	}
+	if off, ok := t.uint(ifd0[tagGPSIFD]); ok {
+		if ifd, err := t.ifd(off); err == nil {
+			lat, latOK := degrees(t.rationals(ifd[tagGPSLatitude]), t.string(ifd[tagGPSLatitudeRef]), "S")
+			lon, lonOK := degrees(t.rationals(ifd[tagGPSLongitude]), t.string(ifd[tagGPSLongitudeRef]), "W")
+			if latOK && lonOK {
+				e.GPS = &GPS{Latitude: lat, Longitude: lon}
+			}
+		}
+	}
+	return e, nil
+}
+
+// jpegEXIF returns the TIFF structured data of the EXIF APP1 segment of a JPEG, nil if there isn't one before the
+// image data or the end of data.
+func jpegEXIF(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, nil
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return nil, errors.Errorf("invalid jpeg marker at %d", i)
+		}
+		m := data[i+1]
+		switch {
+		case m == 0xff:
+			// fill byte
+			i++
+			continue
+		case m == 0x01 || m >= 0xd0 && m <= 0xd7:
+			// no length
+			i += 2
+			continue
+		case m == 0xda || m == 0xd9:
+			// start of image data or end of image
+			return nil, nil
+		}
+
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 {
+			return nil, errors.Errorf("invalid jpeg segment length at %d", i)
+		}
+		start, end := i+4, i+2+n
+		if m == 0xe1 && bytes.HasPrefix(data[start:], []byte("Exif\x00\x00")) {
+			if end > len(data) {
+				return nil, errors.New("truncated exif segment")
+			}
+			return data[start+6 : end], nil
+		}
+		i = end
+	}
+	return nil, nil
+}
+
+// tiff is TIFF structured data, which EXIF metadata is.
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// tiffEntry is an IFD entry, value is the data of all count values of the type.
+type tiffEntry struct {
+	typ   uint16
+	value []byte
+}
+
+// tiffTypeSizes are the sizes of the TIFF field types that are read, ASCII, SHORT, LONG and RATIONAL.
+var tiffTypeSizes = map[uint16]uint64{2: 1, 3: 2, 4: 4, 5: 8}
+
+func newTIFF(data []byte) (tiff, error) {
+	t := tiff{data: data}
+	if len(data) < 8 {
+		return t, errors.New("truncated tiff header")
+	}
+	switch string(data[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return t, errors.New("invalid tiff byte order")
+	}
+	if t.order.Uint16(data[2:]) != 42 {
+		return t, errors.New("invalid tiff header")
+	}
+	return t, nil
+}
+
+// ifd reads the IFD at offset, entries of unknown types or with values outside of the data are left out.
+func (t tiff) ifd(offset uint32) (map[uint16]tiffEntry, error) {
+	start := uint64(offset)
+	if start+2 > uint64(len(t.data)) {
+		return nil, errors.Errorf("ifd offset %d outside of exif data", offset)
+	}
+	n := uint64(t.order.Uint16(t.data[start:]))
+	if start+2+n*12 > uint64(len(t.data)) {
+		return nil, errors.Errorf("truncated ifd at %d", offset)
+	}
+
+	entries := make(map[uint16]tiffEntry, n)
+	for i := uint64(0); i < n; i++ {
+		e := t.data[start+2+i*12:]
+		typ := t.order.Uint16(e[2:])
+		size, ok := tiffTypeSizes[typ]
+		if !ok {
+			continue
+		}
+		total := uint64(t.order.Uint32(e[4:])) * size
+		value := e[8:12]
+		if total > 4 {
+			off := uint64(t.order.Uint32(e[8:]))
+			if off+total > uint64(len(t.data)) {
+				continue
+			}
+			value = t.data[off:]
+		}
+		entries[t.order.Uint16(e)] = tiffEntry{typ: typ, value: value[:total]}
+	}
+	return entries, nil
+}
+
+// string returns the value of an ASCII entry, empty if e isn't one.
+func (t tiff) string(e tiffEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// uint returns the first value of a SHORT or LONG entry.
+func (t tiff) uint(e tiffEntry) (uint32, bool) {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(t.order.Uint16(e.value)), true
+	case e.typ == 4 && len(e.value) >= 4:
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+// rationals returns the values of a RATIONAL entry, nil if e isn't one or a denominator is 0.
+func (t tiff) rationals(e tiffEntry) []float64 {
+	if e.typ != 5 {
+		return nil
+	}
+	var r []float64
+	for v := e.value; len(v) >= 8; v = v[8:] {
+		den := t.order.Uint32(v[4:])
+		if den == 0 {
+			return nil
+		}
+		r = append(r, float64(t.order.Uint32(v))/float64(den))
+	}
+	return r
+}
+
+// degrees converts a GPS degrees, minutes, seconds value to decimal degrees, negative if ref is neg.
+func degrees(dms []float64, ref, neg string) (float64, bool) {
+	if len(dms) != 3 || ref == "" {
+		return 0, false
+	}
+	d := dms[0] + dms[1]/60 + dms[2]/3600
+	if ref == neg {
+		d = -d
+	}
+	return d, true
+}
+
+// exifTime converts an EXIF date time, eg 2018:03:04 05:06:07, to ISO 8601, empty if it isn't valid.
+func exifTime(s string) string {
+	t, err := time.Parse("2006:01:02 15:04:05", s)
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02T15:04:05")
+}
+
+// readEXIF parses the EXIF metadata at the start of r, see ParseEXIF, the returned reader has all of r's data. Nil is
+// returned if there's no metadata or it can't be parsed, the image can still be used without it.
+func readEXIF(r io.Reader) (io.Reader, *EXIF) {
+	br := bufio.NewReaderSize(r, MetadataBytes)
+	// a short image gives an error along with all of its data
+	header, _ := br.Peek(MetadataBytes) // nolint: gas
+	e, err := ParseEXIF(header)
+	if err != nil {
+		return br, nil
+	}
+	return br, e
+}
+
+// orientationOps are the operations that turn an image upright for each EXIF orientation.
+var orientationOps = map[int][]map[string]string{
+	2: {{"dir": "h"}},
+	3: {{"deg": "180"}},
+	4: {{"dir": "v"}},
+	5: {{"deg": "90"}, {"dir": "h"}},
+	6: {{"deg": "90"}},
+	7: {{"deg": "270"}, {"dir": "h"}},
+	8: {{"deg": "270"}},
+}
+
+// orient rotates and flips img upright, as it's shown using its EXIF orientation (e can be nil), so it can be encoded
+// without the metadata.
+func orient(ctx context.Context, img image.Image, e *EXIF) (image.Image, error) {
+	if e == nil {
+		return img, nil
+	}
+	for _, args := range orientationOps[e.Orientation] {
+		newOp := newRotate
+		if args["dir"] != "" {
+			newOp = newFlip
+		}
+		op, err := newOp(args)
+		if err != nil {
+			return nil, err
+		}
+		if img, err = op.Apply(ctx, img); err != nil {
+			return nil, err
+		}
+	}
+	return img, nil
+}
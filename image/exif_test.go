@@ -0,0 +1,497 @@
+package imagetransform_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
+)
+
+var jpegTransformer = primage.Transformer{
+	Name:        "jpeg",
+	ContentType: "image/jpeg",
+	Encoder: func(w io.Writer, m image.Image, opts primage.EncodeOptions) error {
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: 100})
+	},
+}
+
+// ifdEntry is a TIFF IFD entry, value is big endian.
+type ifdEntry struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+// ifd returns a TIFF IFD at offset, values that don't fit in an entry follow it.
+func ifd(offset int, entries []ifdEntry) []byte {
+	b := make([]byte, 2, 2+12*len(entries)+4)
+	binary.BigEndian.PutUint16(b, uint16(len(entries)))
+	var data []byte
+	dataOffset := offset + 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		entry := make([]byte, 12)
+		binary.BigEndian.PutUint16(entry, e.tag)
+		binary.BigEndian.PutUint16(entry[2:], e.typ)
+		binary.BigEndian.PutUint32(entry[4:], e.count)
+		if len(e.value) <= 4 {
+			copy(entry[8:], e.value)
+		} else {
+			binary.BigEndian.PutUint32(entry[8:], uint32(dataOffset+len(data)))
+			data = append(data, e.value...)
+		}
+		b = append(b, entry...)
+	}
+	b = append(b, 0, 0, 0, 0) // no next ifd
+	return append(b, data...)
+}
+
+func ascii(tag uint16, s string) ifdEntry {
+	return ifdEntry{tag: tag, typ: 2, count: uint32(len(s) + 1), value: append([]byte(s), 0)}
+}
+
+func short(tag, v uint16) ifdEntry {
+	return ifdEntry{tag: tag, typ: 3, count: 1, value: []byte{byte(v >> 8), byte(v)}}
+}
+
+func long(tag uint16, v uint32) ifdEntry {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return ifdEntry{tag: tag, typ: 4, count: 1, value: b}
+}
+
+func rationals(tag uint16, v ...uint32) ifdEntry {
+	b := make([]byte, 4*len(v))
+	for i := range v {
+		binary.BigEndian.PutUint32(b[i*4:], v[i])
+	}
+	return ifdEntry{tag: tag, typ: 5, count: uint32(len(v) / 2), value: b}
+}
+
+// exifSegment returns a JPEG APP1 EXIF segment with camera, time and GPS metadata and the given orientation.
+func exifSegment(orientation uint16) []byte {
+	ifd0 := func(exifOffset, gpsOffset uint32) []byte {
+		return ifd(8, []ifdEntry{
+			ascii(0x010f, "Acme"),
+			ascii(0x0110, "Phone 1"),
+			short(0x0112, orientation),
+			ascii(0x0132, "2018:03:04 05:06:07"),
+			long(0x8769, exifOffset),
+			long(0x8825, gpsOffset),
+		})
+	}
+	exifOffset := 8 + len(ifd0(0, 0))
+	exifIFD := ifd(exifOffset, []ifdEntry{ascii(0x9003, "2017:01:02 03:04:05")})
+	gpsOffset := exifOffset + len(exifIFD)
+	gpsIFD := ifd(gpsOffset, []ifdEntry{
+		ascii(0x0001, "N"),
+		rationals(0x0002, 51, 1, 30, 1, 2628, 100), // 51° 30' 26.28"
+		ascii(0x0003, "W"),
+		rationals(0x0004, 0, 1, 7, 1, 3996, 100), // 0° 7' 39.96"
+	})
+
+	tiff := append([]byte("MM\x00\x2a\x00\x00\x00\x08"), ifd0(uint32(exifOffset), uint32(gpsOffset))...)
+	tiff = append(tiff, exifIFD...)
+	tiff = append(tiff, gpsIFD...)
+	return segment(0xe1, append([]byte("Exif\x00\x00"), tiff...))
+}
+
+// segment returns a JPEG segment with the given marker and data.
+func segment(marker byte, data []byte) []byte {
+	n := len(data) + 2
+	return append([]byte{0xff, marker, byte(n >> 8), byte(n)}, data...)
+}
+
+// withSegments inserts segments after the start of image marker of a JPEG.
+func withSegments(data []byte, segments ...[]byte) []byte {
+	b := append([]byte{}, data[:2]...)
+	for _, s := range segments {
+		b = append(b, s...)
+	}
+	return append(b, data[2:]...)
+}
+
+// quadrantImage returns a 40x20 jpeg, red in the top left quadrant, blue elsewhere.
+func quadrantImage(t *testing.T) []byte {
+	m := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	draw.Draw(m, m.Bounds(), &image.Uniform{C: color.RGBA{B: 255, A: 255}}, image.ZP, draw.Src)
+	draw.Draw(m, image.Rect(0, 0, 20, 10), &image.Uniform{C: color.RGBA{R: 255, A: 255}}, image.ZP, draw.Src)
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, m, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseEXIF(t *testing.T) {
+	e, err := primage.ParseEXIF(withSegments(quadrantImage(t), exifSegment(6)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := primage.EXIF{Make: "Acme", Model: "Phone 1", Orientation: 6, Taken: "2017-01-02T03:04:05"}
+	if e == nil || e.GPS == nil {
+		t.Fatalf("expected exif with gps, got %+v", e)
+	}
+	gps := *e.GPS
+	e.GPS = nil
+	if !reflect.DeepEqual(*e, expected) {
+		t.Errorf("expected %+v, got %+v", expected, *e)
+	}
+	if math.Abs(gps.Latitude-51.5073) > 1e-4 || math.Abs(gps.Longitude+0.1278) > 1e-4 {
+		t.Errorf("expected gps 51.5073, -0.1278, got %+v", gps)
+	}
+}
+
+func TestParseEXIF_None(t *testing.T) {
+	icc := segment(0xe2, []byte("ICC_PROFILE\x00..."))
+	var noneTests = []struct {
+		Name string
+		Data []byte
+	}{
+		{Name: "no exif", Data: quadrantImage(t)},
+		{Name: "other segments", Data: withSegments(quadrantImage(t), icc)},
+		{Name: "not a jpeg", Data: pngHeader(10, 10)},
+		{Name: "empty"},
+	}
+
+	for _, item := range noneTests {
+		t.Run(item.Name, func(t *testing.T) {
+			e, err := primage.ParseEXIF(item.Data)
+			if e != nil || err != nil {
+				t.Errorf("expected no exif or error, got %+v, %v", e, err)
+			}
+		})
+	}
+}
+
+// TestParseEXIF_Corrupt checks corrupted metadata is an error or parsed, not panicking.
+func TestParseEXIF_Corrupt(t *testing.T) {
+	data := withSegments(quadrantImage(t), exifSegment(6))
+	seg := exifSegment(6)
+	for i := 4; i < len(seg); i++ {
+		corrupt := append([]byte{}, data...)
+		corrupt[2+i] ^= 0xff
+		primage.ParseEXIF(corrupt)       // nolint: errcheck
+		primage.ParseEXIF(corrupt[:2+i]) // nolint: errcheck
+	}
+}
+
+func TestPipeline_RunOrientation(t *testing.T) {
+	// where the centre of the top left (red) and bottom right (blue) quadrants of a 40x20 image end up
+	red, blue := image.Pt(10, 5), image.Pt(30, 15)
+	var orientationTests = []struct {
+		Orientation uint16
+		Width       int
+		Red, Blue   image.Point
+	}{
+		{Orientation: 1, Width: 40, Red: red, Blue: blue},
+		{Orientation: 2, Width: 40, Red: image.Pt(29, 5), Blue: image.Pt(9, 15)},
+		{Orientation: 3, Width: 40, Red: image.Pt(29, 14), Blue: image.Pt(9, 4)},
+		{Orientation: 4, Width: 40, Red: image.Pt(10, 14), Blue: image.Pt(30, 4)},
+		{Orientation: 5, Width: 20, Red: image.Pt(5, 10), Blue: image.Pt(15, 30)},
+		{Orientation: 6, Width: 20, Red: image.Pt(14, 10), Blue: image.Pt(4, 30)},
+		{Orientation: 7, Width: 20, Red: image.Pt(14, 29), Blue: image.Pt(4, 9)},
+		{Orientation: 8, Width: 20, Red: image.Pt(5, 29), Blue: image.Pt(15, 9)},
+	}
+
+	for _, item := range orientationTests {
+		t.Run(string('0'+rune(item.Orientation)), func(t *testing.T) {
+			data := withSegments(quadrantImage(t), exifSegment(item.Orientation))
+			img := progimage.Image{Data: bytes.NewReader(data), ContentType: "image/jpeg"}
+			out, err := primage.Pipeline{Transformer: pngTransformer}.Run(context.Background(), img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, _, err := image.Decode(out.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w, h := m.Bounds().Dx(), m.Bounds().Dy(); w != item.Width || h != 60-item.Width {
+				t.Errorf("expected %dx%d, got %dx%d", item.Width, 60-item.Width, w, h)
+			}
+			if r, _, b, _ := m.At(item.Red.X, item.Red.Y).RGBA(); r < 0xc000 || b > 0x4000 {
+				t.Errorf("expected red at %v", item.Red)
+			}
+			if r, _, b, _ := m.At(item.Blue.X, item.Blue.Y).RGBA(); b < 0xc000 || r > 0x4000 {
+				t.Errorf("expected blue at %v", item.Blue)
+			}
+		})
+	}
+}
+
+func TestValidate_Orientation(t *testing.T) {
+	up, err := primage.Validate(bytes.NewReader(withSegments(quadrantImage(t), exifSegment(6))), 0, primage.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.Width != 20 || up.Height != 40 {
+		t.Errorf("expected upright size 20x40, got %dx%d", up.Width, up.Height)
+	}
+}
+
+func TestStripMetadata_JPEG(t *testing.T) {
+	plain := quadrantImage(t)
+	xmp := segment(0xe1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta/>"))
+	icc := segment(0xe2, []byte("ICC_PROFILE\x00..."))
+	iptc := segment(0xed, []byte("Photoshop 3.0\x00..."))
+	// phones append more images after the end of the image
+	trailer := withSegments([]byte{0xff, 0xd8, 0xff, 0xd9}, exifSegment(1))
+
+	var stripTests = []struct {
+		Name string
+		Data []byte
+	}{
+		{Name: "none", Data: plain},
+		{Name: "exif", Data: withSegments(plain, exifSegment(1))},
+		{Name: "all", Data: withSegments(plain, exifSegment(1), xmp, icc, iptc)},
+		{Name: "trailer", Data: append(withSegments(plain, exifSegment(1)), trailer...)},
+	}
+
+	for _, item := range stripTests {
+		t.Run(item.Name, func(t *testing.T) {
+			r, ok := primage.StripMetadata(bytes.NewReader(item.Data), "image/jpeg")
+			if !ok {
+				t.Fatal("expected jpeg metadata to be stripped")
+			}
+			out, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out, plain) {
+				t.Errorf("expected the image without metadata, got %d bytes, expected %d", len(out), len(plain))
+			}
+		})
+	}
+
+	// a real image with an ICC profile, it's only removed
+	data, err := ioutil.ReadFile("../testimages/test.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _ := primage.StripMetadata(bytes.NewReader(data), "image/jpeg")
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(out, []byte("ICC_PROFILE")) || len(out) >= len(data) {
+		t.Error("expected ICC profile to be removed")
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Errorf("expected stripped image to decode, got %v", err)
+	}
+}
+
+func TestStripMetadata_PNG(t *testing.T) {
+	plain := testImage(t, 10, 10).Data.(*bytes.Buffer).Bytes()
+
+	// metadata chunks after the header
+	chunk := func(typ, data string) []byte {
+		b := make([]byte, 4, 12+len(data))
+		binary.BigEndian.PutUint32(b, uint32(len(data)))
+		b = append(b, typ+data...)
+		return append(b, 0, 0, 0, 0) // the crc isn't checked
+	}
+	ihdrEnd := 8 + 8 + 13 + 4
+	data := append([]byte{}, plain[:ihdrEnd]...)
+	for _, c := range [][]byte{
+		chunk("eXIf", "MM\x00\x2a"),
+		chunk("iCCP", "sRGB\x00\x00..."),
+		chunk("iTXt", "XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta/>"),
+		chunk("tEXt", "Comment\x00hello"),
+	} {
+		data = append(data, c...)
+	}
+	data = append(data, plain[ihdrEnd:]...)
+
+	r, ok := primage.StripMetadata(bytes.NewReader(data), "image/png")
+	if !ok {
+		t.Fatal("expected png metadata to be stripped")
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Errorf("expected the image without metadata, got %d bytes, expected %d", len(out), len(plain))
+	}
+}
+
+// riffChunk returns a WebP (RIFF) chunk, padded to an even size.
+func riffChunk(typ, data string) []byte {
+	b := make([]byte, 8, 9+len(data))
+	copy(b, typ)
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// webpImage returns an extended format WebP, with ICC, EXIF and XMP metadata if metadata is set. The image data isn't
+// valid, it's only the chunks that are checked.
+func webpImage(metadata bool) []byte {
+	flags := byte(0x10) // alpha
+	if metadata {
+		flags |= 0x20 | 0x08 | 0x04
+	}
+	chunks := [][]byte{riffChunk("VP8X", string([]byte{flags, 0, 0, 0, 9, 0, 0, 9, 0, 0}))}
+	if metadata {
+		chunks = append(chunks, riffChunk("ICCP", "icc profile"))
+	}
+	chunks = append(chunks, riffChunk("ALPH", "alpha"), riffChunk("VP8 ", "lossy data"))
+	if metadata {
+		chunks = append(chunks, riffChunk("EXIF", "MM\x00\x2a"), riffChunk("XMP ", "<x:xmpmeta/>"))
+	}
+
+	b := []byte("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range chunks {
+		b = append(b, c...)
+	}
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)-8))
+	return b
+}
+
+func TestStripMetadata_WebP(t *testing.T) {
+	plain := webpImage(false)
+
+	r, ok := primage.StripMetadata(bytes.NewReader(webpImage(true)), "image/webp")
+	if !ok {
+		t.Fatal("expected webp metadata to be stripped")
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, plain) {
+		t.Errorf("expected the image without metadata, got %q, expected %q", out, plain)
+	}
+}
+
+func TestHasMetadata(t *testing.T) {
+	plain := quadrantImage(t)
+
+	var metadataTests = []struct {
+		Name        string
+		ContentType string
+		Data        []byte
+		Metadata    bool
+	}{
+		{Name: "jpeg", ContentType: "image/jpeg", Data: plain},
+		{Name: "jpeg exif", ContentType: "image/jpeg", Data: withSegments(plain, exifSegment(1)), Metadata: true},
+		{Name: "jpeg trailer", ContentType: "image/jpeg", Data: append(plain, 0xff, 0xd8, 0xff, 0xd9), Metadata: true},
+		{Name: "png", ContentType: "image/png", Data: testImage(t, 10, 10).Data.(*bytes.Buffer).Bytes()},
+		{Name: "webp", ContentType: "image/webp", Data: webpImage(false)},
+		{Name: "webp metadata", ContentType: "image/webp", Data: webpImage(true), Metadata: true},
+		{Name: "gif", ContentType: "image/gif", Data: []byte("GIF89a")},
+		{Name: "unsupported", ContentType: "image/bmp", Data: []byte("BM"), Metadata: true},
+	}
+
+	for _, item := range metadataTests {
+		t.Run(item.Name, func(t *testing.T) {
+			metadata, err := primage.HasMetadata(bytes.NewReader(item.Data), item.ContentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if metadata != item.Metadata {
+				t.Errorf("expected metadata %t, got %t", item.Metadata, metadata)
+			}
+		})
+	}
+}
+
+func TestStripMetadata_Invalid(t *testing.T) {
+	plain := quadrantImage(t)
+	var invalidTests = []struct {
+		Name        string
+		ContentType string
+		Data        []byte
+	}{
+		{Name: "not a jpeg", ContentType: "image/jpeg", Data: pngHeader(10, 10)},
+		{Name: "truncated jpeg", ContentType: "image/jpeg", Data: plain[:len(plain)/2]},
+		{Name: "not a png", ContentType: "image/png", Data: plain},
+		{Name: "truncated png", ContentType: "image/png", Data: pngHeader(10, 10)[:20]},
+		{Name: "not a webp", ContentType: "image/webp", Data: plain},
+		{Name: "truncated webp", ContentType: "image/webp", Data: webpImage(false)[:30]},
+	}
+
+	for _, item := range invalidTests {
+		t.Run(item.Name, func(t *testing.T) {
+			r, _ := primage.StripMetadata(bytes.NewReader(item.Data), item.ContentType)
+			if _, err := ioutil.ReadAll(r); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	if _, ok := primage.StripMetadata(bytes.NewReader(nil), "image/bmp"); ok {
+		t.Error("expected bmp metadata not to be stripped")
+	}
+}
+
+func TestPipeline_RunStripMetadata(t *testing.T) {
+	plain := quadrantImage(t)
+
+	var stripTests = []struct {
+		Name        string
+		Orientation uint16
+		Width       int
+	}{
+		// upright, the metadata is removed without encoding
+		{Name: "upright", Orientation: 1, Width: 40},
+		// rotated when encoded
+		{Name: "rotated", Orientation: 6, Width: 20},
+	}
+
+	for _, item := range stripTests {
+		t.Run(item.Name, func(t *testing.T) {
+			data := withSegments(plain, exifSegment(item.Orientation))
+			img := progimage.Image{Data: bytes.NewReader(data), ContentType: "image/jpeg"}
+			p := primage.Pipeline{Transformer: jpegTransformer, StripMetadata: true}
+			out, err := p.Run(context.Background(), img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(out.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if e, err := primage.ParseEXIF(b); e != nil || err != nil {
+				t.Errorf("expected no exif, got %+v, %v", e, err)
+			}
+			if item.Orientation == 1 && !bytes.Equal(b, plain) {
+				t.Error("expected the original image data without metadata")
+			}
+			cfg, err := jpeg.DecodeConfig(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != item.Width {
+				t.Errorf("expected width %d, got %d", item.Width, cfg.Width)
+			}
+		})
+	}
+
+	// without StripMetadata the original is returned as is
+	data := withSegments(plain, exifSegment(6))
+	img := progimage.Image{Data: bytes.NewReader(data), ContentType: "image/jpeg"}
+	out, err := primage.Pipeline{Transformer: jpegTransformer}.Run(context.Background(), img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(out.Data); !bytes.Equal(b, data) {
+		t.Error("expected the original image data")
+	}
+}
@@ -8,16 +8,20 @@ import (
 	"io"
 
 	primage "github.com/j0hnsmith/progimage/image"
+	_ "golang.org/x/image/webp" // import to register image type
 )
 
 // Transformer implements progimage.ImageTypeTransformer to convert a progimage.Image to png format.
 var Transformer = primage.Transformer{
 	Name:        "gif",
 	ContentType: "image/gif",
-	Encoder:     DefaultGifEncode,
+	Encoder:     Encode,
 }
 
-// DefaultGifEncode performs fig encoding with default values for options.
-func DefaultGifEncode(w io.Writer, m image.Image) error {
-	return gif.Encode(w, m, nil)
+// Encode performs gif encoding, opts.Colors sets the palette size (default 256).
+func Encode(w io.Writer, m image.Image, opts primage.EncodeOptions) error {
+	if opts.Colors == 0 {
+		return gif.Encode(w, m, nil)
+	}
+	return gif.Encode(w, m, &gif.Options{NumColors: opts.Colors})
 }
@@ -1,6 +1,7 @@
 package gif_test
 
 import (
+	"context"
 	"image"
 	"os"
 	"testing"
@@ -35,7 +36,7 @@ func TestTransformGif(t *testing.T) {
 			}
 
 			errCh := make(chan error, 1)
-			imgOut, err := gif.Transformer.Transform(img, errCh)
+			imgOut, err := gif.Transformer.Transform(context.Background(), img, errCh)
 			if err != nil {
 				t.Fatal(err)
 			}
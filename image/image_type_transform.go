@@ -1,13 +1,13 @@
 package imagetransform
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"io"
-	"log"
+	"strings"
 
 	"github.com/j0hnsmith/progimage"
-	"github.com/pkg/errors"
 )
 
 var _ progimage.ImageTypeTransformer = Transformer{}
@@ -15,37 +15,66 @@ var _ progimage.ImageTypeTransformer = Transformer{}
 // Transformer enables progimage.ImageTypeTransformer implementations to be created easily avoiding code duplication.
 type Transformer struct {
 	ContentType string
-	Encoder     func(io.Writer, image.Image) error
+	Encoder     func(io.Writer, image.Image, EncodeOptions) error
 	Name        string
 }
 
-// Transform the given image to the desired format.
-func (t Transformer) Transform(img progimage.Image, ec chan error) (progimage.Image, error) {
+// EncodeOptions are per image encoder settings, the zero value of a field means the encoder's default. Encoders
+// ignore the options that don't apply to their format.
+type EncodeOptions struct {
+	Quality     int    // lossy quality 1-100 (jpeg, webp)
+	Compression string // compression level, one of the Compression constants (png)
+	Colors      int    // palette size 2-256 (gif)
+	Lossless    bool   // lossless encoding, Quality doesn't apply (webp)
+}
+
+// Compression levels for EncodeOptions.Compression.
+const (
+	CompressionDefault = "default"
+	CompressionBest    = "best"
+	CompressionFast    = "fast"
+	CompressionNone    = "none"
+)
+
+// String describes the options that are set, eg "q=90 colors=64", empty if none are.
+func (o EncodeOptions) String() string {
+	var s []string
+	if o.Quality != 0 {
+		s = append(s, fmt.Sprintf("q=%d", o.Quality))
+	}
+	if o.Compression != "" {
+		s = append(s, "compression="+o.Compression)
+	}
+	if o.Colors != 0 {
+		s = append(s, fmt.Sprintf("colors=%d", o.Colors))
+	}
+	if o.Lossless {
+		s = append(s, "lossless")
+	}
+	return strings.Join(s, " ")
+}
+
+// Transform the given image to the desired format with the encoder's default options, the encoding error (or nil) is
+// sent on ec. Images larger than DefaultLimits aren't decoded, JPEGs are made upright using their EXIF orientation.
+// Encoding stops when ctx is done.
+func (t Transformer) Transform(ctx context.Context, img progimage.Image, ec chan error) (progimage.Image, error) {
 	if img.ContentType == t.ContentType {
 		ec <- nil
 		return img, nil
 	}
 	ret := progimage.Image{}
-	i, _, err := image.Decode(img.Data)
+	data, exif := readEXIF(img.Data)
+	i, err := DefaultLimits.Decode(data)
 	if err != nil {
-		return ret, errors.Wrap(err, fmt.Sprintf("unable to decode %s image", t.Name))
+		return ret, err
+	}
+	if i, err = orient(ctx, i, exif); err != nil {
+		return ret, err
 	}
 
-	r, w := io.Pipe()
+	r, errc := encodePipe(ctx, t, i, EncodeOptions{})
 	go func() {
-		if err := t.Encoder(w, i); err != nil {
-			ec <- errors.Wrap(err, fmt.Sprintf("unable to encode %s image", t.Name))
-			closeErr := w.Close()
-			if closeErr != nil {
-				log.Println("error closing pipe (unable to encode)", closeErr.Error())
-			}
-			return
-		}
-		ec <- nil
-		closeErr := w.Close()
-		if closeErr != nil {
-			log.Println("error closing pipe", closeErr.Error())
-		}
+		ec <- <-errc
 	}()
 
 	ret.ID = img.ID
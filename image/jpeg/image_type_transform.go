@@ -8,16 +8,20 @@ import (
 	"io"
 
 	primage "github.com/j0hnsmith/progimage/image"
+	_ "golang.org/x/image/webp" // register image type, do not remove
 )
 
 // Transformer implements progimage.ImageTypeTransformer to convert a progimage.Image to jpeg format.
 var Transformer = primage.Transformer{
 	Name:        "jpeg",
 	ContentType: "image/jpeg",
-	Encoder:     DefaultJpegEncode,
+	Encoder:     Encode,
 }
 
-// DefaultJpegEncode performs jpeg encoding with default values for options.
-func DefaultJpegEncode(w io.Writer, m image.Image) error {
-	return jpeg.Encode(w, m, nil)
+// Encode performs jpeg encoding, opts.Quality sets the quality (default 75).
+func Encode(w io.Writer, m image.Image, opts primage.EncodeOptions) error {
+	if opts.Quality == 0 {
+		return jpeg.Encode(w, m, nil)
+	}
+	return jpeg.Encode(w, m, &jpeg.Options{Quality: opts.Quality})
 }
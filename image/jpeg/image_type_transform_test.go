@@ -1,11 +1,14 @@
 package jpeg_test
 
 import (
+	"bytes"
+	"context"
 	"image"
 	"os"
 	"testing"
 
 	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
 	"github.com/j0hnsmith/progimage/image/jpeg"
 )
 
@@ -35,7 +38,7 @@ func TestTransformPNG(t *testing.T) {
 			}
 
 			errCh := make(chan error, 1)
-			imgOut, err := jpeg.Transformer.Transform(img, errCh)
+			imgOut, err := jpeg.Transformer.Transform(context.Background(), img, errCh)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -54,6 +57,30 @@ func TestTransformPNG(t *testing.T) {
 	}
 }
 
+func TestEncodeQuality(t *testing.T) {
+	fp, err := os.Open("../../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	m, _, err := image.Decode(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var low, high bytes.Buffer
+	if err := jpeg.Encode(&low, m, primage.EncodeOptions{Quality: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&high, m, primage.EncodeOptions{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	if low.Len() >= high.Len() {
+		t.Errorf("expected quality 10 (%d bytes) to be smaller than quality 95 (%d bytes)", low.Len(), high.Len())
+	}
+}
+
 func BenchmarkTransformToJPEG(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		for _, item := range fileTests {
@@ -71,7 +98,7 @@ func BenchmarkTransformToJPEG(b *testing.B) {
 				}
 
 				errCh := make(chan error, 1)
-				imgOut, err := jpeg.Transformer.Transform(img, errCh)
+				imgOut, err := jpeg.Transformer.Transform(context.Background(), img, errCh)
 				if err != nil {
 					b.Fatal(err)
 				}
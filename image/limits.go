@@ -0,0 +1,76 @@
+package imagetransform
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/j0hnsmith/progimage"
+)
+
+// Limits are the max dimensions of images that are decoded. A small file can declare a huge image (a decompression
+// bomb) so the dimensions in the header are checked before the image is decoded and memory allocated for it. A zero
+// field isn't checked.
+//
+// MaxWork limits the operations a Pipeline applies to a decoded image, it's the total pixels processed (see Coster).
+type Limits struct {
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64 // width * height
+	MaxWork   int64
+}
+
+// DefaultLimits are used when no limits are given, a zero Limits.
+var DefaultLimits = Limits{
+	MaxWidth:  16384,
+	MaxHeight: 16384,
+	MaxPixels: 50 * 1000 * 1000, // 50 megapixels, 200mb decoded as RGBA
+	MaxWork:   500 * 1000 * 1000,
+}
+
+// orDefault returns l, or DefaultLimits if l is zero.
+func (l Limits) orDefault() Limits {
+	if l == (Limits{}) {
+		return DefaultLimits
+	}
+	return l
+}
+
+// Check returns a progimage.ErrImageDimensions error if an image with the given config is larger than l (or
+// DefaultLimits if l is zero).
+func (l Limits) Check(cfg image.Config) error {
+	l = l.orDefault()
+	var detail string
+	switch {
+	case l.MaxWidth > 0 && cfg.Width > l.MaxWidth:
+		detail = fmt.Sprintf("width %d is more than %d", cfg.Width, l.MaxWidth)
+	case l.MaxHeight > 0 && cfg.Height > l.MaxHeight:
+		detail = fmt.Sprintf("height %d is more than %d", cfg.Height, l.MaxHeight)
+	case l.MaxPixels > 0 && int64(cfg.Width)*int64(cfg.Height) > l.MaxPixels:
+		detail = fmt.Sprintf("%dx%d is more than %d pixels", cfg.Width, cfg.Height, l.MaxPixels)
+	default:
+		return nil
+	}
+	return &progimage.Error{Kind: progimage.ErrImageDimensions, Detail: detail}
+}
+
+// Decode decodes an image from r after checking its dimensions with Check. Data that isn't a recognised image is a
+// progimage.ErrUnrecognisedImageType error.
+func (l Limits) Decode(r io.Reader) (image.Image, error) {
+	// the header read by DecodeConfig is needed again by Decode
+	header := new(bytes.Buffer)
+	cfg, _, err := image.DecodeConfig(io.TeeReader(r, header))
+	if err != nil {
+		return nil, &progimage.Error{Kind: progimage.ErrUnrecognisedImageType, Err: err}
+	}
+	if err := l.Check(cfg); err != nil {
+		return nil, err
+	}
+
+	i, _, err := image.Decode(io.MultiReader(header, r))
+	if err != nil {
+		return nil, &progimage.Error{Kind: progimage.ErrUnrecognisedImageType, Err: err}
+	}
+	return i, nil
+}
@@ -0,0 +1,174 @@
+package imagetransform_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"math/rand"
+	"testing"
+
+	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
+)
+
+// pngHeader returns the start of a png declaring a w x h image, there's no image data after the header.
+func pngHeader(w, h uint32) []byte {
+	b := []byte("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], w)
+	binary.BigEndian.PutUint32(ihdr[4:], h)
+	ihdr[8], ihdr[9] = 8, 2 // 8 bit rgb
+
+	chunk := append([]byte("IHDR"), ihdr...)
+	b = append(b, 0, 0, 0, byte(len(ihdr)))
+	b = append(b, chunk...)
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk))
+	return append(b, crc...)
+}
+
+// gifHeader returns the start of a gif with a w x h logical screen.
+func gifHeader(w, h uint16) []byte {
+	b := []byte("GIF89a")
+	b = append(b, byte(w), byte(w>>8), byte(h), byte(h>>8))
+	return append(b, 0, 0, 0)
+}
+
+// jpegHeader returns the start of a grayscale jpeg with a w x h frame.
+func jpegHeader(w, h uint16) []byte {
+	b := []byte{0xff, 0xd8}                                  // SOI
+	b = append(b, 0xff, 0xc0, 0, 11, 8, byte(h>>8), byte(h)) // SOF0
+	b = append(b, byte(w>>8), byte(w), 1, 1, 0x11, 0)
+	return append(b, 0xff, 0xda, 0, 8) // SOS
+}
+
+func TestLimits_Check(t *testing.T) {
+	limits := primage.Limits{MaxWidth: 100, MaxHeight: 50, MaxPixels: 1000}
+
+	var checkTests = []struct {
+		Name   string
+		Limits primage.Limits
+		Width  int
+		Height int
+		Err    bool
+	}{
+		{Name: "within", Limits: limits, Width: 40, Height: 25},
+		{Name: "max pixels", Limits: limits, Width: 100, Height: 10},
+		{Name: "too wide", Limits: limits, Width: 101, Height: 1, Err: true},
+		{Name: "too high", Limits: limits, Width: 1, Height: 51, Err: true},
+		{Name: "too many pixels", Limits: limits, Width: 50, Height: 21, Err: true},
+		{Name: "unchecked width", Limits: primage.Limits{MaxHeight: 50}, Width: 1 << 30, Height: 50},
+		{Name: "default", Width: primage.DefaultLimits.MaxWidth, Height: primage.DefaultLimits.MaxHeight, Err: true},
+		// overflows an int32
+		{Name: "overflow", Limits: limits, Width: 1 << 16, Height: 1 << 16, Err: true},
+	}
+
+	for _, item := range checkTests {
+		t.Run(item.Name, func(t *testing.T) {
+			err := item.Limits.Check(image.Config{Width: item.Width, Height: item.Height})
+			if !item.Err {
+				if err != nil {
+					t.Errorf("expected no error, got %v", err)
+				}
+				return
+			}
+			if progimage.KindOf(err) != progimage.ErrImageDimensions {
+				t.Errorf("expected ErrImageDimensions, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLimits_Decode(t *testing.T) {
+	var decodeTests = []struct {
+		Name string
+		Data []byte
+	}{
+		{Name: "png width", Data: pngHeader(50000, 1)},
+		{Name: "png height", Data: pngHeader(1, 50000)},
+		{Name: "png pixels", Data: pngHeader(16000, 16000)},
+		{Name: "png huge", Data: pngHeader(1<<20, 1<<20)},
+		{Name: "gif", Data: gifHeader(65535, 65535)},
+		{Name: "jpeg", Data: jpegHeader(65535, 65535)},
+	}
+
+	for _, item := range decodeTests {
+		t.Run(item.Name, func(t *testing.T) {
+			_, err := primage.Limits{}.Decode(bytes.NewReader(item.Data))
+			if progimage.KindOf(err) != progimage.ErrImageDimensions {
+				t.Errorf("expected ErrImageDimensions, got %v", err)
+			}
+
+			_, err = primage.Validate(bytes.NewReader(item.Data), 0, primage.Limits{})
+			if progimage.KindOf(err) != progimage.ErrImageDimensions {
+				t.Errorf("expected ErrImageDimensions from Validate, got %v", err)
+			}
+		})
+	}
+}
+
+// TestLimits_DecodeRandom checks crafted headers with random dimensions are rejected before decoding if they're over
+// the limits, headers within the limits have no image data so fail to decode.
+func TestLimits_DecodeRandom(t *testing.T) {
+	limits := primage.Limits{MaxWidth: 4000, MaxHeight: 3000, MaxPixels: 6 * 1000 * 1000}
+	rnd := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 1000; i++ {
+		w, h := uint16(rnd.Intn(8000)+1), uint16(rnd.Intn(8000)+1)
+		over := limits.Check(image.Config{Width: int(w), Height: int(h)}) != nil
+
+		for _, data := range [][]byte{pngHeader(uint32(w), uint32(h)), gifHeader(w, h), jpegHeader(w, h)} {
+			_, err := limits.Decode(bytes.NewReader(data))
+			expected := progimage.ErrUnrecognisedImageType
+			if over {
+				expected = progimage.ErrImageDimensions
+			}
+			if kind := progimage.KindOf(err); kind != expected {
+				t.Fatalf("%dx%d % x: expected %v, got %v", w, h, data[:4], expected, err)
+			}
+		}
+	}
+}
+
+// TestLimits_DecodeCorrupt checks corrupted headers are rejected, not decoded or panicking.
+func TestLimits_DecodeCorrupt(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	for _, header := range [][]byte{pngHeader(50000, 50000), gifHeader(65535, 65535), jpegHeader(65535, 65535)} {
+		for i := 0; i < 1000; i++ {
+			data := append([]byte{}, header...)
+			for n := rnd.Intn(3) + 1; n > 0; n-- {
+				data[rnd.Intn(len(data))] = byte(rnd.Intn(256))
+			}
+
+			_, err := primage.Limits{}.Decode(bytes.NewReader(data))
+			if kind := progimage.KindOf(err); kind != progimage.ErrImageDimensions &&
+				kind != progimage.ErrUnrecognisedImageType {
+				t.Fatalf("% x: expected ErrImageDimensions or ErrUnrecognisedImageType, got %v", data, err)
+			}
+		}
+	}
+}
+
+func TestPipeline_RunLimits(t *testing.T) {
+	spec, err := primage.ParseSpec("grayscale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := primage.NewPipeline(spec, pngTransformer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.Limits = primage.Limits{MaxPixels: 100}
+	if _, err := p.Run(context.Background(), testImage(t, 20, 10)); progimage.KindOf(err) != progimage.ErrImageDimensions {
+		t.Errorf("expected ErrImageDimensions, got %v", err)
+	}
+
+	p.Limits = primage.Limits{MaxPixels: 200}
+	if _, err := p.Run(context.Background(), testImage(t, 20, 10)); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
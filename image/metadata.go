@@ -0,0 +1,330 @@
+package imagetransform
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// StripMetadata returns a reader of the image data r without its EXIF (including any GPS location), XMP and ICC
+// metadata. The pixel data isn't touched, so isn't re-encoded. ok is false if metadata can't be removed from the
+// contentType, JPEG, PNG and WebP are supported, GIF (which has no EXIF) is returned as is, re-encoding it would lose
+// any animation. Errors in the data are returned when it's read.
+//
+// EXIF orientation is lost, images that aren't upright need to be decoded and encoded (see Pipeline) instead.
+func StripMetadata(r io.Reader, contentType string) (rd io.Reader, ok bool) {
+	switch contentType {
+	case "image/gif":
+		return r, true
+	case "image/jpeg":
+		return &stripReader{next: jpegStripper(bufio.NewReader(r))}, true
+	case "image/png":
+		return &stripReader{next: pngStripper(bufio.NewReader(r))}, true
+	case "image/webp":
+		return &stripReader{next: webpStripper(r)}, true
+	}
+	return nil, false
+}
+
+// HasMetadata reports whether StripMetadata changes the image data r, if it doesn't the original can be served as is.
+// It's true if metadata can't be removed from the contentType, the image has to be encoded. r is read to the end.
+func HasMetadata(r io.Reader, contentType string) (bool, error) {
+	cr := &countReader{r: r}
+	stripped, ok := StripMetadata(cr, contentType)
+	if !ok {
+		return true, nil
+	}
+	n, err := io.Copy(ioutil.Discard, stripped)
+	if err != nil {
+		return false, err
+	}
+	// anything after the end of the image is stripped too
+	if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+		return false, err
+	}
+	return n != cr.n, nil
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// stripReader reads the parts of an image next returns in turn, next returns io.EOF when there are no more.
+type stripReader struct {
+	next func() (io.Reader, error)
+	cur  io.Reader
+	err  error
+}
+
+func (s *stripReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for s.err == nil {
+		if s.cur == nil {
+			s.cur, s.err = s.next()
+			continue
+		}
+		n, err := s.cur.Read(p)
+		if err == io.EOF {
+			s.cur, err = nil, nil
+		}
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+	return 0, s.err
+}
+
+// jpegStripMarkers are the segments with metadata, APP1 (EXIF and XMP), APP2 (ICC) and APP13 (IPTC).
+var jpegStripMarkers = map[byte]bool{0xe1: true, 0xe2: true, 0xed: true}
+
+// jpegStripper returns the segments of a JPEG without metadata. Anything after the end of the image is left out,
+// phones append extra images (with their own metadata) there.
+func jpegStripper(br *bufio.Reader) func() (io.Reader, error) {
+	started, scanning, done := false, false, false
+	// the 0xff of the marker after the image data has been read
+	markerFF := false
+	return func() (io.Reader, error) {
+		switch {
+		case done:
+			return nil, io.EOF
+		case !started:
+			started = true
+			soi := make([]byte, 2)
+			if _, err := io.ReadFull(br, soi); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if soi[0] != 0xff || soi[1] != 0xd8 {
+				return nil, errors.New("invalid jpeg, no start of image")
+			}
+			return bytes.NewReader(soi), nil
+		case scanning:
+			// image data, it only has 0xff followed by 0x00 (an escaped 0xff) or a restart marker
+			data, err := br.ReadSlice(0xff)
+			if err == bufio.ErrBufferFull {
+				return bytes.NewReader(append([]byte{}, data...)), nil
+			}
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			next, err := br.Peek(1)
+			if err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if m := next[0]; m != 0x00 && m != 0xff && (m < 0xd0 || m > 0xd7) {
+				// a marker, the end of the image data
+				scanning, markerFF = false, true
+				data = data[:len(data)-1]
+			}
+			return bytes.NewReader(append([]byte{}, data...)), nil
+		}
+
+		for {
+			m, err := jpegMarker(br, markerFF)
+			markerFF = false
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case m == 0xd9:
+				done = true
+				return bytes.NewReader([]byte{0xff, m}), nil
+			case m == 0x01 || m >= 0xd0 && m <= 0xd7:
+				return bytes.NewReader([]byte{0xff, m}), nil
+			}
+
+			seg := []byte{0xff, m, 0, 0}
+			if _, err := io.ReadFull(br, seg[2:]); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			n := int64(binary.BigEndian.Uint16(seg[2:])) - 2
+			if n < 0 {
+				return nil, errors.New("invalid jpeg segment length")
+			}
+			if jpegStripMarkers[m] {
+				if _, err := io.CopyN(ioutil.Discard, br, n); err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				continue
+			}
+			// start of scan, the image data follows the segment
+			scanning = m == 0xda
+			return io.MultiReader(bytes.NewReader(seg), &fullReader{r: br, n: n}), nil
+		}
+	}
+}
+
+// jpegMarker reads a marker, skipping any fill bytes. ff is true if its 0xff has already been read.
+func jpegMarker(br *bufio.Reader, ff bool) (byte, error) {
+	if !ff {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if b != 0xff {
+			return 0, errors.New("invalid jpeg marker")
+		}
+	}
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		if b != 0xff {
+			return b, nil
+		}
+	}
+}
+
+// pngStripChunks are the chunks with metadata, text chunks can hold XMP.
+var pngStripChunks = map[string]bool{"eXIf": true, "iCCP": true, "iTXt": true, "tEXt": true, "zTXt": true}
+
+// pngStripper returns the chunks of a PNG without metadata.
+func pngStripper(br *bufio.Reader) func() (io.Reader, error) {
+	started, done := false, false
+	return func() (io.Reader, error) {
+		switch {
+		case done:
+			return nil, io.EOF
+		case !started:
+			started = true
+			sig := make([]byte, 8)
+			if _, err := io.ReadFull(br, sig); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			if string(sig) != "\x89PNG\r\n\x1a\n" {
+				return nil, errors.New("invalid png signature")
+			}
+			return bytes.NewReader(sig), nil
+		}
+
+		for {
+			hdr := make([]byte, 8)
+			if _, err := io.ReadFull(br, hdr); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			n := int64(binary.BigEndian.Uint32(hdr))
+			if n > 1<<31-1 {
+				return nil, errors.New("invalid png chunk length")
+			}
+			typ := string(hdr[4:])
+			if pngStripChunks[typ] {
+				if _, err := io.CopyN(ioutil.Discard, br, n+4); err != nil {
+					return nil, unexpectedEOF(err)
+				}
+				continue
+			}
+			done = typ == "IEND"
+			// the chunk data and crc
+			return io.MultiReader(bytes.NewReader(hdr), &fullReader{r: br, n: n + 4}), nil
+		}
+	}
+}
+
+// webpStripChunks are the chunks with metadata.
+var webpStripChunks = map[string]bool{"EXIF": true, "XMP ": true, "ICCP": true}
+
+// webpVP8XMetadata are the VP8X flags for the metadata chunks, ICC, EXIF and XMP.
+const webpVP8XMetadata = 0x20 | 0x08 | 0x04
+
+// webpStripper returns the chunks of a WebP without metadata, and the VP8X chunk without the flags for them. The RIFF
+// header has the size of the whole file so it's read before anything is returned.
+func webpStripper(r io.Reader) func() (io.Reader, error) {
+	done := false
+	return func() (io.Reader, error) {
+		if done {
+			return nil, io.EOF
+		}
+		done = true
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+			return nil, errors.New("invalid webp header")
+		}
+		end := int64(binary.LittleEndian.Uint32(data[4:])) + 8
+		if end > int64(len(data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		// anything after the end of the image is left out
+		data = data[:end]
+
+		out := append([]byte{}, data[:12]...)
+		stripped := false
+		for rest := data[12:]; len(rest) > 0; {
+			if len(rest) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			typ := string(rest[:4])
+			n := int64(binary.LittleEndian.Uint32(rest[4:]))
+			if 8+n > int64(len(rest)) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			// chunks are padded to an even size, the last may not be
+			size := 8 + n + n&1
+			if size > int64(len(rest)) {
+				size = int64(len(rest))
+			}
+			if webpStripChunks[typ] {
+				stripped = true
+			} else {
+				out = append(out, rest[:size]...)
+			}
+			rest = rest[size:]
+		}
+
+		if stripped {
+			if len(out) >= 21 && string(out[12:16]) == "VP8X" {
+				out[20] &^= webpVP8XMetadata
+			}
+			binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+		}
+		return bytes.NewReader(out), nil
+	}
+}
+
+// fullReader reads n bytes from r, it's an io.ErrUnexpectedEOF error if r has fewer.
+type fullReader struct {
+	r io.Reader
+	n int64
+}
+
+func (f *fullReader) Read(p []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= int64(n)
+	if err == io.EOF {
+		err = nil
+		if f.n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF for io.EOF, data ending before the end of an image.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,358 @@
+package imagetransform
+
+import (
+	"context"
+	"image"
+	"math"
+	"strconv"
+
+	"github.com/j0hnsmith/progimage"
+	"github.com/pkg/errors"
+	"golang.org/x/image/draw"
+)
+
+// built in operations, see the individual functions for the args each takes
+func init() {
+	RegisterOperation("resize", newResize)
+	RegisterOperation("crop", newCrop)
+	RegisterOperation("rotate", newRotate)
+	RegisterOperation("flip", newFlip)
+	RegisterOperation("blur", newBlur)
+	RegisterOperation("grayscale", newGrayscale)
+}
+
+// newResize takes w, h and fit args, see Resize. With fit=cover, focus=smart sets Resize.Smart and fx and fy (fractions
+// of the width and height) set Resize.Focus.
+func newResize(args map[string]string) (Operation, error) {
+	var rs Resize
+	var err error
+	if rs.Width, err = intArg(args, "w", 0); err != nil {
+		return nil, err
+	}
+	if rs.Height, err = intArg(args, "h", 0); err != nil {
+		return nil, err
+	}
+	if rs.Fit, err = ParseFit(args["fit"]); err != nil {
+		return nil, err
+	}
+	if rs.IsZero() {
+		return nil, errors.New("w or h is required")
+	}
+	if err := rs.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch v := args["focus"]; v {
+	case "":
+	case "smart":
+		rs.Smart = true
+	default:
+		return nil, errors.Errorf("unsupported focus %q, must be smart", v)
+	}
+	_, fx := args["fx"]
+	_, fy := args["fy"]
+	if fx || fy {
+		f := progimage.Focus{}
+		if f.X, err = floatArg(args, "fx"); err != nil {
+			return nil, err
+		}
+		if f.Y, err = floatArg(args, "fy"); err != nil {
+			return nil, err
+		}
+		if !f.Valid() {
+			return nil, errors.New("fx and fy must be between 0 and 1")
+		}
+		rs.Focus = &f
+	}
+	if (rs.Smart || rs.Focus != nil) && (rs.Fit != FitCover || rs.Width == 0 || rs.Height == 0) {
+		return nil, errors.New("focus needs w, h and fit=cover")
+	}
+
+	return resizeOp{rs}, nil
+}
+
+// resizeOp is the resize operation, its work is the pixels read and written.
+type resizeOp struct {
+	Resize
+}
+
+func (r resizeOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	if w, h := r.Size(img.Bounds()); w > MaxDimension || h > MaxDimension {
+		return nil, &OperationError{
+			Op:  "resize",
+			Err: errors.Errorf("resized image %dx%d is larger than %dx%d", w, h, MaxDimension, MaxDimension),
+		}
+	}
+	return r.Resize.Apply(img), nil
+}
+
+func (r resizeOp) Cost(b image.Rectangle) int64 {
+	w, h := r.Size(b)
+	if w > MaxDimension || h > MaxDimension {
+		// Apply returns the error
+		return pixels(b)
+	}
+	return pixels(b) + int64(w)*int64(h)
+}
+
+// newCrop takes x, y, w and h args, the rectangle must be inside the image.
+func newCrop(args map[string]string) (Operation, error) {
+	var v [4]int
+	for i, k := range []string{"x", "y", "w", "h"} {
+		var err error
+		if v[i], err = intArg(args, k, -1); err != nil {
+			return nil, err
+		}
+		if v[i] < 0 {
+			return nil, errors.Errorf("%s is required", k)
+		}
+	}
+	if v[2] == 0 || v[3] == 0 {
+		return nil, errors.New("w and h must be greater than 0")
+	}
+
+	return OperationFunc(func(ctx context.Context, img image.Image) (image.Image, error) {
+		b := img.Bounds()
+		r := image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]).Add(b.Min)
+		if !r.In(b) {
+			return nil, &OperationError{
+				Op:  "crop",
+				Err: errors.Errorf("rectangle %v is outside image bounds %v", r.Sub(b.Min), b.Sub(b.Min)),
+			}
+		}
+		return copyRGBA(img, r), nil
+	}), nil
+}
+
+// newRotate takes a deg arg of 90, 180 or 270, rotation is clockwise.
+func newRotate(args map[string]string) (Operation, error) {
+	deg, err := intArg(args, "deg", 0)
+	if err != nil {
+		return nil, err
+	}
+	switch deg {
+	case 90, 180, 270:
+	default:
+		return nil, errors.New("deg must be one of 90, 180 or 270")
+	}
+
+	return OperationFunc(func(ctx context.Context, img image.Image) (image.Image, error) {
+		src := toRGBA(img)
+		w, h := src.Rect.Dx(), src.Rect.Dy()
+		dw, dh := w, h
+		if deg != 180 {
+			dw, dh = h, w
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+		for y := 0; y < h; y++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			row := src.Pix[y*src.Stride:]
+			for x := 0; x < w; x++ {
+				var dx, dy int
+				switch deg {
+				case 90:
+					dx, dy = h-1-y, x
+				case 180:
+					dx, dy = w-1-x, h-1-y
+				case 270:
+					dx, dy = y, w-1-x
+				}
+				copy(dst.Pix[dy*dst.Stride+4*dx:], row[4*x:4*x+4])
+			}
+		}
+		return dst, nil
+	}), nil
+}
+
+// newFlip takes a dir arg, h flips horizontally (mirror), v flips vertically.
+func newFlip(args map[string]string) (Operation, error) {
+	dir := args["dir"]
+	if dir != "h" && dir != "v" {
+		return nil, errors.New("dir must be h or v")
+	}
+
+	return OperationFunc(func(ctx context.Context, img image.Image) (image.Image, error) {
+		src := toRGBA(img)
+		w, h := src.Rect.Dx(), src.Rect.Dy()
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			row := src.Pix[y*src.Stride : y*src.Stride+4*w]
+			if dir == "v" {
+				copy(dst.Pix[(h-1-y)*dst.Stride:], row)
+				continue
+			}
+			drow := dst.Pix[y*dst.Stride:]
+			for x := 0; x < w; x++ {
+				copy(drow[4*(w-1-x):], row[4*x:4*x+4])
+			}
+		}
+		return dst, nil
+	}), nil
+}
+
+// maxBlurSigma limits the size of the blur kernel, a radius of 3 * sigma pixels.
+const maxBlurSigma = 10
+
+// newBlur takes a sigma arg, the standard deviation of a gaussian blur.
+func newBlur(args map[string]string) (Operation, error) {
+	sigma := 1.0
+	if v, ok := args["sigma"]; ok {
+		var err error
+		if sigma, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, errors.Errorf("invalid sigma %q", v)
+		}
+	}
+	if sigma <= 0 || sigma > maxBlurSigma {
+		return nil, errors.Errorf("sigma must be greater than 0 and no more than %d", maxBlurSigma)
+	}
+
+	// 1D gaussian kernel, applied horizontally then vertically
+	radius := int(math.Ceil(sigma * 3))
+	kernel := make([]float64, 2*radius+1)
+	var sum float64
+	for i := range kernel {
+		d := float64(i - radius)
+		kernel[i] = math.Exp(-d * d / (2 * sigma * sigma))
+		sum += kernel[i]
+	}
+	for i := range kernel {
+		kernel[i] /= sum
+	}
+	return blurOp(kernel), nil
+}
+
+// blurOp is the blur operation, a 1D gaussian kernel. Its work is every pixel once for each pixel of the kernel, in
+// both directions.
+type blurOp []float64
+
+func (k blurOp) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	h, err := convolve(ctx, toRGBA(img), k, true)
+	if err != nil {
+		return nil, err
+	}
+	return convolve(ctx, h, k, false)
+}
+
+func (k blurOp) Cost(b image.Rectangle) int64 {
+	return pixels(b) * 2 * int64(len(k))
+}
+
+// convolve applies a 1D kernel to img horizontally or vertically, edge pixels are extended. The colours are
+// premultiplied by alpha so transparent pixels don't add their colour.
+func convolve(ctx context.Context, img *image.RGBA, kernel []float64, horizontal bool) (*image.RGBA, error) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	radius := len(kernel) / 2
+	for y := 0; y < h; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		d := dst.Pix[y*dst.Stride:]
+		for x := 0; x < w; x++ {
+			var r, g, b, a float64
+			for i, k := range kernel {
+				sx, sy := x, y
+				if horizontal {
+					sx = clamp(x+i-radius, 0, w-1)
+				} else {
+					sy = clamp(y+i-radius, 0, h-1)
+				}
+				p := img.Pix[sy*img.Stride+4*sx:]
+				r += float64(p[0]) * k
+				g += float64(p[1]) * k
+				b += float64(p[2]) * k
+				a += float64(p[3]) * k
+			}
+			d[4*x], d[4*x+1], d[4*x+2], d[4*x+3] = round8(r), round8(g), round8(b), round8(a)
+		}
+	}
+	return dst, nil
+}
+
+// newGrayscale takes no args.
+func newGrayscale(args map[string]string) (Operation, error) {
+	return OperationFunc(func(ctx context.Context, img image.Image) (image.Image, error) {
+		src := toRGBA(img)
+		w, h := src.Rect.Dx(), src.Rect.Dy()
+		dst := image.NewGray(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			row := src.Pix[y*src.Stride:]
+			for x := 0; x < w; x++ {
+				// as color.GrayModel, with the 8 bit values scaled to 16 bits
+				r, g, b := uint32(row[4*x])*0x101, uint32(row[4*x+1])*0x101, uint32(row[4*x+2])*0x101
+				dst.Pix[y*dst.Stride+x] = uint8((19595*r + 38470*g + 7471*b + 1<<15) >> 24)
+			}
+		}
+		return dst, nil
+	}), nil
+}
+
+// toRGBA returns img as an *image.RGBA with bounds starting at 0, 0 so operations can work on its pixel data rather
+// than through At and Set, see copyRGBA.
+func toRGBA(img image.Image) *image.RGBA {
+	if m, ok := img.(*image.RGBA); ok && m.Rect.Min == (image.Point{}) {
+		return m
+	}
+	return copyRGBA(img, img.Bounds())
+}
+
+// copyRGBA returns a copy of the r part of img as an *image.RGBA with bounds starting at 0, 0. draw.Draw has fast
+// paths for the image types that decoders return (RGBA, NRGBA, YCbCr, Gray etc).
+func copyRGBA(img image.Image, r image.Rectangle) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+// pixels returns the number of pixels in b.
+func pixels(b image.Rectangle) int64 {
+	return int64(b.Dx()) * int64(b.Dy())
+}
+
+// intArg returns the named arg as an int, or def if it's not set.
+func intArg(args map[string]string, name string, def int) (int, error) {
+	v, ok := args[name]
+	if !ok {
+		return def, nil
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil || i < 0 {
+		return 0, errors.Errorf("invalid %s %q", name, v)
+	}
+	return i, nil
+}
+
+// floatArg returns the named arg, which is required, as a float.
+func floatArg(args map[string]string, name string) (float64, error) {
+	v, ok := args[name]
+	if !ok {
+		return 0, errors.Errorf("%s is required", name)
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid %s %q", name, v)
+	}
+	return f, nil
+}
+
+func clamp(v, min, max int) int {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
+
+func round8(v float64) uint8 {
+	return uint8(clamp(int(v+0.5), 0, 255))
+}
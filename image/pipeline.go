@@ -0,0 +1,324 @@
+package imagetransform
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/j0hnsmith/progimage"
+	"github.com/pkg/errors"
+)
+
+var _ progimage.ImagePipeline = Pipeline{}
+
+// Operation is a single step of a Pipeline, it's applied to a decoded image. It should stop with ctx.Err() once ctx
+// is done.
+type Operation interface {
+	Apply(ctx context.Context, img image.Image) (image.Image, error)
+}
+
+// OperationFunc allows a plain function to be used as an Operation.
+type OperationFunc func(context.Context, image.Image) (image.Image, error)
+
+// Apply calls f(ctx, img).
+func (f OperationFunc) Apply(ctx context.Context, img image.Image) (image.Image, error) {
+	return f(ctx, img)
+}
+
+// Coster is implemented by operations that know how much work applying them to an image with bounds b is, in pixels
+// processed, see Limits.MaxWork. Other operations are one per pixel.
+type Coster interface {
+	Cost(b image.Rectangle) int64
+}
+
+// cost returns the work of applying op to an image with bounds b.
+func cost(op Operation, b image.Rectangle) int64 {
+	if c, ok := op.(Coster); ok {
+		return c.Cost(b)
+	}
+	return pixels(b)
+}
+
+// MaxOperations is the most operations a Spec can have.
+const MaxOperations = 10
+
+// OperationFactory creates an Operation from its (unvalidated) arguments.
+type OperationFactory func(args map[string]string) (Operation, error)
+
+// OperationError is returned when an operation can't be created or applied with the given arguments.
+type OperationError struct {
+	Op  string
+	Err error
+}
+
+func (e *OperationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Err)
+}
+
+// Is reports whether target is progimage.ErrInvalidTransform, which all operation errors are.
+func (e *OperationError) Is(target error) bool {
+	return target == progimage.ErrInvalidTransform
+}
+
+var (
+	operationsMu sync.RWMutex
+	operations   = map[string]OperationFactory{}
+)
+
+// RegisterOperation makes an operation available by name to Spec.Operations. It panics if the name is already
+// registered.
+func RegisterOperation(name string, f OperationFactory) {
+	operationsMu.Lock()
+	defer operationsMu.Unlock()
+	if _, ok := operations[name]; ok {
+		panic("imagetransform: operation registered twice " + name)
+	}
+	operations[name] = f
+}
+
+// OperationSpec describes a single operation by name.
+type OperationSpec struct {
+	Name string
+	Args map[string]string
+}
+
+// String returns the operation in spec format with the args sorted, eg `resize:fit=cover,h=150,w=200`.
+func (o OperationSpec) String() string {
+	if len(o.Args) == 0 {
+		return o.Name
+	}
+	keys := make([]string, 0, len(o.Args))
+	for k := range o.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	args := make([]string, len(keys))
+	for i, k := range keys {
+		args[i] = k + "=" + o.Args[k]
+	}
+	return o.Name + ":" + strings.Join(args, ",")
+}
+
+// Spec is a declarative description of the operations in a pipeline, in order.
+type Spec []OperationSpec
+
+// ParseSpec parses a spec of the form `name:key=value,key=value|name|...`, eg `resize:w=200,h=150|grayscale`.
+func ParseSpec(s string) (Spec, error) {
+	var spec Spec
+	if s == "" {
+		return spec, nil
+	}
+	for _, op := range strings.Split(s, "|") {
+		name, rawArgs := op, ""
+		if i := strings.Index(op, ":"); i >= 0 {
+			name, rawArgs = op[:i], op[i+1:]
+		}
+		if name == "" {
+			return nil, &progimage.Error{
+				Kind:   progimage.ErrInvalidTransform,
+				Detail: fmt.Sprintf("missing operation name in %q", op),
+			}
+		}
+
+		o := OperationSpec{Name: name, Args: map[string]string{}}
+		if rawArgs != "" {
+			for _, arg := range strings.Split(rawArgs, ",") {
+				kv := strings.SplitN(arg, "=", 2)
+				if len(kv) != 2 || kv[0] == "" {
+					return nil, &progimage.Error{
+						Kind:   progimage.ErrInvalidTransform,
+						Detail: fmt.Sprintf("invalid argument %q for operation %s", arg, name),
+					}
+				}
+				o.Args[kv[0]] = kv[1]
+			}
+		}
+		spec = append(spec, o)
+	}
+	return spec, nil
+}
+
+// String returns the spec in a canonical form, equal specs give equal strings.
+func (s Spec) String() string {
+	ops := make([]string, len(s))
+	for i, o := range s {
+		ops[i] = o.String()
+	}
+	return strings.Join(ops, "|")
+}
+
+// focusKeeping are the operations that keep every point in the same place relative to the size of the image.
+var focusKeeping = map[string]bool{"blur": true, "grayscale": true}
+
+// WithFocus returns a copy of s with the fx and fy args of its first cover resize set to the focal point f, so it
+// crops around it, unless the resize already has them. Resizes that aren't cover keep points in the same place, any
+// other operation before it (eg a crop) could move f so the spec is returned as is.
+func (s Spec) WithFocus(f progimage.Focus) Spec {
+	for i, o := range s {
+		if focusKeeping[o.Name] || o.Name == "resize" && o.Args["fit"] != string(FitCover) {
+			continue
+		}
+		if _, ok := o.Args["fx"]; o.Name != "resize" || ok {
+			return s
+		}
+
+		args := map[string]string{}
+		for k, v := range o.Args {
+			args[k] = v
+		}
+		args["fx"] = strconv.FormatFloat(f.X, 'f', -1, 64)
+		args["fy"] = strconv.FormatFloat(f.Y, 'f', -1, 64)
+		focused := append(Spec{}, s...)
+		focused[i] = OperationSpec{Name: o.Name, Args: args}
+		return focused
+	}
+	return s
+}
+
+// Operations creates the registered operations described by the spec, there can be up to MaxOperations.
+func (s Spec) Operations() ([]Operation, error) {
+	if len(s) > MaxOperations {
+		return nil, &progimage.Error{
+			Kind:   progimage.ErrInvalidTransform,
+			Detail: fmt.Sprintf("%d operations is more than %d", len(s), MaxOperations),
+		}
+	}
+
+	operationsMu.RLock()
+	defer operationsMu.RUnlock()
+
+	ops := make([]Operation, 0, len(s))
+	for _, o := range s {
+		f, ok := operations[o.Name]
+		if !ok {
+			return nil, &OperationError{Op: o.Name, Err: errors.New("unknown operation")}
+		}
+		op, err := f(o.Args)
+		if err != nil {
+			return nil, &OperationError{Op: o.Name, Err: err}
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// Pipeline decodes an image, applies each of the Operations in order then encodes the result using Transformer with
+// Options. Images larger than Limits (DefaultLimits if zero) aren't decoded. JPEGs are rotated and flipped upright
+// using their EXIF orientation before the operations, encoded images have no metadata. Operations that would do
+// more than Limits.MaxWork are an ErrInvalidTransform error.
+//
+// An image that doesn't need to be encoded is returned as is, unless StripMetadata is set. Then its metadata is
+// removed (see StripMetadata), or if that isn't possible or it isn't upright, it's encoded.
+type Pipeline struct {
+	Operations    []Operation
+	Transformer   Transformer
+	Options       EncodeOptions
+	Limits        Limits
+	StripMetadata bool
+}
+
+// NewPipeline creates a Pipeline from a spec that encodes using t.
+func NewPipeline(spec Spec, t Transformer) (Pipeline, error) {
+	ops, err := spec.Operations()
+	if err != nil {
+		return Pipeline{}, err
+	}
+	return Pipeline{Operations: ops, Transformer: t}, nil
+}
+
+// Run the pipeline on img. Decoding and the operations happen before Run returns, encoding happens as the returned
+// image data is read, any encoding error is returned from Read. Operations aren't started and encoding stops once
+// ctx is done.
+func (p Pipeline) Run(ctx context.Context, img progimage.Image) (progimage.Image, error) {
+	passthrough := img.ContentType == p.Transformer.ContentType && len(p.Operations) == 0 &&
+		p.Options == (EncodeOptions{})
+	if passthrough && !p.StripMetadata {
+		return img, nil
+	}
+	ret := progimage.Image{}
+	data, exif := readEXIF(img.Data)
+	if passthrough && (exif == nil || exif.Orientation <= 1) {
+		if stripped, ok := StripMetadata(data, img.ContentType); ok {
+			img.Data = stripped
+			return img, nil
+		}
+	}
+
+	i, err := p.Limits.Decode(data)
+	if err != nil {
+		return ret, err
+	}
+	if i, err = orient(ctx, i, exif); err != nil {
+		return ret, err
+	}
+
+	maxWork := p.Limits.orDefault().MaxWork
+	var work int64
+	for _, op := range p.Operations {
+		if err := ctx.Err(); err != nil {
+			return ret, err
+		}
+		if work += cost(op, i.Bounds()); maxWork > 0 && work > maxWork {
+			return ret, &progimage.Error{
+				Kind:   progimage.ErrInvalidTransform,
+				Detail: fmt.Sprintf("operations need more than %d pixels of work", maxWork),
+			}
+		}
+		if i, err = op.Apply(ctx, i); err != nil {
+			return ret, err
+		}
+	}
+
+	ret.ID = img.ID
+	ret.ContentType = p.Transformer.ContentType
+	ret.Data, _ = encodePipe(ctx, p.Transformer, i, p.Options)
+	return ret, nil
+}
+
+// encodePipe encodes i with t using opts as the returned reader is read, the encoding error is also sent on the
+// returned (buffered) channel. When ctx is done the reader is closed with ctx.Err() so the encoder stops, even if
+// nothing is reading.
+func encodePipe(ctx context.Context, t Transformer, i image.Image, opts EncodeOptions) (io.Reader, <-chan error) {
+	r, w := io.Pipe()
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.CloseWithError(ctx.Err()) // nolint: errcheck,gas
+		case <-done:
+		}
+	}()
+
+	go func() {
+		defer close(done)
+		err := t.Encoder(w, i, opts)
+		if err != nil {
+			err = errors.Wrap(err, fmt.Sprintf("unable to encode %s image", t.Name))
+		}
+		w.CloseWithError(err) // nolint: errcheck,gas
+		errc <- err
+	}()
+
+	return ctxReader{ctx, r}, errc
+}
+
+// ctxReader fails reads with ctx.Err() once ctx is done. The pipe is closed by another goroutine, so without it a read
+// could still return data that had already been encoded.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -0,0 +1,399 @@
+package imagetransform_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
+)
+
+var pngTransformer = primage.Transformer{
+	Name:        "png",
+	ContentType: "image/png",
+	Encoder: func(w io.Writer, m image.Image, opts primage.EncodeOptions) error {
+		return png.Encode(w, m)
+	},
+}
+
+func TestParseSpec(t *testing.T) {
+	spec, err := primage.ParseSpec("resize:w=200,h=150,fit=cover|grayscale|rotate:deg=90")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spec) != 3 {
+		t.Fatalf("expected 3 operations, got %d", len(spec))
+	}
+	if spec[0].Name != "resize" || spec[0].Args["w"] != "200" || spec[0].Args["fit"] != "cover" {
+		t.Errorf("unexpected resize operation %+v", spec[0])
+	}
+
+	expected := "resize:fit=cover,h=150,w=200|grayscale|rotate:deg=90"
+	if spec.String() != expected {
+		t.Errorf("expected canonical spec %s, got %s", expected, spec.String())
+	}
+
+	for _, s := range []string{":w=1", "resize:w", "resize:=1", "resize:w=1,"} {
+		if _, err := primage.ParseSpec(s); progimage.KindOf(err) != progimage.ErrInvalidTransform {
+			t.Errorf("expected ErrInvalidTransform parsing %q, got %v", s, err)
+		}
+	}
+}
+
+func TestSpec_Operations(t *testing.T) {
+	var specTests = []struct {
+		Spec  string
+		Valid bool
+	}{
+		{Spec: "resize:w=10", Valid: true},
+		{Spec: "resize", Valid: false},
+		{Spec: "resize:w=10,h=10,fit=cover,focus=smart", Valid: true},
+		{Spec: "resize:w=10,h=10,fit=cover,fx=0,fy=1", Valid: true},
+		{Spec: "resize:w=10,h=10,fit=cover,focus=faces", Valid: false},
+		{Spec: "resize:w=10,h=10,focus=smart", Valid: false},
+		{Spec: "resize:w=10,fit=cover,focus=smart", Valid: false},
+		{Spec: "resize:w=10,h=10,fit=cover,fx=0.5", Valid: false},
+		{Spec: "resize:w=10,h=10,fit=cover,fx=1.1,fy=0", Valid: false},
+		{Spec: "resize:w=10,h=10,fit=cover,fx=NaN,fy=0", Valid: false},
+		{Spec: "crop:x=0,y=0,w=10,h=10", Valid: true},
+		{Spec: "crop:x=0,y=0,w=10", Valid: false},
+		{Spec: "rotate:deg=90", Valid: true},
+		{Spec: "rotate:deg=45", Valid: false},
+		{Spec: "flip:dir=v", Valid: true},
+		{Spec: "flip:dir=x", Valid: false},
+		{Spec: "blur:sigma=1.5", Valid: true},
+		{Spec: "blur:sigma=0", Valid: false},
+		{Spec: "blur:sigma=10", Valid: true},
+		{Spec: "blur:sigma=10.5", Valid: false},
+		{Spec: "grayscale", Valid: true},
+		{Spec: "sharpen", Valid: false},
+	}
+
+	for _, item := range specTests {
+		t.Run(item.Spec, func(t *testing.T) {
+			spec, err := primage.ParseSpec(item.Spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = spec.Operations()
+			if item.Valid && err != nil {
+				t.Errorf("expected no error, got %s", err)
+			}
+			if !item.Valid {
+				if _, ok := err.(*primage.OperationError); !ok {
+					t.Errorf("expected *OperationError, got %v", err)
+				}
+				if progimage.KindOf(err) != progimage.ErrInvalidTransform {
+					t.Errorf("expected ErrInvalidTransform, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestSpec_OperationsTooMany(t *testing.T) {
+	spec, err := primage.ParseSpec(strings.Repeat("grayscale|", primage.MaxOperations) + "grayscale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := spec.Operations(); progimage.KindOf(err) != progimage.ErrInvalidTransform {
+		t.Errorf("expected ErrInvalidTransform, got %v", err)
+	}
+	if _, err := spec[1:].Operations(); err != nil {
+		t.Errorf("expected no error for %d operations, got %s", primage.MaxOperations, err)
+	}
+}
+
+func TestSpec_WithFocus(t *testing.T) {
+	focus := progimage.Focus{X: 0.25, Y: 0.5}
+	var focusTests = []struct {
+		Spec     string
+		Expected string
+	}{
+		{Spec: "resize:w=10,h=10,fit=cover", Expected: "resize:fit=cover,fx=0.25,fy=0.5,h=10,w=10"},
+		{
+			Spec:     "grayscale|resize:w=100|resize:w=10,h=10,fit=cover,focus=smart|resize:w=5,h=5,fit=cover",
+			Expected: "grayscale|resize:w=100|resize:fit=cover,focus=smart,fx=0.25,fy=0.5,h=10,w=10|resize:fit=cover,h=5,w=5",
+		},
+		{Spec: "resize:w=10,h=10,fit=cover,fx=1,fy=1", Expected: "resize:fit=cover,fx=1,fy=1,h=10,w=10"},
+		{Spec: "resize:w=10,h=10", Expected: "resize:h=10,w=10"},
+		{
+			Spec:     "crop:x=0,y=0,w=10,h=10|resize:w=10,h=10,fit=cover",
+			Expected: "crop:h=10,w=10,x=0,y=0|resize:fit=cover,h=10,w=10",
+		},
+		{Spec: "rotate:deg=90|resize:w=10,h=10,fit=cover", Expected: "rotate:deg=90|resize:fit=cover,h=10,w=10"},
+		{Spec: "", Expected: ""},
+	}
+
+	for _, item := range focusTests {
+		t.Run(item.Spec, func(t *testing.T) {
+			spec, err := primage.ParseSpec(item.Spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := spec.String()
+
+			if s := spec.WithFocus(focus).String(); s != item.Expected {
+				t.Errorf("expected %s, got %s", item.Expected, s)
+			}
+			if spec.String() != before {
+				t.Errorf("expected the spec to be unchanged, got %s", spec.String())
+			}
+		})
+	}
+}
+
+// testImage returns a png of the given size, the top left pixel is red, everything else is white.
+func testImage(t *testing.T, w, h int) progimage.Image {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.Set(x, y, color.White)
+		}
+	}
+	m.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	buf := new(bytes.Buffer)
+	if err := png.Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	return progimage.Image{ID: "test", ContentType: "image/png", Data: buf}
+}
+
+func TestPipeline_Run(t *testing.T) {
+	red := color.RGBA{R: 255, A: 255}
+
+	var pipelineTests = []struct {
+		Spec   string
+		Width  int
+		Height int
+		Red    image.Point // location of the red pixel after transforming, negative to skip the check
+	}{
+		{Spec: "", Width: 40, Height: 20, Red: image.Pt(0, 0)},
+		{Spec: "crop:x=0,y=0,w=10,h=5", Width: 10, Height: 5, Red: image.Pt(0, 0)},
+		{Spec: "rotate:deg=90", Width: 20, Height: 40, Red: image.Pt(19, 0)},
+		{Spec: "rotate:deg=180", Width: 40, Height: 20, Red: image.Pt(39, 19)},
+		{Spec: "rotate:deg=270", Width: 20, Height: 40, Red: image.Pt(0, 39)},
+		{Spec: "flip:dir=h", Width: 40, Height: 20, Red: image.Pt(39, 0)},
+		{Spec: "flip:dir=v", Width: 40, Height: 20, Red: image.Pt(0, 19)},
+		{Spec: "rotate:deg=90|flip:dir=h", Width: 20, Height: 40, Red: image.Pt(0, 0)},
+		{Spec: "resize:w=20", Width: 20, Height: 10, Red: image.Pt(-1, -1)},
+		{Spec: "grayscale", Width: 40, Height: 20, Red: image.Pt(-1, -1)},
+		{Spec: "blur:sigma=2", Width: 40, Height: 20, Red: image.Pt(-1, -1)},
+	}
+
+	for _, item := range pipelineTests {
+		t.Run(item.Spec, func(t *testing.T) {
+			spec, err := primage.ParseSpec(item.Spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := primage.NewPipeline(spec, pngTransformer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// ensure image is decoded, not passed through
+			img := testImage(t, 40, 20)
+			img.ContentType = "image/x-test"
+
+			imgOut, err := p.Run(context.Background(), img)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if imgOut.ContentType != "image/png" {
+				t.Errorf("expected content type image/png, got %s", imgOut.ContentType)
+			}
+
+			m, err := png.Decode(imgOut.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b := m.Bounds(); b.Dx() != item.Width || b.Dy() != item.Height {
+				t.Errorf("expected %dx%d, got %dx%d", item.Width, item.Height, b.Dx(), b.Dy())
+			}
+			if item.Red.X >= 0 {
+				r, g, b, a := m.At(item.Red.X, item.Red.Y).RGBA()
+				er, eg, eb, ea := red.RGBA()
+				if r != er || g != eg || b != eb || a != ea {
+					t.Errorf("expected red pixel at %v", item.Red)
+				}
+			}
+		})
+	}
+}
+
+func TestPipeline_RunCropOutOfBounds(t *testing.T) {
+	spec, err := primage.ParseSpec("crop:x=30,y=0,w=20,h=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := primage.NewPipeline(spec, pngTransformer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Run(context.Background(), testImage(t, 40, 20)); err == nil {
+		t.Error("expected error cropping outside of image bounds")
+	} else if _, ok := err.(*primage.OperationError); !ok {
+		t.Errorf("expected *OperationError, got %v", err)
+	}
+}
+
+// TestPipeline_RunResizeTooLarge checks a resize with one side given isn't allocated if the other side (from the
+// aspect ratio) is larger than MaxDimension.
+func TestPipeline_RunResizeTooLarge(t *testing.T) {
+	var resizeTests = []struct {
+		Spec   string
+		Width  int
+		Height int
+	}{
+		{Spec: "resize:w=5000", Width: 10, Height: 100},
+		{Spec: "resize:h=5000", Width: 100, Height: 10},
+		{Spec: "resize:w=5000", Width: 10, Height: 16000},
+	}
+
+	for _, item := range resizeTests {
+		t.Run(fmt.Sprintf("%s %dx%d", item.Spec, item.Width, item.Height), func(t *testing.T) {
+			spec, err := primage.ParseSpec(item.Spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, err := primage.NewPipeline(spec, pngTransformer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = p.Run(context.Background(), testImage(t, item.Width, item.Height))
+			if _, ok := err.(*primage.OperationError); !ok {
+				t.Errorf("expected *OperationError, got %v", err)
+			}
+			if progimage.KindOf(err) != progimage.ErrInvalidTransform {
+				t.Errorf("expected ErrInvalidTransform, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPipeline_RunTooMuchWork(t *testing.T) {
+	spec, err := primage.ParseSpec("blur:sigma=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := primage.NewPipeline(spec, pngTransformer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a 100x100 image is 10000 pixels, blurred with a 61 pixel kernel in both directions
+	p.Limits = primage.Limits{MaxWork: 1000000}
+	_, err = p.Run(context.Background(), testImage(t, 100, 100))
+	if progimage.KindOf(err) != progimage.ErrInvalidTransform {
+		t.Errorf("expected ErrInvalidTransform, got %v", err)
+	}
+	p.Limits = primage.Limits{MaxWork: 2000000}
+	if _, err := p.Run(context.Background(), testImage(t, 100, 100)); err != nil {
+		t.Errorf("expected no error, got %s", err)
+	}
+}
+
+// TestOperation_ApplyCancelled checks operations stop once ctx is done, not only between operations.
+func TestOperation_ApplyCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+
+	for _, s := range []string{"rotate:deg=90", "flip:dir=h", "blur:sigma=1", "grayscale"} {
+		t.Run(s, func(t *testing.T) {
+			spec, err := primage.ParseSpec(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ops, err := spec.Operations()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ops[0].Apply(ctx, src); err != context.Canceled {
+				t.Errorf("expected context.Canceled, got %v", err)
+			}
+		})
+	}
+}
+
+func TestPipeline_RunPassthrough(t *testing.T) {
+	img := testImage(t, 10, 10)
+	data := img.Data.(*bytes.Buffer).Bytes()
+
+	imgOut, err := primage.Pipeline{Transformer: pngTransformer}.Run(context.Background(), img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(imgOut.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, out) {
+		t.Error("expected image data to be unchanged")
+	}
+}
+
+func TestPipeline_RunCancelled(t *testing.T) {
+	spec, err := primage.ParseSpec("grayscale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := primage.NewPipeline(spec, pngTransformer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.Run(ctx, testImage(t, 10, 10)); err != context.Canceled {
+		t.Errorf("expected context.Canceled before operations, got %v", err)
+	}
+
+	// cancelled after Run returns, encoding stops before all the data is read
+	ctx, cancel = context.WithCancel(context.Background())
+	imgOut, err := p.Run(ctx, testImage(t, 1000, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := ioutil.ReadAll(imgOut.Data); err == nil {
+		t.Error("expected error reading data after cancel")
+	}
+}
+
+func TestPipeline_RunOptions(t *testing.T) {
+	var got primage.EncodeOptions
+	tr := primage.Transformer{
+		Name:        "png",
+		ContentType: "image/png",
+		Encoder: func(w io.Writer, m image.Image, opts primage.EncodeOptions) error {
+			got = opts
+			return png.Encode(w, m)
+		},
+	}
+
+	// same format without operations is still encoded when there are options
+	opts := primage.EncodeOptions{Compression: primage.CompressionBest}
+	imgOut, err := primage.Pipeline{Transformer: tr, Options: opts}.Run(context.Background(), testImage(t, 10, 10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(imgOut.Data); err != nil {
+		t.Fatal(err)
+	}
+	if got != opts {
+		t.Errorf("expected encoder options %+v, got %+v", opts, got)
+	}
+}
@@ -1,16 +1,38 @@
 package png
 
 import (
+	"image"
 	_ "image/gif"  // register image type, do not remove
 	_ "image/jpeg" // register image type, do not remove
 	"image/png"
+	"io"
 
 	primage "github.com/j0hnsmith/progimage/image"
+	"github.com/pkg/errors"
+	_ "golang.org/x/image/webp" // register image type, do not remove
 )
 
 // Transformer implements progimage.ImageTypeTransformer to convert a progimage.Image to png format.
 var Transformer = primage.Transformer{
 	Name:        "png",
 	ContentType: "image/png",
-	Encoder:     png.Encode,
+	Encoder:     Encode,
+}
+
+var compressionLevels = map[string]png.CompressionLevel{
+	"":                         png.DefaultCompression,
+	primage.CompressionDefault: png.DefaultCompression,
+	primage.CompressionBest:    png.BestCompression,
+	primage.CompressionFast:    png.BestSpeed,
+	primage.CompressionNone:    png.NoCompression,
+}
+
+// Encode performs png encoding, opts.Compression sets the compression level.
+func Encode(w io.Writer, m image.Image, opts primage.EncodeOptions) error {
+	level, ok := compressionLevels[opts.Compression]
+	if !ok {
+		return errors.Errorf("unknown png compression %q", opts.Compression)
+	}
+	enc := png.Encoder{CompressionLevel: level}
+	return enc.Encode(w, m)
 }
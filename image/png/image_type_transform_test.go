@@ -1,6 +1,7 @@
 package png_test
 
 import (
+	"context"
 	"image"
 	"os"
 	"testing"
@@ -35,7 +36,7 @@ func TestTransformPNG(t *testing.T) {
 			}
 
 			errCh := make(chan error, 1)
-			imgOut, err := png.Transformer.Transform(img, errCh)
+			imgOut, err := png.Transformer.Transform(context.Background(), img, errCh)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -71,7 +72,7 @@ func BenchmarkTransformToPNG(b *testing.B) {
 				}
 
 				errCh := make(chan error, 1)
-				imgOut, err := png.Transformer.Transform(img, errCh)
+				imgOut, err := png.Transformer.Transform(context.Background(), img, errCh)
 				if err != nil {
 					b.Fatal(err)
 				}
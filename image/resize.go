@@ -0,0 +1,147 @@
+package imagetransform
+
+import (
+	"image"
+
+	"github.com/j0hnsmith/progimage"
+	"github.com/pkg/errors"
+	"golang.org/x/image/draw"
+)
+
+// MaxDimension is the largest width or height an image can be resized to.
+const MaxDimension = 5000
+
+// Fit controls how an image is resized when both a width and height are given.
+type Fit string
+
+// Supported Fit values.
+const (
+	// FitContain scales the image to fit inside the box, preserving the aspect ratio.
+	FitContain Fit = "contain"
+	// FitCover scales the image to fill the box, preserving the aspect ratio, then crops the overflow, see
+	// Resize.Focus.
+	FitCover Fit = "cover"
+	// FitFill stretches the image to exactly fill the box.
+	FitFill Fit = "fill"
+)
+
+// ParseFit returns the Fit for the given string, an empty string gives FitContain.
+func ParseFit(s string) (Fit, error) {
+	switch f := Fit(s); f {
+	case "":
+		return FitContain, nil
+	case FitContain, FitCover, FitFill:
+		return f, nil
+	}
+	return "", errors.Errorf("unsupported fit %q", s)
+}
+
+// Resize describes the target dimensions of an image, a zero Width or Height is calculated from the aspect ratio.
+type Resize struct {
+	Width  int
+	Height int
+	Fit    Fit
+
+	// Focus is the point FitCover keeps in view, as near to the centre of the box as it can be. If it's nil the
+	// centre of the image is kept, unless Smart is set, then the part chosen by smartCrop is.
+	Focus *progimage.Focus
+	Smart bool
+}
+
+// IsZero reports whether r doesn't resize at all.
+func (r Resize) IsZero() bool {
+	return r.Width == 0 && r.Height == 0
+}
+
+// Validate checks the dimensions are within range.
+func (r Resize) Validate() error {
+	if r.Width < 0 || r.Height < 0 {
+		return errors.New("width and height must be positive")
+	}
+	if r.Width > MaxDimension || r.Height > MaxDimension {
+		return errors.Errorf("width and height must be no more than %d", MaxDimension)
+	}
+	return nil
+}
+
+// Apply resamples img to the dimensions described by r.
+func (r Resize) Apply(img image.Image) image.Image {
+	if r.IsZero() {
+		return img
+	}
+
+	src := img.Bounds()
+	sw, sh := src.Dx(), src.Dy()
+	if sw == 0 || sh == 0 {
+		return img
+	}
+
+	w, h := r.Size(src)
+	if r.Fit == FitCover && r.Width != 0 && r.Height != 0 {
+		// crop the source to the aspect ratio of the box then scale
+		cw, ch := sw, sh
+		if sw*h > sh*w {
+			cw = scale(w, sh, h)
+		} else {
+			ch = scale(h, sw, w)
+		}
+		src = r.coverCrop(img, src, cw, ch)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
+
+// Size returns the dimensions of an image with bounds b once it's resized. A Width or Height given alone has the other
+// side calculated from the aspect ratio, so it can be larger than MaxDimension.
+func (r Resize) Size(b image.Rectangle) (w, h int) {
+	sw, sh := b.Dx(), b.Dy()
+	if r.IsZero() || sw == 0 || sh == 0 {
+		return sw, sh
+	}
+
+	w, h = r.Width, r.Height
+	switch {
+	case w == 0:
+		w = scale(sw, h, sh)
+	case h == 0:
+		h = scale(sh, w, sw)
+	case r.Fit == FitFill || r.Fit == FitCover:
+		// the box as is, cover crops the source to fit it
+	default:
+		// contain, shrink whichever side overflows the box
+		if sw*h > sh*w {
+			h = scale(sh, w, sw)
+		} else {
+			w = scale(sw, h, sh)
+		}
+	}
+	return w, h
+}
+
+// coverCrop returns the cw x ch rectangle of src kept by FitCover, see Focus.
+func (r Resize) coverCrop(img image.Image, src image.Rectangle, cw, ch int) image.Rectangle {
+	if r.Focus == nil && r.Smart {
+		return smartCrop(img, src, cw, ch)
+	}
+	x, y := (src.Dx()-cw)/2, (src.Dy()-ch)/2
+	if r.Focus != nil {
+		x, y = around(r.Focus.X, src.Dx(), cw), around(r.Focus.Y, src.Dy(), ch)
+	}
+	return image.Rect(src.Min.X+x, src.Min.Y+y, src.Min.X+x+cw, src.Min.Y+y+ch)
+}
+
+// around returns the offset of size pixels centred on the fraction f of n pixels, kept within them.
+func around(f float64, n, size int) int {
+	return clamp(int(f*float64(n)+0.5)-size/2, 0, n-size)
+}
+
+// scale returns n*num/den rounded to the nearest integer, never less than 1.
+func scale(n, num, den int) int {
+	v := (n*num + den/2) / den
+	if v < 1 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,154 @@
+package imagetransform_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"math/rand"
+	"testing"
+
+	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
+)
+
+func TestResize_Apply(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 400, 200))
+
+	var resizeTests = []struct {
+		Name   string
+		Resize primage.Resize
+		Width  int
+		Height int
+	}{
+		{Name: "zero", Resize: primage.Resize{}, Width: 400, Height: 200},
+		{Name: "width only", Resize: primage.Resize{Width: 100}, Width: 100, Height: 50},
+		{Name: "height only", Resize: primage.Resize{Height: 100}, Width: 200, Height: 100},
+		{Name: "contain", Resize: primage.Resize{Width: 100, Height: 100, Fit: primage.FitContain}, Width: 100, Height: 50},
+		{Name: "cover", Resize: primage.Resize{Width: 100, Height: 100, Fit: primage.FitCover}, Width: 100, Height: 100},
+		{Name: "fill", Resize: primage.Resize{Width: 100, Height: 30, Fit: primage.FitFill}, Width: 100, Height: 30},
+		{Name: "tiny", Resize: primage.Resize{Width: 1}, Width: 1, Height: 1},
+	}
+
+	for _, item := range resizeTests {
+		t.Run(item.Name, func(t *testing.T) {
+			b := item.Resize.Apply(src).Bounds()
+			if b.Dx() != item.Width || b.Dy() != item.Height {
+				t.Errorf("expected %dx%d, got %dx%d", item.Width, item.Height, b.Dx(), b.Dy())
+			}
+		})
+	}
+}
+
+func TestResize_Size(t *testing.T) {
+	src := image.Rect(0, 0, 400, 200)
+	var sizeTests = []struct {
+		Name   string
+		Resize primage.Resize
+		Src    image.Rectangle
+		Width  int
+		Height int
+	}{
+		{Name: "zero", Resize: primage.Resize{}, Src: src, Width: 400, Height: 200},
+		{Name: "contain", Resize: primage.Resize{Width: 100, Height: 100}, Src: src, Width: 100, Height: 50},
+		{
+			Name:   "cover",
+			Resize: primage.Resize{Width: 100, Height: 100, Fit: primage.FitCover},
+			Src:    src, Width: 100, Height: 100,
+		},
+		// one side from the aspect ratio, larger than MaxDimension
+		{Name: "tall", Resize: primage.Resize{Width: 5000}, Src: image.Rect(0, 0, 10, 100), Width: 5000, Height: 50000},
+		{Name: "wide", Resize: primage.Resize{Height: 5000}, Src: image.Rect(0, 0, 16000, 10), Width: 8000000, Height: 5000},
+	}
+
+	for _, item := range sizeTests {
+		t.Run(item.Name, func(t *testing.T) {
+			if w, h := item.Resize.Size(item.Src); w != item.Width || h != item.Height {
+				t.Errorf("expected %dx%d, got %dx%d", item.Width, item.Height, w, h)
+			}
+		})
+	}
+}
+
+func TestParseFit(t *testing.T) {
+	if f, err := primage.ParseFit(""); err != nil || f != primage.FitContain {
+		t.Errorf("expected default fit to be contain, got %q (%v)", f, err)
+	}
+	if _, err := primage.ParseFit("stretch"); err == nil {
+		t.Error("expected error for unsupported fit")
+	}
+}
+
+// subjectImage returns a w x h gray image with a subject, a patch of skin coloured noise, in the size x size square at
+// x, y. Cropped to a square and resized to 50x50, the subject is 25x25 if it's in the crop.
+func subjectImage(w, h, x, y, size int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(m, m.Bounds(), image.NewUniform(color.RGBA{R: 128, G: 128, B: 128, A: 255}), image.Point{}, draw.Src)
+	rnd := rand.New(rand.NewSource(1))
+	for py := y; py < y+size; py++ {
+		for px := x; px < x+size; px++ {
+			v := uint8(rnd.Intn(40))
+			m.Set(px, py, color.RGBA{R: 200 + v, G: 140 + v, B: 110 + v, A: 255})
+		}
+	}
+	return m
+}
+
+// hasSubject reports whether all of the subject of a subjectImage is in img, a quarter of the image.
+func hasSubject(img image.Image) bool {
+	b := img.Bounds()
+	n := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			if r>>8 > 180 && r > g && g > bl {
+				n++
+			}
+		}
+	}
+	// allow for resampling the edges
+	return n > b.Dx()*b.Dy()/5
+}
+
+func TestResize_ApplyFocus(t *testing.T) {
+	var focusTests = []struct {
+		Name    string
+		Src     *image.RGBA
+		Focus   *progimage.Focus
+		Smart   bool
+		Subject bool
+	}{
+		{Name: "centre", Src: subjectImage(300, 100, 240, 20, 50)},
+		{Name: "focus", Src: subjectImage(300, 100, 240, 20, 50), Focus: &progimage.Focus{X: 0.85, Y: 0.5}, Subject: true},
+		{Name: "focus edge", Src: subjectImage(300, 100, 240, 20, 50), Focus: &progimage.Focus{X: 1, Y: 0}, Subject: true},
+		{Name: "smart", Src: subjectImage(300, 100, 240, 20, 50), Smart: true, Subject: true},
+		{Name: "smart left", Src: subjectImage(300, 100, 10, 20, 50), Smart: true, Subject: true},
+		{Name: "smart tall", Src: subjectImage(100, 400, 20, 10, 50), Smart: true, Subject: true},
+		{Name: "smart large", Src: subjectImage(3000, 1000, 2400, 200, 500), Smart: true, Subject: true},
+		// a focus is chosen over the content
+		{Name: "focus not smart", Src: subjectImage(300, 100, 240, 20, 50), Focus: &progimage.Focus{X: 0, Y: 0}, Smart: true},
+	}
+
+	for _, item := range focusTests {
+		t.Run(item.Name, func(t *testing.T) {
+			rs := primage.Resize{Width: 50, Height: 50, Fit: primage.FitCover, Focus: item.Focus, Smart: item.Smart}
+			dst := rs.Apply(item.Src)
+			if b := dst.Bounds(); b.Dx() != 50 || b.Dy() != 50 {
+				t.Fatalf("expected 50x50, got %dx%d", b.Dx(), b.Dy())
+			}
+			if hasSubject(dst) != item.Subject {
+				t.Errorf("expected subject in the crop %v, got %v", item.Subject, !item.Subject)
+			}
+		})
+	}
+}
+
+// TestResize_ApplySmartPlain checks an image without a subject is cropped the same as a centred crop.
+func TestResize_ApplySmartPlain(t *testing.T) {
+	src := subjectImage(301, 100, 0, 0, 0)
+	centred := primage.Resize{Width: 50, Height: 50, Fit: primage.FitCover}.Apply(src)
+	smart := primage.Resize{Width: 50, Height: 50, Fit: primage.FitCover, Smart: true}.Apply(src)
+	if !bytes.Equal(centred.(*image.RGBA).Pix, smart.(*image.RGBA).Pix) {
+		t.Error("expected the smart crop to be centred")
+	}
+}
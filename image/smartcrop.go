@@ -0,0 +1,114 @@
+package imagetransform
+
+import (
+	"image"
+	"math"
+
+	"golang.org/x/image/draw"
+)
+
+// smartSize is the size the longest side of an image is scaled down to before it's scored by smartCrop, the score of
+// a crop doesn't need more detail than that.
+const smartSize = 96
+
+// The weights of each part of a pixel's score, see pixelScore.
+const (
+	edgeWeight       = 1.0
+	saturationWeight = 0.5
+	skinWeight       = 1.5
+)
+
+// smartCrop returns the cw x ch rectangle of src with the highest score, the sum of the scores of its pixels (see
+// pixelScore). Of equally good rectangles the one nearest to the centre is chosen, so an image without anything
+// interesting in it is cropped the same as a centred crop.
+func smartCrop(img image.Image, src image.Rectangle, cw, ch int) image.Rectangle {
+	sw, sh := src.Dx(), src.Dy()
+	long := sw
+	if sh > long {
+		long = sh
+	}
+	step := (long + smartSize - 1) / smartSize
+	dw, dh := clamp(sw/step, 1, sw), clamp(sh/step, 1, sh)
+	small := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, src, draw.Src, nil)
+
+	// summed area table of the scores, sums[y][x] is the total of the scores above and left of x, y
+	sums := make([][]float64, dh+1)
+	sums[0] = make([]float64, dw+1)
+	for y := 0; y < dh; y++ {
+		sums[y+1] = make([]float64, dw+1)
+		row := 0.0
+		for x := 0; x < dw; x++ {
+			row += pixelScore(small, x, y)
+			sums[y+1][x+1] = sums[y][x+1] + row
+		}
+	}
+
+	ww, wh := clamp(scale(cw, dw, sw), 1, dw), clamp(scale(ch, dh, sh), 1, dh)
+	cx, cy := float64(dw-ww)/2, float64(dh-wh)/2
+	bestX, bestY, best, bestDist := 0, 0, -1.0, 0.0
+	for y := 0; y+wh <= dh; y++ {
+		for x := 0; x+ww <= dw; x++ {
+			score := sums[y+wh][x+ww] - sums[y][x+ww] - sums[y+wh][x] + sums[y][x]
+			dist := math.Hypot(float64(x)-cx, float64(y)-cy)
+			// scores are sums of floats, allow for rounding differences
+			const epsilon = 1e-6
+			if score > best+epsilon || score > best-epsilon && dist < bestDist {
+				bestX, bestY, best, bestDist = x, y, score, dist
+			}
+		}
+	}
+
+	// the crop is centred on the side that isn't cropped, or not by enough to be seen in the scaled down image
+	x, y := (sw-cw)/2, (sh-ch)/2
+	if ww < dw {
+		x = clamp(int(float64(bestX*sw)/float64(dw)+0.5), 0, sw-cw)
+	}
+	if wh < dh {
+		y = clamp(int(float64(bestY*sh)/float64(dh)+0.5), 0, sh-ch)
+	}
+	return image.Rect(src.Min.X+x, src.Min.Y+y, src.Min.X+x+cw, src.Min.Y+y+ch)
+}
+
+// pixelScore scores how interesting the pixel at x, y is, the subject of a photo has more detail (edges), more
+// saturated colours and people have skin tones. Transparent pixels aren't interesting.
+func pixelScore(img *image.NRGBA, x, y int) float64 {
+	c := img.NRGBAAt(x, y)
+	r, g, b := int(c.R), int(c.G), int(c.B)
+	l := luma(c.R, c.G, c.B)
+
+	// the difference from the pixels right of and below it
+	edge := 0.0
+	if x+1 < img.Rect.Dx() {
+		n := img.NRGBAAt(x+1, y)
+		edge += math.Abs(l - luma(n.R, n.G, n.B))
+	}
+	if y+1 < img.Rect.Dy() {
+		n := img.NRGBAAt(x, y+1)
+		edge += math.Abs(l - luma(n.R, n.G, n.B))
+	}
+
+	hi, lo := r, r
+	for _, v := range []int{g, b} {
+		if v > hi {
+			hi = v
+		}
+		if v < lo {
+			lo = v
+		}
+	}
+	saturation := float64(hi - lo)
+
+	skin := 0.0
+	if r > 95 && g > 40 && b > 20 && hi-lo > 15 && r-g > 15 && r > b {
+		skin = 255
+	}
+
+	score := edgeWeight*edge/2 + saturationWeight*saturation + skinWeight*skin
+	return score * float64(c.A) / 255
+}
+
+// luma returns the brightness of a colour, 0 to 255.
+func luma(r, g, b uint8) float64 {
+	return 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+}
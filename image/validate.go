@@ -0,0 +1,93 @@
+package imagetransform
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	_ "image/gif"  // import to register
+	_ "image/jpeg" // import to register
+	_ "image/png"  // import to register
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/j0hnsmith/progimage"
+	"github.com/pkg/errors"
+	_ "golang.org/x/image/webp" // import to register
+)
+
+// DefaultMaxUploadBytes is the maximum size of image data accepted by Validate when no limit is given.
+const DefaultMaxUploadBytes = 20 * 1024 * 1024 // 20mb
+
+// Upload is validated image data, ready to be stored.
+type Upload struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+	Hash        string // hex encoded sha256 of Data
+	HasMetadata bool   // see HasMetadata
+}
+
+// Validate reads image data (into memory) and ensures it's an image that can be decoded, returns
+// progimage.ErrUnrecognisedImageType if not. Data larger than maxBytes (DefaultMaxUploadBytes if 0) is rejected with
+// progimage.ErrImageTooLarge, images larger than limits (see Limits.Check) with progimage.ErrImageDimensions. The
+// width and height are of the image upright, using any EXIF orientation. Storage implementations should use this so
+// they all accept the same images.
+func Validate(r io.Reader, maxBytes int64, limits Limits) (Upload, error) {
+	ret := Upload{}
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxUploadBytes
+	}
+
+	// one more byte than allowed so too much data can be told apart from exactly enough
+	lr := io.LimitReader(r, maxBytes+1)
+
+	// the whole image is read before storing so the metadata is known up front, the decoded image needs to be
+	// held in memory to validate it anyway, hash as it's read so content addressed stores don't need another pass
+	h := sha256.New()
+	data, err := ioutil.ReadAll(io.TeeReader(lr, h))
+	if err != nil {
+		return ret, errors.Wrap(err, "unable to read image data")
+	}
+	if int64(len(data)) > maxBytes {
+		return ret, &progimage.Error{
+			Kind:   progimage.ErrImageTooLarge,
+			Detail: fmt.Sprintf("image data is larger than %d bytes", maxBytes),
+		}
+	}
+
+	// extract the mime type from the header
+	contentType := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image") {
+		// not an image, bail
+		return ret, progimage.ErrUnrecognisedImageType
+	}
+
+	// decode the image to ensure we have a valid image
+	img, err := limits.Decode(bytes.NewReader(data))
+	if err != nil {
+		if progimage.KindOf(err) == progimage.ErrImageDimensions {
+			return ret, err
+		}
+		return ret, progimage.ErrUnrecognisedImageType
+	}
+
+	b := img.Bounds()
+
+	ret.Data = data
+	ret.ContentType = contentType
+	ret.Width = b.Dx()
+	ret.Height = b.Dy()
+	if exif, err := ParseEXIF(data); err == nil && exif != nil && exif.Orientation >= 5 {
+		// shown (and transformed) rotated 90 degrees
+		ret.Width, ret.Height = ret.Height, ret.Width
+	}
+	ret.Hash = hex.EncodeToString(h.Sum(nil))
+	// data that can't be stripped is served encoded, as if it had metadata
+	strip, err := HasMetadata(bytes.NewReader(data), contentType)
+	ret.HasMetadata = strip || err != nil
+	return ret, nil
+}
@@ -0,0 +1,41 @@
+package webp
+
+import (
+	"image"
+	_ "image/gif"  // register image type, do not remove
+	_ "image/jpeg" // register image type, do not remove
+	_ "image/png"  // register image type, do not remove
+	"io"
+
+	"github.com/gen2brain/webp"
+	primage "github.com/j0hnsmith/progimage/image"
+	_ "golang.org/x/image/webp" // register image type, do not remove
+)
+
+// DefaultQuality is the lossy encoding quality (1-100) used by Encode when the options don't set one.
+const DefaultQuality = 75
+
+// method is the libwebp speed/size trade off (0 fast - 6 small), 4 is the libwebp default.
+const method = 4
+
+// Transformer implements progimage.ImageTypeTransformer to convert a progimage.Image to webp format, lossy unless
+// EncodeOptions.Lossless is set.
+var Transformer = primage.Transformer{
+	Name:        "webp",
+	ContentType: "image/webp",
+	Encoder:     Encode,
+}
+
+// Encode performs lossy webp encoding, opts.Quality sets the quality (default DefaultQuality), or lossless encoding if
+// opts.Lossless is set (quality doesn't apply). The encoder is libwebp compiled to wasm, it runs in pure Go so cgo
+// isn't needed.
+func Encode(w io.Writer, m image.Image, opts primage.EncodeOptions) error {
+	if opts.Lossless {
+		return webp.Encode(w, m, webp.Options{Lossless: true, Method: method})
+	}
+	q := opts.Quality
+	if q == 0 {
+		q = DefaultQuality
+	}
+	return webp.Encode(w, m, webp.Options{Quality: q, Method: method})
+}
@@ -0,0 +1,87 @@
+package webp_test
+
+import (
+	"context"
+	"image"
+	"os"
+	"testing"
+
+	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
+	"github.com/j0hnsmith/progimage/image/webp"
+)
+
+var fileTests = []struct {
+	Name        string
+	Path        string
+	ContentType string
+}{
+	{Name: "png", Path: "../../testimages/test.png", ContentType: "image/png"},
+	{Name: "gif", Path: "../../testimages/test.gif", ContentType: "image/gif"},
+	{Name: "jpg", Path: "../../testimages/test.jpg", ContentType: "image/jpeg"},
+}
+
+func TestTransformWebP(t *testing.T) {
+	options := map[string]primage.EncodeOptions{
+		"lossy":    {},
+		"lossless": {Lossless: true},
+	}
+	for name, opts := range options {
+		for _, item := range fileTests {
+			t.Run(name+"/"+item.Name, func(t *testing.T) {
+				fp, err := os.Open(item.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer fp.Close()
+
+				img := progimage.Image{
+					ID:          item.Name,
+					ContentType: item.ContentType,
+					Data:        fp,
+				}
+
+				p := primage.Pipeline{Transformer: webp.Transformer, Options: opts}
+				imgOut, err := p.Run(context.Background(), img)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// any encoding error is returned by Decode reading the data
+				_, typ, err := image.Decode(imgOut.Data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if typ != "webp" {
+					t.Errorf("expected type of converted image to be webp, got %s", typ)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateWebP(t *testing.T) {
+	fp, err := os.Open("../../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	errCh := make(chan error, 1)
+	imgOut, err := webp.Transformer.Transform(context.Background(), progimage.Image{ContentType: "image/png", Data: fp}, errCh)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// webp uploads are accepted by storage implementations
+	up, err := primage.Validate(imgOut.Data, 0, primage.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if up.ContentType != "image/webp" {
+		t.Errorf("expected content type image/webp, got %s", up.ContentType)
+	}
+	if err := <-errCh; err != nil {
+		t.Errorf("got error converting image %s", err)
+	}
+}
@@ -0,0 +1,160 @@
+package memory
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/j0hnsmith/progimage"
+	"github.com/pkg/errors"
+)
+
+var _ progimage.DerivativeStore = &DerivativeCache{}
+
+// DerivativeCache implements progimage.DerivativeStore by keeping derivatives in memory, it's safe for concurrent
+// use. If MaxBytes is set, the least recently used derivatives are evicted to keep the total size below it. If Next
+// is set the cache sits in front of it, misses are read from Next and stores and deletes are written through.
+type DerivativeCache struct {
+	MaxBytes int64
+	Next     progimage.DerivativeStore
+
+	mu    sync.Mutex
+	items map[string]map[string]*list.Element // image id -> key -> element, values are *derivative
+	lru   *list.List                          // most recently used at the front
+	size  int64
+}
+
+type derivative struct {
+	id          string // source image id
+	key         string
+	contentType string
+	data        []byte
+}
+
+// NewDerivativeCache provides an initialised DerivativeCache, maxBytes of 0 means no limit, next may be nil.
+func NewDerivativeCache(maxBytes int64, next progimage.DerivativeStore) *DerivativeCache {
+	return &DerivativeCache{
+		MaxBytes: maxBytes,
+		Next:     next,
+		items:    map[string]map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// GetDerivative retrieves the derivative of the image with the given id.
+func (dc *DerivativeCache) GetDerivative(ctx context.Context, ID, key string) (progimage.Image, error) {
+	dc.mu.Lock()
+	if el, ok := dc.items[ID][key]; ok {
+		dc.lru.MoveToFront(el)
+		d := el.Value.(*derivative)
+		dc.mu.Unlock()
+		return progimage.Image{ID: ID, Data: bytes.NewReader(d.data), ContentType: d.contentType}, nil
+	}
+	dc.mu.Unlock()
+
+	if dc.Next == nil {
+		return progimage.Image{}, progimage.ErrImageNotFound
+	}
+
+	img, err := dc.Next.GetDerivative(ctx, ID, key)
+	if err != nil {
+		return img, err
+	}
+	d, err := dc.read(ID, key, img)
+	if err != nil {
+		return progimage.Image{}, err
+	}
+	dc.add(d)
+	return progimage.Image{ID: ID, Data: bytes.NewReader(d.data), ContentType: d.contentType}, nil
+}
+
+// StoreDerivative persists a derivative of the image with the given id.
+func (dc *DerivativeCache) StoreDerivative(ctx context.Context, ID, key string, img progimage.Image) error {
+	d, err := dc.read(ID, key, img)
+	if err != nil {
+		return err
+	}
+	if dc.Next != nil {
+		next := progimage.Image{ID: ID, Data: bytes.NewReader(d.data), ContentType: d.contentType}
+		if err := dc.Next.StoreDerivative(ctx, ID, key, next); err != nil {
+			return err
+		}
+	}
+	dc.add(d)
+	return nil
+}
+
+// DeleteDerivatives removes all derivatives of the image with the given id.
+func (dc *DerivativeCache) DeleteDerivatives(ctx context.Context, ID string) error {
+	dc.mu.Lock()
+	for _, el := range dc.items[ID] {
+		dc.remove(el)
+	}
+	dc.mu.Unlock()
+
+	if dc.Next != nil {
+		return dc.Next.DeleteDerivatives(ctx, ID)
+	}
+	return nil
+}
+
+// Size returns the total size of derivative data held in memory.
+func (dc *DerivativeCache) Size() int64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.size
+}
+
+// read reads img into a derivative, closing the data if needed.
+func (dc *DerivativeCache) read(ID, key string, img progimage.Image) (*derivative, error) {
+	data, err := ioutil.ReadAll(img.Data)
+	closeData(img)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read derivative data")
+	}
+	return &derivative{id: ID, key: key, contentType: img.ContentType, data: data}, nil
+}
+
+// add adds d to the cache, evicting as needed, derivatives larger than MaxBytes aren't cached.
+func (dc *DerivativeCache) add(d *derivative) {
+	size := int64(len(d.data))
+	if dc.MaxBytes > 0 && size > dc.MaxBytes {
+		return
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if el, ok := dc.items[d.id][d.key]; ok {
+		dc.remove(el)
+	}
+	if dc.items[d.id] == nil {
+		dc.items[d.id] = map[string]*list.Element{}
+	}
+	dc.items[d.id][d.key] = dc.lru.PushFront(d)
+	dc.size += size
+
+	for dc.MaxBytes > 0 && dc.size > dc.MaxBytes {
+		dc.remove(dc.lru.Back())
+	}
+}
+
+// remove must be called with mu held.
+func (dc *DerivativeCache) remove(el *list.Element) {
+	d := dc.lru.Remove(el).(*derivative)
+	delete(dc.items[d.id], d.key)
+	if len(dc.items[d.id]) == 0 {
+		delete(dc.items, d.id)
+	}
+	dc.size -= int64(len(d.data))
+}
+
+// closeData closes the image data if it needs closing, eg a file.
+func closeData(img progimage.Image) {
+	if c, ok := img.Data.(io.Closer); ok {
+		c.Close() // nolint: errcheck,gas
+	}
+}
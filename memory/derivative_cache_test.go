@@ -0,0 +1,114 @@
+package memory_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/j0hnsmith/progimage"
+	"github.com/j0hnsmith/progimage/memory"
+)
+
+func storeDerivative(t *testing.T, ds progimage.DerivativeStore, ID, key string, data []byte) {
+	img := progimage.Image{ID: ID, Data: bytes.NewReader(data), ContentType: "image/png"}
+	if err := ds.StoreDerivative(context.Background(), ID, key, img); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getDerivative(t *testing.T, ds progimage.DerivativeStore, ID, key string) []byte {
+	img, err := ds.GetDerivative(context.Background(), ID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.ID != ID {
+		t.Errorf("expected derivative id to be '%s', got '%s'", ID, img.ID)
+	}
+	if img.ContentType != "image/png" {
+		t.Errorf("expected derivative content type to be 'image/png', got '%s'", img.ContentType)
+	}
+	d, err := ioutil.ReadAll(img.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDerivativeCache_StoreGet(t *testing.T) {
+	dc := memory.NewDerivativeCache(0, nil)
+
+	storeDerivative(t, dc, "a", "small", []byte("1234"))
+	storeDerivative(t, dc, "a", "large", []byte("12345678"))
+
+	if d := getDerivative(t, dc, "a", "small"); string(d) != "1234" {
+		t.Errorf("expected derivative data '1234', got '%s'", d)
+	}
+	if _, err := dc.GetDerivative(context.Background(), "a", "foo"); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound, got %v", err)
+	}
+	if _, err := dc.GetDerivative(context.Background(), "b", "small"); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound, got %v", err)
+	}
+
+	if err := dc.DeleteDerivatives(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dc.GetDerivative(context.Background(), "a", "large"); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound after delete, got %v", err)
+	}
+	if dc.Size() != 0 {
+		t.Errorf("expected size 0 after delete, got %d", dc.Size())
+	}
+}
+
+func TestDerivativeCache_Evict(t *testing.T) {
+	dc := memory.NewDerivativeCache(10, nil)
+
+	storeDerivative(t, dc, "a", "1", []byte("1234"))
+	storeDerivative(t, dc, "b", "1", []byte("1234"))
+	getDerivative(t, dc, "a", "1") // a is now most recently used
+	storeDerivative(t, dc, "c", "1", []byte("1234"))
+
+	if _, err := dc.GetDerivative(context.Background(), "b", "1"); err != progimage.ErrImageNotFound {
+		t.Errorf("expected least recently used derivative to be evicted, got %v", err)
+	}
+	getDerivative(t, dc, "a", "1")
+	getDerivative(t, dc, "c", "1")
+	if dc.Size() != 8 {
+		t.Errorf("expected size 8, got %d", dc.Size())
+	}
+
+	// too big to cache
+	storeDerivative(t, dc, "d", "1", []byte("12345678901"))
+	if _, err := dc.GetDerivative(context.Background(), "d", "1"); err != progimage.ErrImageNotFound {
+		t.Errorf("expected derivative larger than the cache not to be cached, got %v", err)
+	}
+}
+
+func TestDerivativeCache_Next(t *testing.T) {
+	next := memory.NewDerivativeCache(0, nil)
+	dc := memory.NewDerivativeCache(0, next)
+
+	// written through
+	storeDerivative(t, dc, "a", "1", []byte("1234"))
+	if d := getDerivative(t, next, "a", "1"); string(d) != "1234" {
+		t.Errorf("expected derivative to be written through, got '%s'", d)
+	}
+
+	// read through, by another process
+	other := memory.NewDerivativeCache(0, next)
+	if d := getDerivative(t, other, "a", "1"); string(d) != "1234" {
+		t.Errorf("expected derivative to be read through, got '%s'", d)
+	}
+	if other.Size() != 4 {
+		t.Errorf("expected derivative read through to be cached, size %d", other.Size())
+	}
+
+	if err := dc.DeleteDerivatives(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := next.GetDerivative(context.Background(), "a", "1"); err != progimage.ErrImageNotFound {
+		t.Errorf("expected delete to be written through, got %v", err)
+	}
+}
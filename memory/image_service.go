@@ -0,0 +1,198 @@
+package memory
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
+)
+
+var _ progimage.ImageService = &ImageService{}
+
+// ImageService implements progimage.ImageService by storing images in memory, it's safe for concurrent use. If
+// MaxBytes is set, the least recently used images are evicted to keep the total size of image data below it. The zero
+// value is an empty ImageService without a limit.
+type ImageService struct {
+	MaxBytes int64
+	UUID     func() uuid.UUID // uuid.New if nil
+
+	// MaxUploadBytes is the max size of image data Store accepts, 0 for primage.DefaultMaxUploadBytes.
+	MaxUploadBytes int64
+
+	// Limits are the max dimensions of images Store accepts, zero for primage.DefaultLimits.
+	Limits primage.Limits
+
+	mu     sync.Mutex
+	images map[string]*list.Element // values are *entry
+	lru    *list.List               // most recently used at the front
+	size   int64
+}
+
+type entry struct {
+	info progimage.ImageInfo
+	data []byte
+}
+
+// NewImageService provides an initialised ImageService, maxBytes of 0 means no limit.
+func NewImageService(maxBytes int64, uuid func() uuid.UUID) *ImageService {
+	return &ImageService{
+		MaxBytes: maxBytes,
+		UUID:     uuid,
+		images:   map[string]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// Get retrieves the Image with the given id.
+func (is *ImageService) Get(ctx context.Context, ID string) (progimage.Image, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	el, ok := is.images[ID]
+	if !ok {
+		return progimage.Image{}, progimage.ErrImageNotFound
+	}
+	is.lru.MoveToFront(el)
+	e := el.Value.(*entry)
+
+	return progimage.Image{
+		ID:           ID,
+		Data:         bytes.NewReader(e.data),
+		ContentType:  e.info.ContentType,
+		ETag:         e.info.Hash,
+		LastModified: e.info.Created,
+		Focus:        e.info.Focus,
+	}, nil
+}
+
+var _ progimage.RangeGetter = &ImageService{}
+
+// GetRange retrieves part of the Image with the given id.
+func (is *ImageService) GetRange(ctx context.Context, ID string, offset, length int64) (progimage.Image, error) {
+	img, err := is.Get(ctx, ID)
+	if err != nil {
+		return img, err
+	}
+	img.Data = io.NewSectionReader(img.Data.(*bytes.Reader), offset, length)
+	return img, nil
+}
+
+// Stat returns information about the Image with the given id.
+func (is *ImageService) Stat(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	el, ok := is.images[ID]
+	if !ok {
+		return progimage.ImageInfo{}, progimage.ErrImageNotFound
+	}
+	return el.Value.(*entry).info, nil
+}
+
+// Store validates data is an image (read into memory), persists the image and returns the id.
+func (is *ImageService) Store(ctx context.Context, rawImg io.Reader) (string, error) {
+	up, err := primage.Validate(rawImg, is.MaxUploadBytes, is.Limits)
+	if err != nil {
+		return "", err
+	}
+
+	size := int64(len(up.Data))
+	if is.MaxBytes > 0 && size > is.MaxBytes {
+		return "", &progimage.Error{
+			Kind:   progimage.ErrImageTooLarge,
+			Detail: fmt.Sprintf("image size %d is larger than the store (%d bytes)", size, is.MaxBytes),
+		}
+	}
+
+	newUUID := is.UUID
+	if newUUID == nil {
+		newUUID = uuid.New
+	}
+	ID := newUUID().String()
+	e := &entry{
+		info: progimage.ImageInfo{
+			ID:          ID,
+			ContentType: up.ContentType,
+			Width:       up.Width,
+			Height:      up.Height,
+			Size:        size,
+			Created:     time.Now().UTC(),
+			Hash:        up.Hash,
+			HasMetadata: up.HasMetadata,
+		},
+		data: up.Data,
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	if is.images == nil {
+		is.images = map[string]*list.Element{}
+		is.lru = list.New()
+	}
+	if el, ok := is.images[ID]; ok {
+		is.remove(el)
+	}
+	is.images[ID] = is.lru.PushFront(e)
+	is.size += size
+
+	for is.MaxBytes > 0 && is.size > is.MaxBytes {
+		is.remove(is.lru.Back())
+	}
+
+	return ID, nil
+}
+
+var _ progimage.FocusSetter = &ImageService{}
+
+// SetFocus stores the focal point of the Image with the given id, nil removes it.
+func (is *ImageService) SetFocus(ctx context.Context, ID string, focus *progimage.Focus) error {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	el, ok := is.images[ID]
+	if !ok {
+		return progimage.ErrImageNotFound
+	}
+	if focus != nil {
+		// a copy, the caller's can change and infos already returned mustn't
+		f := *focus
+		focus = &f
+	}
+	el.Value.(*entry).info.Focus = focus
+	return nil
+}
+
+// Delete removes the Image with the given id.
+func (is *ImageService) Delete(ctx context.Context, ID string) error {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	el, ok := is.images[ID]
+	if !ok {
+		return progimage.ErrImageNotFound
+	}
+	is.remove(el)
+	return nil
+}
+
+// Size returns the total size of image data stored.
+func (is *ImageService) Size() int64 {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	return is.size
+}
+
+// remove must be called with mu held.
+func (is *ImageService) remove(el *list.Element) {
+	e := is.lru.Remove(el).(*entry)
+	delete(is.images, e.info.ID)
+	is.size -= e.info.Size
+}
@@ -0,0 +1,207 @@
+package memory_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/j0hnsmith/progimage"
+	"github.com/j0hnsmith/progimage/memory"
+	"github.com/j0hnsmith/progimage/servicetest"
+)
+
+var fileTests = []struct {
+	Name        string
+	Path        string
+	ContentType string
+}{
+	{Name: "png", Path: "../testimages/test.png", ContentType: "image/png"},
+	{Name: "gif", Path: "../testimages/test.gif", ContentType: "image/gif"},
+	{Name: "jpg", Path: "../testimages/test.jpg", ContentType: "image/jpeg"},
+}
+
+func readFile(t *testing.T, path string) []byte {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestImageService_StoreGetImage(t *testing.T) {
+	for _, item := range fileTests {
+		t.Run(item.Name, func(t *testing.T) {
+			is := memory.NewImageService(0, uuid.New)
+			d := readFile(t, item.Path)
+
+			id, err := is.Store(context.Background(), bytes.NewReader(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			img, err := is.Get(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.ID != id {
+				t.Errorf("expected image id to be '%s', got '%s'", id, img.ID)
+			}
+			if img.ContentType != item.ContentType {
+				t.Errorf("expected image content type to be '%s', got '%s'", item.ContentType, img.ContentType)
+			}
+
+			retrieved, err := ioutil.ReadAll(img.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d, retrieved) {
+				t.Error("expected stored data to be equal to initial data from file, data not equal")
+			}
+
+			info, err := is.Stat(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.ContentType != item.ContentType || info.Size != int64(len(d)) || info.Width == 0 ||
+				info.Height == 0 || info.Hash == "" || info.Created.IsZero() {
+				t.Errorf("unexpected image info %+v", info)
+			}
+		})
+	}
+}
+
+func TestImageService_StoreNoData(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+
+	if _, err := is.Store(context.Background(), bytes.NewReader([]byte("not an image"))); err != progimage.ErrUnrecognisedImageType {
+		t.Errorf("expected progimage.ErrUnrecognisedImageType, got %s", err)
+	}
+	if is.Size() != 0 {
+		t.Errorf("expected size to be 0, got %d", is.Size())
+	}
+}
+
+func TestImageService_Delete(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+
+	id, err := is.Store(context.Background(), bytes.NewReader(readFile(t, "../testimages/test.png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := is.Delete(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := is.Get(context.Background(), id); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound after delete, got %s", err)
+	}
+	if err := is.Delete(context.Background(), id); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound deleting twice, got %s", err)
+	}
+	if is.Size() != 0 {
+		t.Errorf("expected size to be 0, got %d", is.Size())
+	}
+}
+
+func TestImageService_Evict(t *testing.T) {
+	png := readFile(t, "../testimages/test.png")
+	gif := readFile(t, "../testimages/test.gif")
+
+	// room for 2 pngs or 1 gif
+	is := memory.NewImageService(int64(len(png)*2), uuid.New)
+
+	id1, err := is.Store(context.Background(), bytes.NewReader(png))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := is.Store(context.Background(), bytes.NewReader(png))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// id1 most recently used
+	if _, err := is.Get(context.Background(), id1); err != nil {
+		t.Fatal(err)
+	}
+
+	id3, err := is.Store(context.Background(), bytes.NewReader(png))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := is.Get(context.Background(), id2); err != progimage.ErrImageNotFound {
+		t.Errorf("expected least recently used image to be evicted, got %v", err)
+	}
+	for _, id := range []string{id1, id3} {
+		if _, err := is.Get(context.Background(), id); err != nil {
+			t.Errorf("expected image %s to exist, got %s", id, err)
+		}
+	}
+	if is.Size() != int64(len(png)*2) {
+		t.Errorf("expected size to be %d, got %d", len(png)*2, is.Size())
+	}
+
+	// too big to store at all
+	if _, err := is.Store(context.Background(), bytes.NewReader(gif)); progimage.KindOf(err) != progimage.ErrImageTooLarge {
+		t.Errorf("expected ErrImageTooLarge storing image larger than MaxBytes, got %v", err)
+	}
+}
+
+func TestImageService_Concurrent(t *testing.T) {
+	is := memory.NewImageService(0, uuid.New)
+	d := readFile(t, "../testimages/test.png")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id, err := is.Store(context.Background(), bytes.NewReader(d))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			img, err := is.Get(context.Background(), id)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			retrieved, err := ioutil.ReadAll(img.Data)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(d, retrieved) {
+				t.Error("expected stored data to be equal to initial data from file, data not equal")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if is.Size() != int64(len(d)*20) {
+		t.Errorf("expected size to be %d, got %d", len(d)*20, is.Size())
+	}
+}
+
+func TestImageService_Conformance(t *testing.T) {
+	servicetest.Run(t, servicetest.Suite{
+		New: func(t *testing.T) (progimage.ImageService, func()) {
+			is := memory.NewImageService(0, uuid.New)
+			is.MaxUploadBytes = 1024 * 1024
+			return is, func() {}
+		},
+		MaxBytes: 1024 * 1024,
+	})
+}
+
+// TestImageService_ZeroValue checks an ImageService that wasn't created by NewImageService can be used.
+func TestImageService_ZeroValue(t *testing.T) {
+	servicetest.Run(t, servicetest.Suite{
+		New: func(t *testing.T) (progimage.ImageService, func()) {
+			return &memory.ImageService{}, func() {}
+		},
+	})
+}
@@ -1,6 +1,7 @@
 package mock
 
 import (
+	"context"
 	"io"
 
 	"github.com/j0hnsmith/progimage"
@@ -10,20 +11,36 @@ var _ progimage.ImageService = &ImageService{}
 
 // ImageService is a mock progimage.ImageService.
 type ImageService struct {
-	GetInvoked   bool
-	StoreInvoked bool
-	GetFunc      func(string) (progimage.Image, error)
-	StoreFunc    func(io.Reader) (string, error)
+	GetInvoked    bool
+	StatInvoked   bool
+	StoreInvoked  bool
+	DeleteInvoked bool
+	GetFunc       func(context.Context, string) (progimage.Image, error)
+	StatFunc      func(context.Context, string) (progimage.ImageInfo, error)
+	StoreFunc     func(context.Context, io.Reader) (string, error)
+	DeleteFunc    func(context.Context, string) error
 }
 
 // Get an image.
-func (is *ImageService) Get(ID string) (progimage.Image, error) {
+func (is *ImageService) Get(ctx context.Context, ID string) (progimage.Image, error) {
 	is.GetInvoked = true
-	return is.GetFunc(ID)
+	return is.GetFunc(ctx, ID)
+}
+
+// Stat an image.
+func (is *ImageService) Stat(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+	is.StatInvoked = true
+	return is.StatFunc(ctx, ID)
 }
 
 // Store an image.
-func (is *ImageService) Store(imgRdr io.Reader) (string, error) {
+func (is *ImageService) Store(ctx context.Context, imgRdr io.Reader) (string, error) {
 	is.StoreInvoked = true
-	return is.StoreFunc(imgRdr)
+	return is.StoreFunc(ctx, imgRdr)
+}
+
+// Delete an image.
+func (is *ImageService) Delete(ctx context.Context, ID string) error {
+	is.DeleteInvoked = true
+	return is.DeleteFunc(ctx, ID)
 }
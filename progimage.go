@@ -1,21 +1,118 @@
 package progimage
 
-import "io"
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
 
 // Image represents a digital image.
 type Image struct {
 	ID          string
 	Data        io.Reader
 	ContentType string
+
+	// ETag identifies the image data (without quotes), usually the same as ImageInfo.Hash, empty if unknown. The
+	// http handler uses the Stat hash and created time as the validators of every response, see ImageInfo.
+	ETag         string
+	LastModified time.Time
+
+	// Focus is the stored focal point of the image, nil if it hasn't got one.
+	Focus *Focus
+}
+
+// ImageInfo describes a stored image without its data.
+type ImageInfo struct {
+	ID          string    `json:"id"`
+	ContentType string    `json:"content_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Size        int64     `json:"size"`
+	Created     time.Time `json:"created"`
+	Hash        string    `json:"hash"` // hex encoded sha256 of the image data
+	Focus       *Focus    `json:"focus,omitempty"`
+
+	// HasMetadata is set if the image data has metadata (EXIF, XMP, ICC) that's removed when it's served without, it's
+	// worked out when the image is stored. Images stored before it was recorded have it set.
+	HasMetadata bool `json:"has_metadata"`
+}
+
+// Focus is the point of an image kept in view when it's cropped to a thumbnail, as fractions of the (upright) image's
+// width and height from the top left, {0.5, 0.5} is the centre.
+type Focus struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// Valid reports whether the point is inside the image.
+func (f Focus) Valid() bool {
+	return f.X >= 0 && f.X <= 1 && f.Y >= 0 && f.Y <= 1
+}
+
+// String returns the point as x,y, see ParseFocus.
+func (f Focus) String() string {
+	return strconv.FormatFloat(f.X, 'f', -1, 64) + "," + strconv.FormatFloat(f.Y, 'f', -1, 64)
 }
 
-// ImageService is an interface for a service that can store and retrieve images.
+// ParseFocus parses a point in the form x,y, it must be Valid.
+func ParseFocus(s string) (Focus, error) {
+	f := Focus{}
+	xy := strings.Split(s, ",")
+	if len(xy) != 2 {
+		return f, errors.New("focus must be x,y")
+	}
+	x, errX := strconv.ParseFloat(xy[0], 64)
+	y, errY := strconv.ParseFloat(xy[1], 64)
+	if errX != nil || errY != nil {
+		return f, errors.New("focus must be x,y")
+	}
+	f.X, f.Y = x, y
+	if !f.Valid() {
+		return f, errors.New("focus x and y must be between 0 and 1")
+	}
+	return f, nil
+}
+
+// ImageService is an interface for a service that can store, retrieve and delete images. Implementations should
+// stop work and return an error when ctx is done.
 type ImageService interface {
-	Get(ID string) (Image, error)
-	Store(imgRdr io.Reader) (string, error)
+	Get(ctx context.Context, ID string) (Image, error)
+	Stat(ctx context.Context, ID string) (ImageInfo, error)
+	Store(ctx context.Context, imgRdr io.Reader) (string, error)
+	Delete(ctx context.Context, ID string) error
+}
+
+// RangeGetter is implemented by ImageServices that can retrieve part of an image's data, length bytes from offset.
+// The range must be within the image data.
+type RangeGetter interface {
+	GetRange(ctx context.Context, ID string, offset, length int64) (Image, error)
+}
+
+// FocusSetter is implemented by ImageServices that can store a focal point with an image, it's returned in
+// Image.Focus and ImageInfo.Focus. A nil focus removes it.
+type FocusSetter interface {
+	SetFocus(ctx context.Context, ID string, focus *Focus) error
+}
+
+// DerivativeStore is an interface for a store of images rendered from a stored image, keyed by the source image id
+// and a key describing the rendering. Derivatives can always be rendered again so they may be dropped at any time,
+// a missing derivative is ErrImageNotFound.
+type DerivativeStore interface {
+	GetDerivative(ctx context.Context, ID, key string) (Image, error)
+	StoreDerivative(ctx context.Context, ID, key string, img Image) error
+	DeleteDerivatives(ctx context.Context, ID string) error
 }
 
-// ImageTypeTransformer is an interface that can transform images.
+// ImageTypeTransformer is an interface that can transform images, encoding stops when ctx is done.
 type ImageTypeTransformer interface {
-	Transform(Image, chan error) (Image, error)
+	Transform(context.Context, Image, chan error) (Image, error)
+}
+
+// ImagePipeline is an interface that applies a series of operations to an image then encodes it, errors encoding
+// the image are returned when reading Image.Data. Work stops when ctx is done.
+type ImagePipeline interface {
+	Run(context.Context, Image) (Image, error)
 }
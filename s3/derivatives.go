@@ -0,0 +1,66 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+
+	"github.com/j0hnsmith/progimage"
+	"github.com/minio/minio-go"
+	"github.com/pkg/errors"
+)
+
+var _ progimage.DerivativeStore = &ImageService{}
+
+// derivativePath returns the object name of a derivative, derivatives of an image share a prefix so they can be
+// deleted together.
+func (is *ImageService) derivativePath(ID, key string) string {
+	return is.DerivativePrefix + ID + "/" + key
+}
+
+// GetDerivative retrieves the derivative of the image with the given id.
+func (is *ImageService) GetDerivative(ctx context.Context, ID, key string) (progimage.Image, error) {
+	img, err := is.Get(ctx, is.derivativePath(ID, key))
+	if err != nil {
+		return img, err
+	}
+	img.ID = ID
+	return img, nil
+}
+
+// StoreDerivative persists a derivative of the image with the given id.
+func (is *ImageService) StoreDerivative(ctx context.Context, ID, key string, img progimage.Image) error {
+	data, err := ioutil.ReadAll(img.Data)
+	if err != nil {
+		return errors.Wrap(err, "unable to read derivative data")
+	}
+
+	_, err = is.Client.PutObjectWithContext(
+		ctx, is.BucketName, is.derivativePath(ID, key),
+		bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: img.ContentType},
+	)
+	if err != nil {
+		return storageError(ctx, err, "error uploading derivative of %s to s3", ID)
+	}
+	return nil
+}
+
+// DeleteDerivatives removes all derivatives of the image with the given id.
+func (is *ImageService) DeleteDerivatives(ctx context.Context, ID string) error {
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	for obj := range is.Client.ListObjectsV2(is.BucketName, is.derivativePath(ID, ""), true, doneCh) {
+		if obj.Err != nil {
+			return storageError(ctx, obj.Err, "error listing derivatives of %s", ID)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := is.Client.RemoveObject(is.BucketName, obj.Key); err != nil {
+			return storageError(ctx, err, "error deleting derivative %s", obj.Key)
+		}
+	}
+	return nil
+}
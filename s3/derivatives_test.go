@@ -0,0 +1,59 @@
+package s3_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/j0hnsmith/progimage"
+	"github.com/j0hnsmith/progimage/s3"
+)
+
+func TestImageService_Derivatives(t *testing.T) {
+	c := checkEnvsAndGetClient(t)
+	setup(t, c)
+
+	is := s3.NewImageService(testBucketName, c, uuid.New)
+	if err := is.EnsureBucket(); err != nil {
+		t.Fatal(err)
+	}
+
+	ID := uuid.New().String()
+	key := "0123456789abcdef"
+
+	if _, err := is.GetDerivative(context.Background(), ID, key); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound, got %v", err)
+	}
+
+	d := []byte("not really a png")
+	if err := is.StoreDerivative(context.Background(), ID, key, progimage.Image{ID: ID, Data: bytes.NewReader(d), ContentType: "image/png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := is.GetDerivative(context.Background(), ID, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.ID != ID {
+		t.Errorf("expected derivative id to be '%s', got '%s'", ID, img.ID)
+	}
+	if img.ContentType != "image/png" {
+		t.Errorf("expected content type 'image/png', got '%s'", img.ContentType)
+	}
+	retrieved, err := ioutil.ReadAll(img.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d, retrieved) {
+		t.Error("expected stored derivative to be equal to initial data, data not equal")
+	}
+
+	if err := is.DeleteDerivatives(context.Background(), ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := is.GetDerivative(context.Background(), ID, key); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound after delete, got %v", err)
+	}
+}
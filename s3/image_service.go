@@ -2,16 +2,18 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"image"
-	_ "image/gif"  // import to register
-	_ "image/jpeg" // import to register
-	_ "image/png"  // import to register
 	"io"
-	"log"
 	"net/http"
-	"strings"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
 	"github.com/minio/minio-go"
 	"github.com/pkg/errors"
 
@@ -21,18 +23,37 @@ import (
 var _ progimage.ImageService = &ImageService{}
 
 // ImageService implements progimage.ImageService by storing data in S3 (or other compatible api).
+//
+// If ContentAddressed is set, images are stored under the hex encoded sha256 hash of their data, so storing the same
+// data again returns the existing id without another upload. The id is shared by everyone that stored the data,
+// Delete removes it for all of them.
+//
+// The minio client only has context aware get and put calls, other calls check the context before they're made.
 type ImageService struct {
-	BucketName string
-	Client     *minio.Client
-	UUID       func() uuid.UUID
+	BucketName       string
+	Client           *minio.Client
+	UUID             func() uuid.UUID
+	ContentAddressed bool
+
+	// MaxUploadBytes is the max size of image data Store accepts, 0 for primage.DefaultMaxUploadBytes.
+	MaxUploadBytes int64
+
+	// Limits are the max dimensions of images Store accepts, zero for primage.DefaultLimits.
+	Limits primage.Limits
+
+	// DerivativePrefix is prepended to derivative object names, see StoreDerivative.
+	DerivativePrefix string
+
+	mu sync.Mutex // guards metadata updates, see copyMeta
 }
 
 // NewImageService provides an initialised ImageService.
 func NewImageService(bucketName string, c *minio.Client, uuid func() uuid.UUID) *ImageService {
 	return &ImageService{
-		BucketName: bucketName,
-		Client:     c,
-		UUID:       uuid,
+		BucketName:       bucketName,
+		Client:           c,
+		UUID:             uuid,
+		DerivativePrefix: "derived/",
 	}
 }
 
@@ -52,11 +73,11 @@ func (is *ImageService) EnsureBucket() error {
 }
 
 // Get retrieves the Image with the given id.
-func (is *ImageService) Get(ID string) (progimage.Image, error) {
+func (is *ImageService) Get(ctx context.Context, ID string) (progimage.Image, error) {
 	ret := progimage.Image{}
-	obj, err := is.Client.GetObject(is.BucketName, ID, minio.GetObjectOptions{})
+	obj, err := is.Client.GetObjectWithContext(ctx, is.BucketName, ID, minio.GetObjectOptions{})
 	if err != nil {
-		return ret, errors.Wrapf(err, "error getting image %s", ID)
+		return ret, storageError(ctx, err, "error getting image %s", ID)
 	}
 
 	// ensure the image exists
@@ -66,83 +87,292 @@ func (is *ImageService) Get(ID string) (progimage.Image, error) {
 		if ok && er.Code == "NoSuchKey" {
 			return ret, progimage.ErrImageNotFound
 		}
-		return ret, errors.Wrapf(err, "error getting image data %s", ID)
+		return ret, storageError(ctx, err, "error getting image data %s", ID)
 	}
 
 	ret.ID = ID
 	ret.Data = obj
 	ret.ContentType = info.ContentType
+	ret.ETag = info.Metadata.Get("X-Amz-Meta-" + metaSha256)
+	if ret.ETag == "" {
+		// stored without metadata
+		ret.ETag = info.ETag
+	}
+	ret.LastModified = objectCreated(info)
+	ret.Focus = objectFocus(info)
+	return ret, nil
+}
+
+var _ progimage.RangeGetter = &ImageService{}
+
+// GetRange retrieves part of the Image with the given id, only the requested bytes are read from s3.
+func (is *ImageService) GetRange(ctx context.Context, ID string, offset, length int64) (progimage.Image, error) {
+	ret := progimage.Image{}
+	if err := ctx.Err(); err != nil {
+		return ret, err
+	}
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return ret, errors.Wrapf(err, "invalid range for image %s", ID)
+	}
+
+	// minio.Object drops the range to stat the object, the core api makes a single ranged request
+	data, info, err := minio.Core{Client: is.Client}.GetObject(is.BucketName, ID, opts)
+	if err != nil {
+		er, ok := err.(minio.ErrorResponse)
+		if ok && er.Code == "NoSuchKey" {
+			return ret, progimage.ErrImageNotFound
+		}
+		return ret, storageError(ctx, err, "error getting image data %s", ID)
+	}
+
+	ret.ID = ID
+	ret.Data = data
+	ret.ContentType = info.ContentType
+	ret.ETag = info.Metadata.Get("X-Amz-Meta-" + metaSha256)
+	if ret.ETag == "" {
+		ret.ETag = info.ETag
+	}
+	ret.LastModified = objectCreated(info)
+	ret.Focus = objectFocus(info)
 	return ret, nil
 }
 
-// Store validates data is an image (read into memory), persists the image and returns the id.
-func (is *ImageService) Store(rawImg io.Reader) (string, error) {
-	// limit max size
-	lr := io.LimitReader(rawImg, 20*1024*1024) // 20mb, refactor to config object so value can be set/modified
-
-	// extract the mime type from the header
-	b := make([]byte, 20)
-	if _, err := lr.Read(b); err != io.EOF && err != nil {
-		return "", errors.Wrap(err, "unable to read image data")
-	}
-	contentType := http.DetectContentType(b)
-	if !strings.HasPrefix(contentType, "image") {
-		// not an image, bail
-		return "", progimage.ErrUnrecognisedImageType
-	}
-
-	// create 2 readers of image data, one is used to decode to ensure we have a valid image, the other is used
-	// to upload to s3, both things happen at the same time. In the event that data is not a valid image, we
-	// delete the uploaded object from s3. In theory we don't need to hold both the image bytes and the Image
-	// object in memory so this should improve performance.
-
-	// create 2 readers of rawImg (reads need to be syncronised, will block otherwise)
-	pr, pw := io.Pipe()
-	tr := io.TeeReader(io.MultiReader(bytes.NewReader(b), rawImg), pw)
-
-	var err error
-	errCh := make(chan error, 1)
-
-	u := is.UUID()
-	go func() {
-		_, putErr := is.Client.PutObject(
-			is.BucketName, u.String(),
-			pr, -1,
-			minio.PutObjectOptions{ContentType: contentType},
-		)
-		errCh <- putErr
-	}()
-
-	// decode the image to ensure we have a valid image
-	var uploadErr error
-	var decodeErr error
-	if _, _, decodeErr = image.Decode(tr); decodeErr != nil {
-		// io.EOF to read side
-		pw.Close() // nolint: gas,errcheck
-		uploadErr = <-errCh
-
-		// delete uploaded image
-		if err = is.Client.RemoveObject(is.BucketName, u.String()); err != nil {
-			if uploadErr != nil {
-				// Let's assume not uploaded to avoid further complexity in this example
-				return "", progimage.ErrUnrecognisedImageType
-			}
-
-			// file not valid image, file uploaded ok but delete failed
-			log.Printf("error deleting invalid image %s, %s", u, err)
-			return "", progimage.ErrUnrecognisedImageType
+// Delete removes the Image with the given id, a content addressed image is removed for everyone that stored it.
+func (is *ImageService) Delete(ctx context.Context, ID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// RemoveObject doesn't error for a missing key
+	if _, err := is.Client.StatObject(is.BucketName, ID, minio.StatObjectOptions{}); err != nil {
+		er, ok := err.(minio.ErrorResponse)
+		if ok && er.Code == "NoSuchKey" {
+			return progimage.ErrImageNotFound
+		}
+		return storageError(ctx, err, "error getting image data %s", ID)
+	}
+
+	if err := is.Client.RemoveObject(is.BucketName, ID); err != nil {
+		return storageError(ctx, err, "error deleting image %s", ID)
+	}
+	return nil
+}
+
+// Store validates data is an image (read into memory), persists the image and returns the id. The dimensions, a
+// sha256 hash of the data and the time it was stored are kept as object metadata.
+func (is *ImageService) Store(ctx context.Context, rawImg io.Reader) (string, error) {
+	up, err := primage.Validate(rawImg, is.MaxUploadBytes, is.Limits)
+	if err != nil {
+		return "", err
+	}
+
+	if is.ContentAddressed {
+		return is.storeContentAddressed(ctx, up)
+	}
+
+	ID := is.UUID().String()
+	if err := is.put(ctx, ID, up); err != nil {
+		return "", err
+	}
+	return ID, nil
+}
+
+// storeContentAddressed stores the image using its hash as the id, unless it already exists.
+func (is *ImageService) storeContentAddressed(ctx context.Context, up primage.Upload) (string, error) {
+	ID := up.Hash
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	_, err := is.Client.StatObject(is.BucketName, ID, minio.StatObjectOptions{})
+	if err == nil {
+		return ID, nil
+	}
+	if er, ok := err.(minio.ErrorResponse); !ok || er.Code != "NoSuchKey" {
+		return "", storageError(ctx, err, "error getting image data %s", ID)
+	}
+	if err := is.put(ctx, ID, up); err != nil {
+		return "", err
+	}
+	return ID, nil
+}
+
+// put uploads the image data with its metadata.
+func (is *ImageService) put(ctx context.Context, ID string, up primage.Upload) error {
+	meta := map[string]string{
+		metaWidth:    strconv.Itoa(up.Width),
+		metaHeight:   strconv.Itoa(up.Height),
+		metaSha256:   up.Hash,
+		metaCreated:  time.Now().UTC().Format(time.RFC3339Nano),
+		metaMetadata: strconv.FormatBool(up.HasMetadata),
+	}
+
+	_, err := is.Client.PutObjectWithContext(
+		ctx, is.BucketName, ID,
+		bytes.NewReader(up.Data), int64(len(up.Data)),
+		minio.PutObjectOptions{
+			ContentType:  up.ContentType,
+			UserMetadata: meta,
+		},
+	)
+	if err != nil {
+		return storageError(ctx, err, "error uploading image to s3")
+	}
+	return nil
+}
+
+// copyMeta updates the user metadata of an existing object by copying it onto itself, an empty value removes a key.
+// Metadata is replaced by the copy so the rest of it is copied from info. The copy is a new object so the created
+// time is kept in the metadata, see objectCreated. It must be called with mu held.
+func (is *ImageService) copyMeta(info minio.ObjectInfo, changes map[string]string) error {
+	meta := map[string]string{
+		"Content-Type": info.ContentType,
+		metaCreated:    objectCreated(info).Format(time.RFC3339Nano),
+	}
+	for _, k := range []string{metaWidth, metaHeight, metaSha256, metaFocus, metaMetadata} {
+		if v := info.Metadata.Get("X-Amz-Meta-" + k); v != "" {
+			meta[k] = v
+		}
+	}
+	for k, v := range changes {
+		if v == "" {
+			delete(meta, k)
+			continue
+		}
+		meta[k] = v
+	}
+
+	dst, err := minio.NewDestinationInfo(is.BucketName, info.Key, nil, meta)
+	if err != nil {
+		return err
+	}
+	return is.Client.CopyObject(dst, minio.NewSourceInfo(is.BucketName, info.Key, nil))
+}
+
+var _ progimage.FocusSetter = &ImageService{}
+
+// SetFocus stores the focal point of the Image with the given id in its metadata, nil removes it. A content
+// addressed image has one focal point for all of its references.
+func (is *ImageService) SetFocus(ctx context.Context, ID string, focus *progimage.Focus) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	info, err := is.Client.StatObject(is.BucketName, ID, minio.StatObjectOptions{})
+	if err != nil {
+		er, ok := err.(minio.ErrorResponse)
+		if ok && er.Code == "NoSuchKey" {
+			return progimage.ErrImageNotFound
+		}
+		return storageError(ctx, err, "error getting image data %s", ID)
+	}
+
+	v := ""
+	if focus != nil {
+		v = focus.String()
+	}
+	if err := is.copyMeta(info, map[string]string{metaFocus: v}); err != nil {
+		return storageError(ctx, err, "error updating image focus %s", ID)
+	}
+	return nil
+}
+
+// objectFocus returns the focal point of an object, nil if it hasn't got one (or it's invalid).
+func objectFocus(info minio.ObjectInfo) *progimage.Focus {
+	f, err := progimage.ParseFocus(info.Metadata.Get("X-Amz-Meta-" + metaFocus))
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+// objectCreated returns the time an object was stored, its last modified time if it was stored without one.
+func objectCreated(info minio.ObjectInfo) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, info.Metadata.Get("X-Amz-Meta-"+metaCreated))
+	if err != nil {
+		return info.LastModified
+	}
+	return t
+}
+
+// storageError wraps an error from the s3 api, anything but an error response to a client error (eg connection
+// refused, a 5xx response) means s3 is unavailable.
+func storageError(ctx context.Context, err error, format string, args ...interface{}) error {
+	wrapped := errors.Wrapf(err, format, args...)
+	if er, ok := err.(minio.ErrorResponse); ok && er.StatusCode < http.StatusInternalServerError {
+		return wrapped
+	}
+	return progimage.StorageUnavailable(ctx, wrapped)
+}
+
+// user metadata keys, stored as X-Amz-Meta-{key}
+const (
+	metaWidth    = "Width"
+	metaHeight   = "Height"
+	metaSha256   = "Sha256"
+	metaFocus    = "Focus"    // x,y fractions, see progimage.Focus
+	metaCreated  = "Created"  // RFC 3339, the object's last modified time changes when its metadata is updated
+	metaMetadata = "Metadata" // true or false, see progimage.ImageInfo.HasMetadata
+)
+
+// Stat returns information about the Image with the given id.
+func (is *ImageService) Stat(ctx context.Context, ID string) (progimage.ImageInfo, error) {
+	ret := progimage.ImageInfo{}
+	if err := ctx.Err(); err != nil {
+		return ret, err
+	}
+	info, err := is.Client.StatObject(is.BucketName, ID, minio.StatObjectOptions{})
+	if err != nil {
+		er, ok := err.(minio.ErrorResponse)
+		if ok && er.Code == "NoSuchKey" {
+			return ret, progimage.ErrImageNotFound
 		}
+		return ret, storageError(ctx, err, "error getting image data %s", ID)
+	}
 
-		return "", progimage.ErrUnrecognisedImageType
+	ret.ID = ID
+	ret.ContentType = info.ContentType
+	ret.Size = info.Size
+	ret.Created = objectCreated(info)
+	ret.Hash = info.Metadata.Get("X-Amz-Meta-" + metaSha256)
+	ret.Width, _ = strconv.Atoi(info.Metadata.Get("X-Amz-Meta-" + metaWidth))   // nolint: gas
+	ret.Height, _ = strconv.Atoi(info.Metadata.Get("X-Amz-Meta-" + metaHeight)) // nolint: gas
+	ret.Focus = objectFocus(info)
+	// objects stored without it are treated as having metadata
+	ret.HasMetadata = info.Metadata.Get("X-Amz-Meta-"+metaMetadata) != "false"
+
+	if ret.Hash == "" || ret.Width == 0 || ret.Height == 0 {
+		// stored without metadata, work it out from the data
+		if err := is.statData(ctx, &ret); err != nil {
+			return ret, err
+		}
 	}
+	return ret, nil
+}
 
-	// nolint: gas,errcheck
-	pw.Close() // io.EOF to read side
-	uploadErr = <-errCh
+// statData populates the dimensions and hash of info by reading the image data.
+func (is *ImageService) statData(ctx context.Context, info *progimage.ImageInfo) error {
+	obj, err := is.Client.GetObjectWithContext(ctx, is.BucketName, info.ID, minio.GetObjectOptions{})
+	if err != nil {
+		return storageError(ctx, err, "error getting image %s", info.ID)
+	}
+	defer obj.Close() // nolint: errcheck
 
-	if uploadErr != nil {
-		return "", errors.Wrap(uploadErr, "error uploading image to s3")
+	h := sha256.New()
+	cfg, _, err := image.DecodeConfig(io.TeeReader(obj, h))
+	if err != nil {
+		return errors.Wrapf(err, "error decoding image %s", info.ID)
+	}
+	if _, err := io.Copy(h, obj); err != nil {
+		return storageError(ctx, err, "error reading image %s", info.ID)
 	}
 
-	return u.String(), nil
+	info.Width = cfg.Width
+	info.Height = cfg.Height
+	info.Hash = hex.EncodeToString(h.Sum(nil))
+	return nil
 }
@@ -1,10 +1,10 @@
 // package s3_test tests the s3 image service against a real s3 api implementation. The following env vars are required
 // to run the tests, tests will be skipped if they're not set (go test -v to see skipped tests).
 //
-//     S3_ENDPOINT
-//     S3_ACCESS_KEY
-//     S3_SECRET_KEY
-//     S3_SECURE
+//	S3_ENDPOINT
+//	S3_ACCESS_KEY
+//	S3_SECRET_KEY
+//	S3_SECURE
 //
 // You can use real s3 creds, alternatively
 // `docker run -p 9000:9000 -e MINIO_ACCESS_KEY=minio -e MINIO_SECRET_KEY=miniostorage minio/minio server /data` will
@@ -13,14 +13,22 @@ package s3_test
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	_ "image/png" // import to register
 	"io"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
 	"github.com/j0hnsmith/progimage/s3"
+	"github.com/j0hnsmith/progimage/servicetest"
 	"github.com/minio/minio-go"
 )
 
@@ -121,7 +129,7 @@ func TestImageService_StoreGetImage(t *testing.T) {
 			initial := bytes.NewReader(d)
 
 			// store then retrieve using id
-			id, err := is.Store(initial)
+			id, err := is.Store(context.Background(), initial)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -132,7 +140,7 @@ func TestImageService_StoreGetImage(t *testing.T) {
 				t.Errorf("expected id to be %s, got %s", uid.String(), id)
 			}
 
-			img, err := is.Get(id)
+			img, err := is.Get(context.Background(), id)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -165,6 +173,61 @@ func TestImageService_StoreGetImage(t *testing.T) {
 	}
 }
 
+func TestImageService_Stat(t *testing.T) {
+	c := checkEnvsAndGetClient(t)
+	setup(t, c)
+
+	is := s3.NewImageService(testBucketName, c, uuid.New)
+	if err := is.EnsureBucket(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ioutil.ReadFile("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := is.Store(context.Background(), bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := is.Stat(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(d)
+	strip, err := primage.HasMetadata(bytes.NewReader(d), "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := progimage.ImageInfo{
+		ID:          id,
+		ContentType: "image/png",
+		Width:       cfg.Width,
+		Height:      cfg.Height,
+		Size:        int64(len(d)),
+		Created:     info.Created,
+		Hash:        hex.EncodeToString(sum[:]),
+		HasMetadata: strip,
+	}
+	if info != expected {
+		t.Errorf("expected info to be %+v, got %+v", expected, info)
+	}
+	if info.Created.IsZero() {
+		t.Error("expected created time to be set")
+	}
+
+	if _, err := is.Stat(context.Background(), "foo"); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound, got %s", err)
+	}
+}
+
 func TestImageService_StoreNoData(t *testing.T) {
 	c := checkEnvsAndGetClient(t)
 	setup(t, c)
@@ -175,7 +238,7 @@ func TestImageService_StoreNoData(t *testing.T) {
 	}
 
 	r := bytes.NewReader([]byte{})
-	if _, err := is.Store(r); err != progimage.ErrUnrecognisedImageType {
+	if _, err := is.Store(context.Background(), r); err != progimage.ErrUnrecognisedImageType {
 		t.Errorf("expected progimage.ErrUnrecognisedImageType, got %s", err)
 	}
 }
@@ -189,7 +252,161 @@ func TestImageService_GetNotExists(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if _, err := is.Get("foo"); err != progimage.ErrImageNotFound {
+	if _, err := is.Get(context.Background(), "foo"); err != progimage.ErrImageNotFound {
 		t.Errorf("expected progimage.ErrImageNotFound, got %s", err)
 	}
 }
+
+func TestImageService_Delete(t *testing.T) {
+	c := checkEnvsAndGetClient(t)
+	setup(t, c)
+
+	is := s3.NewImageService(testBucketName, c, uuid.New)
+	if err := is.EnsureBucket(); err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := os.Open("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	id, err := is.Store(context.Background(), fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := is.Delete(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := is.Get(context.Background(), id); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound after delete, got %s", err)
+	}
+
+	if err := is.Delete(context.Background(), id); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound deleting twice, got %s", err)
+	}
+}
+
+func TestImageService_ContentAddressed(t *testing.T) {
+	c := checkEnvsAndGetClient(t)
+	setup(t, c)
+
+	is := s3.NewImageService(testBucketName, c, uuid.New)
+	is.ContentAddressed = true
+	if err := is.EnsureBucket(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := ioutil.ReadFile("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(d)
+	hash := hex.EncodeToString(sum[:])
+
+	// same data, same id
+	for i := 0; i < 2; i++ {
+		id, err := is.Store(context.Background(), bytes.NewReader(d))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != hash {
+			t.Errorf("expected id to be %s, got %s", hash, id)
+		}
+	}
+
+	// the image is shared, one delete removes it and deleting it again (eg a repeated request) is an error
+	if err := is.Delete(context.Background(), hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := is.Get(context.Background(), hash); err != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound after delete, got %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := is.Delete(context.Background(), hash); err != progimage.ErrImageNotFound {
+			t.Errorf("expected progimage.ErrImageNotFound deleting again, got %s", err)
+		}
+	}
+}
+
+// TestImageService_SetFocusCreated checks updating the metadata of an image doesn't change when it was created.
+func TestImageService_SetFocusCreated(t *testing.T) {
+	c := checkEnvsAndGetClient(t)
+	setup(t, c)
+
+	is := s3.NewImageService(testBucketName, c, uuid.New)
+	if err := is.EnsureBucket(); err != nil {
+		t.Fatal(err)
+	}
+
+	fp, err := os.Open("../testimages/test.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+
+	id, err := is.Store(context.Background(), fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := is.Stat(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// s3 last modified times are in seconds
+	time.Sleep(time.Second)
+	if err := is.SetFocus(context.Background(), id, &progimage.Focus{X: 0.5, Y: 0.5}); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := is.Stat(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.Created.Equal(before.Created) {
+		t.Errorf("expected created time %s, got %s", before.Created, after.Created)
+	}
+	img, err := is.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img.Data.(io.Closer).Close()
+	if !img.LastModified.Equal(before.Created) {
+		t.Errorf("expected last modified time %s, got %s", before.Created, img.LastModified)
+	}
+}
+
+func TestImageService_Conformance(t *testing.T) {
+	c := checkEnvsAndGetClient(t)
+
+	servicetest.Run(t, servicetest.Suite{
+		New: func(t *testing.T) (progimage.ImageService, func()) {
+			setup(t, c)
+			is := s3.NewImageService(testBucketName, c, uuid.New)
+			if err := is.EnsureBucket(); err != nil {
+				t.Fatal(err)
+			}
+			return is, func() {}
+		},
+	})
+}
+
+func TestImageService_ConformanceContentAddressed(t *testing.T) {
+	c := checkEnvsAndGetClient(t)
+
+	servicetest.Run(t, servicetest.Suite{
+		New: func(t *testing.T) (progimage.ImageService, func()) {
+			setup(t, c)
+			is := s3.NewImageService(testBucketName, c, uuid.New)
+			is.ContentAddressed = true
+			if err := is.EnsureBucket(); err != nil {
+				t.Fatal(err)
+			}
+			return is, func() {}
+		},
+	})
+}
@@ -0,0 +1,452 @@
+// Package servicetest implements a suite of tests that check a progimage.ImageService implementation behaves the
+// same as every other implementation. Use it from the implementation's tests:
+//
+//	func TestImageService(t *testing.T) {
+//	    servicetest.Run(t, servicetest.Suite{
+//	        New: func(t *testing.T) (progimage.ImageService, func()) {
+//	            return memory.NewImageService(0, uuid.New), func() {}
+//	        },
+//	    })
+//	}
+package servicetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	_ "image/gif"  // import to register
+	_ "image/jpeg" // import to register
+	"image/png"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/j0hnsmith/progimage"
+	primage "github.com/j0hnsmith/progimage/image"
+)
+
+// Suite describes the implementation under test.
+type Suite struct {
+	// New returns an empty ImageService and a func to clean up after it.
+	New func(t *testing.T) (progimage.ImageService, func())
+
+	// MaxBytes is the size over which Store rejects image data, defaults to primage.DefaultMaxUploadBytes.
+	MaxBytes int64
+
+	// SkipSizeLimit skips the size limit test, it needs MaxBytes of memory (more for some implementations).
+	SkipSizeLimit bool
+}
+
+var fileTests = []struct {
+	Name        string
+	Path        string
+	ContentType string
+}{
+	{Name: "png", Path: "test.png", ContentType: "image/png"},
+	{Name: "gif", Path: "test.gif", ContentType: "image/gif"},
+	{Name: "jpg", Path: "test.jpg", ContentType: "image/jpeg"},
+}
+
+// Run runs the suite as subtests of t.
+func Run(t *testing.T, s Suite) {
+	if s.MaxBytes == 0 {
+		s.MaxBytes = primage.DefaultMaxUploadBytes
+	}
+	t.Run("StoreGet", s.testStoreGet)
+	t.Run("NotFound", s.testNotFound)
+	t.Run("Unrecognised", s.testUnrecognised)
+	t.Run("Delete", s.testDelete)
+	t.Run("Range", s.testRange)
+	t.Run("Focus", s.testFocus)
+	t.Run("SizeLimit", s.testSizeLimit)
+	t.Run("Concurrent", s.testConcurrent)
+}
+
+// testImages returns the path to the test images dir, relative to this file.
+func testImages(t *testing.T) string {
+	_, file, _, ok := runtime.Caller(0)
+	if !ok {
+		t.Fatal("unable to find test images")
+	}
+	return filepath.Join(filepath.Dir(file), "..", "testimages")
+}
+
+func readTestImage(t *testing.T, name string) []byte {
+	d, err := ioutil.ReadFile(filepath.Join(testImages(t), name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// closeData closes the image data if it needs closing.
+func closeData(img progimage.Image) {
+	if c, ok := img.Data.(io.Closer); ok {
+		c.Close() // nolint: errcheck,gas
+	}
+}
+
+func (s Suite) testStoreGet(t *testing.T) {
+	for _, item := range fileTests {
+		t.Run(item.Name, func(t *testing.T) {
+			is, teardown := s.New(t)
+			defer teardown()
+
+			d := readTestImage(t, item.Path)
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id, err := is.Store(context.Background(), bytes.NewReader(d))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id == "" {
+				t.Fatal("expected id to be populated, got empty string")
+			}
+
+			img, err := is.Get(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeData(img)
+
+			if img.ID != id {
+				t.Errorf("expected image id to be '%s', got '%s'", id, img.ID)
+			}
+			if img.ContentType != item.ContentType {
+				t.Errorf("expected image content type to be '%s', got '%s'", item.ContentType, img.ContentType)
+			}
+
+			retrieved, err := ioutil.ReadAll(img.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d, retrieved) {
+				t.Error("expected stored data to be equal to initial data, data not equal")
+			}
+
+			info, err := is.Stat(context.Background(), id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(d)
+			strip, err := primage.HasMetadata(bytes.NewReader(d), item.ContentType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := progimage.ImageInfo{
+				ID:          id,
+				ContentType: item.ContentType,
+				Width:       cfg.Width,
+				Height:      cfg.Height,
+				Size:        int64(len(d)),
+				Created:     info.Created,
+				Hash:        hex.EncodeToString(sum[:]),
+				HasMetadata: strip,
+			}
+			if info != expected {
+				t.Errorf("expected info to be %+v, got %+v", expected, info)
+			}
+			if info.Created.IsZero() {
+				t.Error("expected created time to be set")
+			}
+		})
+	}
+}
+
+func (s Suite) testNotFound(t *testing.T) {
+	is, teardown := s.New(t)
+	defer teardown()
+
+	for _, id := range []string{"foo", "6ba7b810-9dad-11d1-80b4-00c04fd430c8", ".."} {
+		if _, err := is.Get(context.Background(), id); progimage.KindOf(err) != progimage.ErrImageNotFound {
+			t.Errorf("Get(%q) expected progimage.ErrImageNotFound, got %v", id, err)
+		}
+		if _, err := is.Stat(context.Background(), id); progimage.KindOf(err) != progimage.ErrImageNotFound {
+			t.Errorf("Stat(%q) expected progimage.ErrImageNotFound, got %v", id, err)
+		}
+		if err := is.Delete(context.Background(), id); progimage.KindOf(err) != progimage.ErrImageNotFound {
+			t.Errorf("Delete(%q) expected progimage.ErrImageNotFound, got %v", id, err)
+		}
+	}
+}
+
+func (s Suite) testUnrecognised(t *testing.T) {
+	png := readTestImage(t, "test.png")
+
+	var unrecognisedTests = []struct {
+		Name string
+		Data []byte
+	}{
+		{Name: "empty", Data: []byte{}},
+		{Name: "text", Data: []byte("this is not an image")},
+		{Name: "truncated", Data: png[:len(png)/2]},
+		{Name: "header only", Data: png[:16]},
+	}
+
+	for _, item := range unrecognisedTests {
+		t.Run(item.Name, func(t *testing.T) {
+			is, teardown := s.New(t)
+			defer teardown()
+
+			_, err := is.Store(context.Background(), bytes.NewReader(item.Data))
+			if progimage.KindOf(err) != progimage.ErrUnrecognisedImageType {
+				t.Errorf("expected progimage.ErrUnrecognisedImageType, got %v", err)
+			}
+		})
+	}
+}
+
+func (s Suite) testDelete(t *testing.T) {
+	is, teardown := s.New(t)
+	defer teardown()
+
+	id, err := is.Store(context.Background(), bytes.NewReader(readTestImage(t, "test.png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := is.Store(context.Background(), bytes.NewReader(readTestImage(t, "test.gif")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := is.Delete(context.Background(), id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := is.Get(context.Background(), id); progimage.KindOf(err) != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound after delete, got %v", err)
+	}
+	if _, err := is.Stat(context.Background(), id); progimage.KindOf(err) != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound after delete, got %v", err)
+	}
+	if err := is.Delete(context.Background(), id); progimage.KindOf(err) != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound deleting twice, got %v", err)
+	}
+
+	// other images unaffected
+	img, err := is.Get(context.Background(), other)
+	if err != nil {
+		t.Errorf("expected other image to exist after delete, got %v", err)
+	} else {
+		closeData(img)
+	}
+}
+
+func (s Suite) testRange(t *testing.T) {
+	is, teardown := s.New(t)
+	defer teardown()
+
+	rg, ok := is.(progimage.RangeGetter)
+	if !ok {
+		t.Skip("progimage.RangeGetter not implemented")
+	}
+
+	d := readTestImage(t, "test.png")
+	id, err := is.Store(context.Background(), bytes.NewReader(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size := int64(len(d))
+	var rangeTests = []struct {
+		Name   string
+		Offset int64
+		Length int64
+	}{
+		{Name: "start", Offset: 0, Length: 10},
+		{Name: "middle", Offset: size / 2, Length: 100},
+		{Name: "end", Offset: size - 1, Length: 1},
+		{Name: "all", Offset: 0, Length: size},
+	}
+	for _, item := range rangeTests {
+		t.Run(item.Name, func(t *testing.T) {
+			img, err := rg.GetRange(context.Background(), id, item.Offset, item.Length)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer closeData(img)
+
+			if img.ContentType != "image/png" {
+				t.Errorf("expected image content type to be 'image/png', got '%s'", img.ContentType)
+			}
+			retrieved, err := ioutil.ReadAll(img.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(d[item.Offset:item.Offset+item.Length], retrieved) {
+				t.Errorf("expected %d bytes from %d, got %d bytes not equal", item.Length, item.Offset, len(retrieved))
+			}
+		})
+	}
+
+	if _, err := rg.GetRange(context.Background(), "foo", 0, 1); progimage.KindOf(err) != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound, got %v", err)
+	}
+}
+
+func (s Suite) testFocus(t *testing.T) {
+	is, teardown := s.New(t)
+	defer teardown()
+
+	fs, ok := is.(progimage.FocusSetter)
+	if !ok {
+		t.Skip("progimage.FocusSetter not implemented")
+	}
+
+	id, err := is.Store(context.Background(), bytes.NewReader(readTestImage(t, "test.png")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFocus := func(expected *progimage.Focus) {
+		t.Helper()
+		info, err := is.Stat(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := is.Get(context.Background(), id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		closeData(img)
+
+		for name, f := range map[string]*progimage.Focus{"Stat": info.Focus, "Get": img.Focus} {
+			if (f == nil) != (expected == nil) || f != nil && *f != *expected {
+				t.Errorf("expected %s focus %v, got %v", name, expected, f)
+			}
+		}
+	}
+
+	checkFocus(nil)
+
+	focus := &progimage.Focus{X: 0.25, Y: 0.75}
+	if err := fs.SetFocus(context.Background(), id, focus); err != nil {
+		t.Fatal(err)
+	}
+	checkFocus(&progimage.Focus{X: 0.25, Y: 0.75})
+
+	// the image is unchanged
+	info, err := is.Stat(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "image/png" || info.Width != 1000 || info.Height != 476 {
+		t.Errorf("expected the image info to be unchanged, got %+v", info)
+	}
+
+	if err := fs.SetFocus(context.Background(), id, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkFocus(nil)
+
+	if err := fs.SetFocus(context.Background(), "foo", focus); progimage.KindOf(err) != progimage.ErrImageNotFound {
+		t.Errorf("expected progimage.ErrImageNotFound, got %v", err)
+	}
+}
+
+// noisePNG returns an uncompressed png, made of random pixels, of more than size bytes.
+func noisePNG(t *testing.T, size int64) []byte {
+	// opaque so encoded as 3 bytes per pixel
+	const width = 1024
+	height := int(size/(width*3)) + 1
+	m := image.NewNRGBA(image.Rect(0, 0, width, height))
+	rand.Read(m.Pix) // nolint: gas
+	for i := 3; i < len(m.Pix); i += 4 {
+		m.Pix[i] = 0xff
+	}
+
+	buf := new(bytes.Buffer)
+	enc := png.Encoder{CompressionLevel: png.NoCompression}
+	if err := enc.Encode(buf, m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func (s Suite) testSizeLimit(t *testing.T) {
+	if s.SkipSizeLimit || testing.Short() {
+		t.Skip("skipping size limit test")
+	}
+	is, teardown := s.New(t)
+	defer teardown()
+
+	d := noisePNG(t, s.MaxBytes)
+	_, err := is.Store(context.Background(), bytes.NewReader(d))
+	if progimage.KindOf(err) != progimage.ErrImageTooLarge {
+		t.Errorf("expected ErrImageTooLarge storing %d bytes (limit %d), got %v", len(d), s.MaxBytes, err)
+	}
+}
+
+func (s Suite) testConcurrent(t *testing.T) {
+	is, teardown := s.New(t)
+	defer teardown()
+
+	// small image so the test is quick
+	m := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	m.Set(0, 0, color.NRGBA{R: 0xff, A: 0xff})
+
+	const n = 10
+	var wg sync.WaitGroup
+	ids := make([]string, n)
+	data := make([][]byte, n)
+	for i := 0; i < n; i++ {
+		// each image is different
+		m.Set(1, 0, color.NRGBA{G: uint8(i), A: 0xff})
+		buf := new(bytes.Buffer)
+		if err := png.Encode(buf, m); err != nil {
+			t.Fatal(err)
+		}
+		data[i] = buf.Bytes()
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id, err := is.Store(context.Background(), bytes.NewReader(data[i]))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for i := 0; i < n; i++ {
+		if ids[i] == "" {
+			continue
+		}
+		if seen[ids[i]] {
+			t.Errorf("duplicate id %s", ids[i])
+		}
+		seen[ids[i]] = true
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			img, err := is.Get(context.Background(), ids[i])
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer closeData(img)
+			retrieved, err := ioutil.ReadAll(img.Data)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(data[i], retrieved) {
+				t.Errorf("expected image %d data to be equal to stored data", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}